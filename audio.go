@@ -0,0 +1,260 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// what loudnorm aims for next to the integrated loudness of the loudnesstarget setting, like EBU R128 says.
+const (
+	loudnormTruePeak = -1.0
+	loudnormRange    = 11.0
+)
+
+// audioBitratesFor reads the audiobitrates setting, like aac:160,opus:128, into the kbit/s for each codec.
+func audioBitratesFor(config Config) (map[string]int, error) {
+	bitrates := map[string]int{}
+	for _, item := range splitList(config.AudioBitrates) {
+		codec, value, _ := strings.Cut(item, ":")
+		kbits, err := strconv.Atoi(strings.TrimSpace(value))
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if _, ok := audioEncoders[codec]; !ok || codec == "copy" || err != nil || kbits <= 0 {
+			return nil, fmt.Errorf("invalid audiobitrates %q, use codec:kbit/s for aac and opus, like aac:160,opus:128", item)
+		}
+		bitrates[codec] = kbits
+	}
+	return bitrates, nil
+}
+
+// downmixFilter mixes audio with more than two channels down to stereo. The center and surround channels
+// go into both sides at -3 dB and the LFE gets dropped, as usual for 5.1 and 7.1, and the gains get
+// normalized so nothing clips. Other layouts use the matrix of ffmpeg. It's empty for mono and stereo.
+func downmixFilter(channels int, layout string) string {
+	if channels <= 2 {
+		return ""
+	}
+	switch layout {
+	case "5.1":
+		return "pan=stereo|FL<FL+0.707*FC+0.707*BL|FR<FR+0.707*FC+0.707*BR"
+	case "5.1(side)":
+		return "pan=stereo|FL<FL+0.707*FC+0.707*SL|FR<FR+0.707*FC+0.707*SR"
+	case "7.1":
+		return "pan=stereo|FL<FL+0.707*FC+0.707*BL+0.707*SL|FR<FR+0.707*FC+0.707*BR+0.707*SR"
+	}
+	return "aformat=channel_layouts=stereo"
+}
+
+// Loudness is what the first pass of loudnorm measured.
+type Loudness struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// loudnormFilter normalizes the loudness to target LUFS. With what the first pass measured it can do that
+// linearly, without it loudnorm has to guess as it goes. It works at 192 kHz, so it gets resampled after.
+func loudnormFilter(target float64, measured *Loudness) string {
+	filter := fmt.Sprintf("loudnorm=I=%v:TP=%v:LRA=%v", target, loudnormTruePeak, loudnormRange)
+	if measured != nil {
+		filter += fmt.Sprintf(":measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh, measured.TargetOffset)
+	}
+	return filter + ",aresample=48000"
+}
+
+// loudnessCommand is the first pass of loudnorm on the audio stream, after the filters before it.
+func loudnessCommand(input, stream string, filters []string, target float64) *FFmpegCommand {
+	measure := fmt.Sprintf("loudnorm=I=%v:TP=%v:LRA=%v:print_format=json", target, loudnormTruePeak, loudnormRange)
+	return NewFFmpegCommand().
+		Globals("-hide_banner", "-nostats").
+		Input(input).
+		Map(stream).
+		AudioFilter(append(filters, measure)...).
+		Options("-vn", "-sn", "-f", "null").
+		Output("-")
+}
+
+// measureLoudness runs the first pass of loudnorm, which prints what it measured as JSON at the end.
+func measureLoudness(cmd *FFmpegCommand) (*Loudness, error) {
+	Log(cmd)
+	var output strings.Builder
+	err := streamTool(context.Background(), "ffmpeg", cmd.Args(), func(stderr io.Reader) {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			output.WriteString(scanner.Text() + "\n")
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot measure the loudness: %w", err)
+	}
+	return parseLoudness(output.String())
+}
+
+// parseLoudness reads the JSON loudnorm prints after its [Parsed_loudnorm_0 @ 0x55d4] line.
+func parseLoudness(output string) (*Loudness, error) {
+	start, end := strings.LastIndex(output, "{"), strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("loudnorm didn't print what it measured")
+	}
+	var loudness Loudness
+	if err := json.Unmarshal([]byte(output[start:end+1]), &loudness); err != nil {
+		return nil, fmt.Errorf("cannot read what loudnorm measured: %w", err)
+	}
+	if loudness.InputI == "" || strings.Contains(loudness.InputI, "inf") {
+		return nil, fmt.Errorf("loudnorm measured silence")
+	}
+	return &loudness, nil
+}
+
+// AudioOutput is an audio track that goes into the output.
+type AudioOutput struct {
+	Map      string   // what to -map for it
+	Language string   // the language tag of the track, set on the output when there's more than one track
+	Filters  []string // the downmix and loudness normalization
+}
+
+// audioTracks are the ids of the audio tracks that go into the output, the best one first.
+func (tracks *SelectedTracks) audioTracks() []int {
+	if tracks == nil || tracks.AudioTrack < 0 {
+		return nil
+	}
+	return append([]int{tracks.AudioTrack}, tracks.ExtraAudio...)
+}
+
+// audioOutputs works out the audio tracks of the output and how they get filtered. The loudness
+// gets measured first, except on a dry run, which plans the measuring and does a single pass.
+func (j *Job) audioOutputs(profile Profile) ([]AudioOutput, error) {
+	info, err := j.mediaInfo()
+	if err != nil {
+		return nil, err
+	}
+	probe, _ := j.probeInfo()
+	// old devices only play stereo.
+	downmix := j.Config.Downmix || profile.Compat
+	filtering := downmix || j.Config.Loudnorm
+	if filtering && profile.Audio == "copy" {
+		log.Printf("Can't downmix or normalize the audio the %s profile copies, use a profile that encodes the audio.\n", profile.Name)
+		filtering = false
+	}
+	var outputs []AudioOutput
+	for _, id := range j.Tracks.audioTracks() {
+		output := AudioOutput{Map: j.mapTrack(id)}
+		track, _ := info.Track(id)
+		var stream media.Stream
+		if probe != nil {
+			if index, ok := media.NewTrackMap(*info, *probe).StreamIndex(id); ok {
+				stream, _ = probe.Stream(index)
+			}
+		}
+		output.Language = track.Language
+		if lang, err := stream.GetLanguage(); err == nil {
+			// ffmpeg wants the language the way it reads it.
+			output.Language = lang
+		}
+		if !filtering {
+			outputs = append(outputs, output)
+			continue
+		}
+		if downmix {
+			channels := max(track.Channels, stream.Channels)
+			if downmix := downmixFilter(channels, stream.ChannelLayout); downmix != "" {
+				output.Filters = append(output.Filters, downmix)
+			}
+		}
+		if j.Config.Loudnorm {
+			loudnorm, err := j.loudnorm(output)
+			if err != nil {
+				return nil, err
+			}
+			output.Filters = append(output.Filters, loudnorm)
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// loudnorm gives the filter normalizing the loudness of the output, measured after its other filters.
+func (j *Job) loudnorm(output AudioOutput) (string, error) {
+	cmd := loudnessCommand(j.Input, output.Map, output.Filters, j.Config.LoudnessTarget)
+	if j.DryRun() {
+		j.Plan.Commands = append(j.Plan.Commands, cmd.String())
+		return loudnormFilter(j.Config.LoudnessTarget, nil), nil
+	}
+	log.Println("Measuring the loudness of", output.Map, "...")
+	measured, err := measureLoudness(cmd)
+	if err != nil {
+		return "", fmt.Errorf("cannot normalize the loudness of %s: %w", j.Input, err)
+	}
+	Log("Loudness of", output.Map, "is", measured.InputI, "LUFS")
+	return loudnormFilter(j.Config.LoudnessTarget, measured), nil
+}
+
+// audioOptions filter each audio output and tag it with its language when there's more than one.
+func audioOptions(outputs []AudioOutput) []string {
+	var opts []string
+	for i, output := range outputs {
+		if len(output.Filters) > 0 {
+			opts = append(opts, fmt.Sprintf("-filter:a:%d", i), strings.Join(output.Filters, ","))
+		}
+		if len(outputs) > 1 && output.Language != "" {
+			opts = append(opts, fmt.Sprintf("-metadata:s:a:%d", i), "language="+output.Language)
+		}
+	}
+	return opts
+}
+
+// extraAudio picks up to count more audio tracks after the best one, the best scoring one of each
+// language that isn't in the output yet, like the dub next to the original.
+func extraAudio(tracks []ScoredTrack, best, count int) []int {
+	var candidates []ScoredTrack
+	var kept []string
+	for _, t := range tracks {
+		if t.Type != media.Audio {
+			continue
+		}
+		if t.ID == best {
+			kept = append(kept, t.Language)
+		} else if t.Excluded == "" {
+			candidates = append(candidates, t)
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b ScoredTrack) int { return b.Score - a.Score })
+	var extra []int
+	for _, t := range candidates {
+		if len(extra) == count {
+			break
+		}
+		if slices.ContainsFunc(kept, func(lang string) bool { return lang == t.Language || media.SameLanguage(lang, t.Language) }) {
+			continue
+		}
+		kept = append(kept, t.Language)
+		extra = append(extra, t.ID)
+	}
+	return extra
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gertm/hardsub/media"
+)
+
+func TestAudioBitratesFor(t *testing.T) {
+	got, err := audioBitratesFor(Config{AudioBitrates: "aac:160, OPUS:128"})
+	if want := map[string]int{"aac": 160, "opus": 128}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("audioBitratesFor() = %v, %v, want %v", got, err, want)
+	}
+	for _, setting := range []string{"aac", "mp3:192", "copy:128", "aac:lots", "opus:-1"} {
+		if _, err := audioBitratesFor(Config{AudioBitrates: setting}); err == nil {
+			t.Errorf("audioBitratesFor(%q) accepts it", setting)
+		}
+	}
+	rate, err := rateControlFor(Config{Profile: "webm-vp9", AudioBitrates: "aac:160,opus:128"})
+	if err != nil || rate.AudioBitrate != 128 {
+		t.Errorf("rateControlFor() = %+v, %v, want the opus bitrate", rate, err)
+	}
+}
+
+func TestDownmixFilter(t *testing.T) {
+	tests := []struct {
+		channels int
+		layout   string
+		want     string
+	}{
+		{2, "stereo", ""},
+		{1, "mono", ""},
+		{6, "5.1", "pan=stereo|FL<FL+0.707*FC+0.707*BL|FR<FR+0.707*FC+0.707*BR"},
+		{6, "5.1(side)", "pan=stereo|FL<FL+0.707*FC+0.707*SL|FR<FR+0.707*FC+0.707*SR"},
+		{8, "7.1", "pan=stereo|FL<FL+0.707*FC+0.707*BL+0.707*SL|FR<FR+0.707*FC+0.707*BR+0.707*SR"},
+		{3, "2.1", "aformat=channel_layouts=stereo"},
+	}
+	for _, tt := range tests {
+		if got := downmixFilter(tt.channels, tt.layout); got != tt.want {
+			t.Errorf("downmixFilter(%d, %s) = %q, want %q", tt.channels, tt.layout, got, tt.want)
+		}
+	}
+}
+
+// what the first pass of loudnorm prints at the end.
+const loudnormOutput = `size=N/A time=00:23:40.04 bitrate=N/A speed= 412x
+[Parsed_loudnorm_1 @ 0x5581c0a3e940]
+{
+	"input_i" : "-17.52",
+	"input_tp" : "-0.43",
+	"input_lra" : "9.80",
+	"input_thresh" : "-27.75",
+	"output_i" : "-23.05",
+	"output_tp" : "-5.66",
+	"output_lra" : "8.40",
+	"output_thresh" : "-33.22",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.05"
+}
+`
+
+func TestParseLoudness(t *testing.T) {
+	got, err := parseLoudness(loudnormOutput)
+	want := &Loudness{InputI: "-17.52", InputTP: "-0.43", InputLRA: "9.80", InputThresh: "-27.75", TargetOffset: "0.05"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseLoudness() = %+v, %v, want %+v", got, err, want)
+	}
+	filter := "loudnorm=I=-23:TP=-1:LRA=11:measured_I=-17.52:measured_TP=-0.43:measured_LRA=9.80:measured_thresh=-27.75:offset=0.05:linear=true,aresample=48000"
+	if got := loudnormFilter(-23, got); got != filter {
+		t.Errorf("loudnormFilter() = %s, want %s", got, filter)
+	}
+	if _, err := parseLoudness("Stream map '0:a:3' matches no streams."); err == nil {
+		t.Error("parseLoudness() without the JSON, want an error")
+	}
+	silence := strings.Replace(loudnormOutput, `"-17.52"`, `"-inf"`, 1)
+	if _, err := parseLoudness(silence); err == nil {
+		t.Error("parseLoudness() of silence, want an error")
+	}
+}
+
+func TestExtraAudio(t *testing.T) {
+	track := func(id int, lang string, score int, excluded string) ScoredTrack {
+		return ScoredTrack{Track: media.Track{ID: id, Type: media.Audio, Language: lang}, Score: score, Excluded: excluded}
+	}
+	tracks := []ScoredTrack{
+		{Track: media.Track{ID: 0, Type: media.Video}},
+		track(1, "jpn", 100, ""),
+		track(2, "ja", 90, ""), // the same language as the best one
+		track(3, "eng", 80, ""),
+		track(4, "en", 85, "commentary"),
+		track(5, "ger", 10, ""),
+		track(6, "eng", 70, ""),
+	}
+	if got, want := extraAudio(tracks, 1, 1), []int{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extraAudio() = %v, want %v", got, want)
+	}
+	if got, want := extraAudio(tracks, 1, 5), []int{3, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extraAudio() = %v, want %v", got, want)
+	}
+}
+
+// audioJob is a job for an mp4 with Japanese 5.1 audio and an English stereo dub.
+func audioJob(t *testing.T, config Config, responses ...FakeResponse) *Job {
+	t.Helper()
+	video := path.Join(t.TempDir(), "show_01.mp4")
+	useFakeRunner(t, append([]FakeResponse{{
+		Name: "ffprobe",
+		Args: append(ffprobe_args, video),
+		Stdout: `{"streams": [
+			{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080},
+			{"index": 1, "codec_name": "eac3", "codec_type": "audio", "channels": 6, "channel_layout": "5.1(side)", "tags": {"language": "jpn"}},
+			{"index": 2, "codec_name": "aac", "codec_type": "audio", "channels": 2, "channel_layout": "stereo", "tags": {"language": "eng"}},
+			{"index": 3, "codec_name": "ass", "codec_type": "subtitle", "tags": {"language": "eng"}}],
+			"format": {"filename": "` + video + `", "duration": "1420.000000"}}`,
+	}}, responses...)...)
+	config.AudioLang = "ja,en"
+	config.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1}
+	job := NewJob(video, config)
+	info, err := job.mediaInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	selection, err := selectTracks(info, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Tracks = &selection.Selected
+	return job
+}
+
+func TestAudioOutputs(t *testing.T) {
+	job := audioJob(t, Config{Profile: "mp4-h264", Downmix: true, Loudnorm: true, LoudnessTarget: -23, AudioTracks: 2},
+		FakeResponse{Name: "ffmpeg", Stderr: loudnormOutput})
+	if len(job.Tracks.ExtraAudio) != 0 {
+		t.Errorf("mp4 output keeps audio tracks %v, want only the best one", job.Tracks.ExtraAudio)
+	}
+	profile, _ := outputProfile(job.Config)
+	outputs, err := job.audioOutputs(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AudioOutput{{Map: "0:1", Language: "jpn", Filters: []string{
+		"pan=stereo|FL<FL+0.707*FC+0.707*SL|FR<FR+0.707*FC+0.707*SR",
+		"loudnorm=I=-23:TP=-1:LRA=11:measured_I=-17.52:measured_TP=-0.43:measured_LRA=9.80:measured_thresh=-27.75:offset=0.05:linear=true,aresample=48000",
+	}}}
+	if !reflect.DeepEqual(outputs, want) {
+		t.Errorf("audioOutputs() = %+v\nwant %+v", outputs, want)
+	}
+	want[0].Filters = []string{strings.Join(want[0].Filters, ",")}
+	if got := audioOptions(outputs); !reflect.DeepEqual(got, []string{"-filter:a:0", want[0].Filters[0]}) {
+		t.Errorf("audioOptions() = %v", got)
+	}
+}
+
+func TestMultipleAudioTracks(t *testing.T) {
+	job := audioJob(t, Config{Profile: "mkv-h264", Downmix: true, AudioTracks: 2})
+	if want := []int{2}; !reflect.DeepEqual(job.Tracks.ExtraAudio, want) {
+		t.Fatalf("ExtraAudio = %v, want %v", job.Tracks.ExtraAudio, want)
+	}
+	profile, _ := outputProfile(job.Config)
+	// the mkv profile copies the audio, so it can't be downmixed.
+	outputs, err := job.audioOutputs(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-metadata:s:a:0", "language=jpn", "-metadata:s:a:1", "language=eng"}
+	if got := audioOptions(outputs); !reflect.DeepEqual(got, want) {
+		t.Errorf("audioOptions() = %v, want %v", got, want)
+	}
+	if got := []string{outputs[0].Map, outputs[1].Map}; !reflect.DeepEqual(got, []string{"0:1", "0:2"}) {
+		t.Errorf("audio maps = %v", got)
+	}
+	encode, err := job.encoding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encode(NewFFmpegCommand().Input("out.mkv")).String(); !strings.HasPrefix(got, "ffmpeg -i out.mkv -map 0:v -map 0:a -c:a copy") {
+		t.Errorf("cutting doesn't keep the audio tracks: %s", got)
+	}
+}
+
+func TestCompatAudio(t *testing.T) {
+	job := audioJob(t, Config{Profile: "mp4-h264-compat", AudioBitrates: "aac:128"})
+	profile, _ := outputProfile(job.Config)
+	// old devices only play stereo, so the 5.1 track gets downmixed without the downmix setting.
+	outputs, err := job.audioOutputs(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pan=stereo|FL<FL+0.707*FC+0.707*SL|FR<FR+0.707*FC+0.707*SR"}; len(outputs) != 1 || !reflect.DeepEqual(outputs[0].Filters, want) {
+		t.Errorf("audioOutputs() = %+v, want the downmix", outputs)
+	}
+	encode, err := job.encoding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := encode(NewFFmpegCommand().Input("in.mp4")).String()
+	if !strings.Contains(got, "-b:a 128k") || strings.Contains(got, "-ac 2") {
+		t.Errorf("want the audio at the bitrate of audiobitrates without -ac 2: %s", got)
+	}
+}
+
+func TestLoudnormPlan(t *testing.T) {
+	job := audioJob(t, Config{Profile: "mp4-h264", Loudnorm: true, LoudnessTarget: -16})
+	job.Plan = &Plan{}
+	profile, _ := outputProfile(job.Config)
+	outputs, err := job.audioOutputs(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ffmpeg -hide_banner -nostats -i " + job.Input + " -map 0:1 -af loudnorm=I=-16:TP=-1:LRA=11:print_format=json -vn -sn -f null -"; !reflect.DeepEqual(job.Plan.Commands, []string{want}) {
+		t.Errorf("planned %v, want %s", job.Plan.Commands, want)
+	}
+	if want := []string{"loudnorm=I=-16:TP=-1:LRA=11,aresample=48000"}; !reflect.DeepEqual(outputs[0].Filters, want) {
+		t.Errorf("filters = %v, want %v", outputs[0].Filters, want)
+	}
+}
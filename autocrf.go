@@ -0,0 +1,363 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the values of the 'qualitymetric' setting.
+const (
+	metricVmaf = "vmaf" // 0 to 100, with ffmpeg's libvmaf filter
+	metricSsim = "ssim" // 0 to 1, with ffmpeg's ssim filter
+)
+
+// how the quality ratecontrol samples the video.
+const (
+	qualitySamples      = 3
+	qualitySampleLength = 5 * time.Second
+)
+
+// qualityCrfs are the crfs the quality ratecontrol tries, around the usual one.
+func qualityCrfs(usual int) []int {
+	var crfs []int
+	for crf := usual - 4; crf <= usual+10; crf += 2 {
+		if crf > 0 {
+			crfs = append(crfs, crf)
+		}
+	}
+	return crfs
+}
+
+// checkQualityTarget checks the qualitytarget setting is a score the metric can give.
+func checkQualityTarget(config Config) error {
+	max := map[string]float64{metricVmaf: 100, metricSsim: 1}[config.QualityMetric]
+	if max == 0 {
+		return fmt.Errorf("unknown qualitymetric %q, use %s or %s", config.QualityMetric, metricVmaf, metricSsim)
+	}
+	if config.QualityTarget <= 0 || config.QualityTarget > max {
+		return fmt.Errorf("ratecontrol %s needs a qualitytarget between 0 and %v for %s", rateQuality, max, config.QualityMetric)
+	}
+	return nil
+}
+
+// searchCrf tries the crfs from the highest down, and returns the first one whose score reaches target,
+// which is the highest crf that does. When none does, it's the lowest with its score.
+func searchCrf(crfs []int, target float64, score func(crf int) (float64, error)) (int, float64, error) {
+	crfs = append([]int{}, crfs...)
+	sort.Sort(sort.Reverse(sort.IntSlice(crfs)))
+	var crf int
+	var got float64
+	for _, crf = range crfs {
+		var err error
+		if got, err = score(crf); err != nil {
+			return 0, 0, err
+		}
+		Log("crf", crf, "scores", got)
+		if got >= target {
+			return crf, got, nil
+		}
+	}
+	return crf, got, nil
+}
+
+// sampleTimes are where the samples of a video of duration start, spread over the video.
+func sampleTimes(duration time.Duration) []time.Duration {
+	if duration < qualitySamples*qualitySampleLength*2 {
+		return []time.Duration{0}
+	}
+	var times []time.Duration
+	for i := 1; i <= qualitySamples; i++ {
+		times = append(times, duration*time.Duration(i)/(qualitySamples+1))
+	}
+	return times
+}
+
+// qualityCrf is the crf for the quality ratecontrol: the one cached for the series, or the highest one
+// that makes samples of the input reach the quality target.
+func (j *Job) qualityCrf() (int, error) {
+	encoder, err := j.encoder()
+	if err != nil {
+		return 0, err
+	}
+	series := j.seriesPrefix()
+	key := CrfCacheKey{Series: series, Metric: j.Config.QualityMetric, Target: j.Config.QualityTarget, Encoder: encoder.Name}
+	if choice, ok := crfCache.Get(j.Input, key); ok {
+		log.Printf("Using crf %d for %s, it scored %.3f %s before.\n", choice.Crf, series, choice.Score, key.Metric)
+		return choice.Crf, nil
+	}
+	crfs := qualityCrfs(j.Config.crf())
+	if j.DryRun() {
+		// measuring means encoding, so the plan uses the usual crf.
+		j.Plan.Crf = fmt.Sprintf("the highest of %v reaching %s %v in samples", crfs, key.Metric, key.Target)
+		return j.Config.crf(), nil
+	}
+	info, err := j.mediaInfo()
+	if err != nil {
+		return 0, err
+	}
+	geometry, err := j.geometry()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Looking for the crf reaching %s %v for %s...\n", key.Metric, key.Target, series)
+	crf, score, err := searchCrf(crfs, key.Target, func(crf int) (float64, error) {
+		return j.sampleScore(encoder, crf, sampleTimes(info.Duration), geometry.Filters())
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot pick the crf for %s: %w", j.Input, err)
+	}
+	if score < key.Target {
+		log.Printf("Even crf %d only scores %.3f %s, using it anyway.\n", crf, score, key.Metric)
+	} else {
+		log.Printf("Using crf %d for %s, it scores %.3f %s.\n", crf, series, score, key.Metric)
+	}
+	if err := crfCache.Put(key, CrfChoice{Crf: crf, Score: score, Time: time.Now()}); err != nil {
+		LogErrorln("Cannot remember the crf:", err)
+	}
+	return crf, nil
+}
+
+// sampleScore encodes the samples starting at times with crf and returns their average score.
+// The samples and what they get compared to go through the filters of the geometry.
+func (j *Job) sampleScore(encoder Encoder, crf int, times []time.Duration, filters []string) (float64, error) {
+	config := j.Config
+	config.Crf = crf
+	var total float64
+	for i, start := range times {
+		sample := j.workspaceFile(fmt.Sprintf("sample%d_crf%d.mkv", i, crf))
+		if err := runQuiet(sampleCommand(j.Input, sample, start, encoder, config, filters)); err != nil {
+			return 0, fmt.Errorf("cannot encode a sample: %w", err)
+		}
+		score, err := measureQuality(measureCommand(sample, j.Input, start, config.QualityMetric, filters), config.QualityMetric)
+		os.Remove(sample)
+		if err != nil {
+			return 0, err
+		}
+		total += score
+	}
+	return total / float64(len(times)), nil
+}
+
+// sampleCommand encodes qualitySampleLength of the video in input from start, without the audio.
+func sampleCommand(input, sample string, start time.Duration, encoder Encoder, config Config, filters []string) *FFmpegCommand {
+	cmd := quietFFmpeg().
+		Input(input, "-ss", formatDuration(start), "-t", formatDuration(qualitySampleLength)).
+		Map("0:v:0").
+		VideoFilter(filters...).
+		Options("-an")
+	return encoder.apply(cmd, config, RateControl{Mode: rateCrf}).Output(sample)
+}
+
+// measureCommand compares the sample to the same part of the input with the metric.
+// The filters log the score at the end, so this needs the info log level.
+func measureCommand(sample, input string, start time.Duration, metric string, filters []string) *FFmpegCommand {
+	filter := "ssim"
+	if metric == metricVmaf {
+		filter = "libvmaf"
+	}
+	graph, reference := "", "[1:v]"
+	if len(filters) > 0 {
+		graph, reference = "[1:v]"+strings.Join(filters, ",")+"[ref];", "[ref]"
+	}
+	graph += "[0:v]" + reference + filter
+	return NewFFmpegCommand().
+		Globals("-hide_banner", "-nostats").
+		Input(sample).
+		Input(input, "-ss", formatDuration(start), "-t", formatDuration(qualitySampleLength)).
+		FilterComplex(graph).
+		Options("-f", "null").
+		Output("-")
+}
+
+func runQuiet(cmd *FFmpegCommand) error {
+	Log(cmd)
+	return streamTool(context.Background(), "ffmpeg", cmd.Args(), func(stderr io.Reader) {})
+}
+
+// measureQuality runs the measure command and reads the score from what the filter logs.
+func measureQuality(cmd *FFmpegCommand, metric string) (float64, error) {
+	Log(cmd)
+	score := -1.0
+	err := streamTool(context.Background(), "ffmpeg", cmd.Args(), func(stderr io.Reader) {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if s, ok := parseQualityScore(scanner.Text(), metric); ok {
+				score = s
+			}
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot measure the %s of a sample: %w", metric, err)
+	}
+	if score < 0 {
+		return 0, fmt.Errorf("ffmpeg didn't give a %s score", metric)
+	}
+	return score, nil
+}
+
+var (
+	vmafScore = regexp.MustCompile(`VMAF score: ([0-9.]+)`)
+	ssimScore = regexp.MustCompile(`SSIM .*All:([0-9.]+)`)
+)
+
+// parseQualityScore reads the score from the line the libvmaf or ssim filter logs when it's done:
+//
+//	[libvmaf @ 0x5581c0a3e940] VMAF score: 94.387661
+//	[Parsed_ssim_0 @ 0x5581c0a3e940] SSIM Y:0.981163 (17.249) U:0.989532 (19.802) V:0.988943 (19.563) All:0.984000 (17.959)
+func parseQualityScore(line, metric string) (float64, bool) {
+	pattern := ssimScore
+	if metric == metricVmaf {
+		pattern = vmafScore
+	}
+	m := pattern.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	score, err := strconv.ParseFloat(m[1], 64)
+	return score, err == nil
+}
+
+// episodeNumber finds where the episode number starts in a filename: show_01, Show - 01 or Show.S01E02.
+var episodeNumber = regexp.MustCompile(`(?i)[ ._-]*(s\d{1,2}e\d{1,3}|ep?\s?\d{1,3}|\d{1,3})(v\d)?([ ._\[\(-]|$)`)
+
+// seriesPrefix is what the videos of the series of the input start with: the introframes key it matches,
+// or the part of the name before the episode number.
+func (j *Job) seriesPrefix() string {
+	for prefix := range j.Config.IntroFrames {
+		if hasSeriesPrefix(j.Input, prefix) {
+			return strings.ToLower(prefix)
+		}
+	}
+	base := path.Base(j.Input)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	for _, loc := range episodeNumber.FindAllStringIndex(base, -1) {
+		if prefix := strings.TrimRight(base[:loc[0]], " ._-"); prefix != "" {
+			return strings.ToLower(prefix)
+		}
+	}
+	return strings.ToLower(base)
+}
+
+// CrfCacheKey is what a crf the quality ratecontrol picked depends on.
+type CrfCacheKey struct {
+	Series  string  `json:"series"`
+	Metric  string  `json:"metric"`
+	Target  float64 `json:"target"`
+	Encoder string  `json:"encoder"`
+}
+
+type CrfChoice struct {
+	Crf   int       `json:"crf"`
+	Score float64   `json:"score"`
+	Time  time.Time `json:"time"`
+}
+
+type crfCacheEntry struct {
+	CrfCacheKey
+	CrfChoice
+}
+
+// CrfCache remembers the crfs the quality ratecontrol picked for each series in a JSON file,
+// so only the first episode gets sampled.
+type CrfCache struct {
+	mu       sync.Mutex
+	filename string
+	entries  map[CrfCacheKey]CrfChoice
+}
+
+// crfCache is where the quality ratecontrol remembers its crfs, nothing gets remembered when it's nil.
+var crfCache *CrfCache
+
+func crfCacheFilename() string {
+	return filepath.Join(filepath.Dir(configFilename()), "crfcache.json")
+}
+
+// OpenCrfCache reads the crfs remembered in filename.
+func OpenCrfCache(filename string) (*CrfCache, error) {
+	c := &CrfCache{filename: filename, entries: map[CrfCacheKey]CrfChoice{}}
+	raw, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []crfCacheEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("cannot read crf cache %s: %w", filename, err)
+	}
+	for _, e := range entries {
+		c.entries[e.CrfCacheKey] = e.CrfChoice
+	}
+	return c, nil
+}
+
+// Get finds the crf picked before for a video of the series of filename, matching the series prefixes
+// the same way as the keys of the introframes setting. The longest prefix wins, the series of key is ignored.
+func (c *CrfCache) Get(filename string, key CrfCacheKey) (CrfChoice, bool) {
+	if c == nil {
+		return CrfChoice{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var found CrfChoice
+	series := ""
+	for k, choice := range c.entries {
+		if len(k.Series) > len(series) && hasSeriesPrefix(filename, k.Series) && k.Metric == key.Metric && k.Target == key.Target && k.Encoder == key.Encoder {
+			found, series = choice, k.Series
+		}
+	}
+	return found, series != ""
+}
+
+// Put remembers the crf picked for key and saves the cache.
+func (c *CrfCache) Put(key CrfCacheKey, choice CrfChoice) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = choice
+	var entries []crfCacheEntry
+	for k, v := range c.entries {
+		entries = append(entries, crfCacheEntry{k, v})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Series < entries[j].Series })
+	raw, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.filename + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.filename)
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchCrf(t *testing.T) {
+	// the score drops a point for each crf above 20.
+	scores := func(tried *[]int) func(int) (float64, error) {
+		return func(crf int) (float64, error) {
+			*tried = append(*tried, crf)
+			return 100 - float64(crf-20), nil
+		}
+	}
+	crfs := qualityCrfs(18)
+	if want := []int{14, 16, 18, 20, 22, 24, 26, 28}; !reflect.DeepEqual(crfs, want) {
+		t.Fatalf("qualityCrfs() = %v, want %v", crfs, want)
+	}
+	var tried []int
+	crf, score, err := searchCrf(crfs, 95, scores(&tried))
+	if err != nil || crf != 24 || score != 96 {
+		t.Errorf("searchCrf() = %d, %v, %v, want 24, 96", crf, score, err)
+	}
+	if want := []int{28, 26, 24}; !reflect.DeepEqual(tried, want) {
+		t.Errorf("searchCrf() tried %v, want %v", tried, want)
+	}
+	tried = nil
+	if crf, score, _ := searchCrf(crfs, 200, scores(&tried)); crf != 14 || score != 106 {
+		t.Errorf("searchCrf() for an unreachable target = %d, %v, want the lowest crf 14", crf, score)
+	}
+}
+
+func TestParseQualityScore(t *testing.T) {
+	tests := []struct {
+		line   string
+		metric string
+		want   float64
+		ok     bool
+	}{
+		{"[libvmaf @ 0x5581c0a3e940] VMAF score: 94.387661", metricVmaf, 94.387661, true},
+		{"[Parsed_ssim_0 @ 0x55] SSIM Y:0.981163 (17.249) U:0.989532 (19.802) V:0.988943 (19.563) All:0.984000 (17.959)", metricSsim, 0.984, true},
+		{"[libvmaf @ 0x5581c0a3e940] VMAF score: 94.387661", metricSsim, 0, false},
+		{"frame=  120 fps=0.0 q=-0.0 size=N/A time=00:00:05.00", metricVmaf, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parseQualityScore(tt.line, tt.metric); got != tt.want || ok != tt.ok {
+			t.Errorf("parseQualityScore(%q, %s) = %v, %v, want %v, %v", tt.line, tt.metric, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMeasureQuality(t *testing.T) {
+	useFakeRunner(t, FakeResponse{Name: "ffmpeg", Stderr: "Input #0, matroska\n[libvmaf @ 0x55] VMAF score: 93.5\n"})
+	cmd := measureCommand("sample.mkv", "show_01.mkv", time.Minute, metricVmaf, nil)
+	want := "ffmpeg -hide_banner -nostats -i sample.mkv -ss 00:01:00.000 -t 00:00:05.000 -i show_01.mkv -filter_complex '[0:v][1:v]libvmaf' -f null -"
+	if got := cmd.String(); got != want {
+		t.Errorf("measureCommand() = %s\nwant %s", got, want)
+	}
+	if score, err := measureQuality(cmd, metricVmaf); err != nil || score != 93.5 {
+		t.Errorf("measureQuality() = %v, %v, want 93.5", score, err)
+	}
+	useFakeRunner(t, FakeResponse{Name: "ffmpeg", Stderr: "No such filter: 'libvmaf'\n", ExitCode: 1})
+	if _, err := measureQuality(cmd, metricVmaf); err == nil {
+		t.Error("measureQuality() without libvmaf, want an error")
+	}
+}
+
+func TestSeriesPrefix(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"/incoming/show_01.mkv", "show"},
+		{"/incoming/Show - 01 [1080p].mkv", "show"},
+		{"/incoming/[SubsPlease] Frieren - 12 (1080p) [ABCD1234].mkv", "[subsplease] frieren"},
+		{"/incoming/The.Show.S01E02.1080p.mkv", "the.show"},
+		{"/incoming/86 - 03.mkv", "86"},
+		{"/incoming/movie.mkv", "movie"},
+		{"/incoming/Dungeon Meshi ep05.mkv", "dungeon meshi"},
+		// the introframes key wins.
+		{"/incoming/Bocchi the Rock - 01.mkv", "bocchi"},
+	}
+	config := Config{IntroFrames: map[string]IntroBoundaries{"Bocchi": {}}}
+	for _, tt := range tests {
+		if got := NewJob(tt.input, config).seriesPrefix(); got != tt.want {
+			t.Errorf("seriesPrefix(%s) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestCrfCache(t *testing.T) {
+	filename := path.Join(t.TempDir(), "crfcache.json")
+	cache, err := OpenCrfCache(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := CrfCacheKey{Series: "show", Metric: metricVmaf, Target: 95, Encoder: "x264"}
+	if _, ok := cache.Get("show_01.mkv", key); ok {
+		t.Fatal("empty cache has a crf")
+	}
+	choice := CrfChoice{Crf: 24, Score: 95.5, Time: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)}
+	if err := cache.Put(key, choice); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = OpenCrfCache(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := cache.Get("/other/dir/Show_02.mkv", key); !ok || got != choice {
+		t.Errorf("Get() = %+v, %v, want %+v", got, ok, choice)
+	}
+	other := key
+	other.Target = 90
+	if _, ok := cache.Get("show_02.mkv", other); ok {
+		t.Error("Get() found a crf for another target")
+	}
+	if _, ok := cache.Get("another_01.mkv", key); ok {
+		t.Error("Get() found a crf for another series")
+	}
+	var none *CrfCache
+	if _, ok := none.Get("show_01.mkv", key); ok || none.Put(key, choice) != nil {
+		t.Error("a nil cache remembers nothing")
+	}
+}
+
+func TestQualityRateControlPlan(t *testing.T) {
+	job := NewJob("show_01.mkv", Config{RateControl: rateQuality, QualityMetric: metricSsim, QualityTarget: 0.98, Profile: "mkv-h264"})
+	job.Plan = &Plan{}
+	rate, err := job.rateControl()
+	if err != nil || rate.Mode != rateCrf || job.Config.Crf != 18 {
+		t.Fatalf("rateControl() = %+v, %v with crf %d, want the crf of the profile", rate, err, job.Config.Crf)
+	}
+	if want := "the highest of [14 16 18 20 22 24 26 28] reaching ssim 0.98 in samples"; job.Plan.Crf != want {
+		t.Errorf("plan crf = %q, want %q", job.Plan.Crf, want)
+	}
+}
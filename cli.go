@@ -0,0 +1,612 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Command is one of the things hardsub can do, like 'convert' or 'config show'.
+type Command struct {
+	Name        string
+	Args        string // what goes after the flags, for the usage line
+	Description string
+	Flags       func(f *flag.FlagSet)
+	Run         func(f *flag.FlagSet) error
+	Subcommands []*Command
+}
+
+var errUsage = errors.New("wrong usage")
+
+var commands = []*Command{
+	{
+		Name:        "convert",
+		Args:        "[files or globs...]",
+		Description: "Burn the subs into the given videos, or into all videos in the source directory.",
+		Flags: func(f *flag.FlagSet) {
+			addConfigFlags(f)
+			addTrackFlags(f)
+			f.Bool("dry-run", false, "Show what would be done for every file, without converting anything.")
+			f.Bool("json", false, "Print the dry-run plan as JSON, one line per file.")
+		},
+		Run: runConvert,
+	},
+	{
+		Name:        "watch",
+		Description: "Watch the source directory and convert the videos as they come in.",
+		Flags: func(f *flag.FlagSet) {
+			addConfigFlags(f)
+			addTrackFlags(f)
+		},
+		Run: runWatch,
+	},
+	{
+		Name:        "cut",
+		Args:        "files...",
+		Description: "Cut the fragment between two frames out of videos.",
+		Flags: func(f *flag.FlagSet) {
+			addConfigFlags(f)
+			f.String("start", "", "An image of the frame the fragment to cut out starts with.")
+			f.String("end", "", "An image of the frame the fragment to cut out ends with.")
+		},
+		Run: runCut,
+	},
+	{
+		Name:        "frames",
+		Description: "Work with the frames used to find intros.",
+		Subcommands: []*Command{
+			{
+				Name:        "dump",
+				Args:        "files...",
+				Description: "Save the frames at the given timestamps as images.",
+				Flags: func(f *flag.FlagSet) {
+					addConfigFlags(f)
+					f.String("at", "", "A comma-separated list of timestamps to save the frames of. (for example: 00:01:30,00:03:10)")
+				},
+				Run: runFramesDump,
+			},
+			{
+				Name:        "show",
+				Description: "Show the intro frames in the config.",
+				Flags:       addConfigFlags,
+				Run:         runFramesShow,
+			},
+		},
+	},
+	{
+		Name:        "probe",
+		Args:        "files...",
+		Description: "Show the streams of videos and the tracks that would be used.",
+		Flags: func(f *flag.FlagSet) {
+			addConfigFlags(f)
+			addTrackFlags(f)
+		},
+		Run: runProbe,
+	},
+	{
+		Name:        "config",
+		Description: "Manage the configuration.",
+		Subcommands: []*Command{
+			{
+				Name:        "init",
+				Description: "Write the default config to the user config file.",
+				Flags: func(f *flag.FlagSet) {
+					f.Bool("force", false, "Overwrite the config file when there already is one.")
+				},
+				Run: runConfigInit,
+			},
+			{
+				Name:        "show",
+				Description: "Show the effective config.",
+				Flags: func(f *flag.FlagSet) {
+					addConfigFlags(f)
+					f.Bool("origin", false, "Show where every setting comes from.")
+				},
+				Run: runConfigShow,
+			},
+			{
+				Name:        "edit",
+				Description: "Open the user config file in $VISUAL or $EDITOR.",
+				Run:         runConfigEdit,
+			},
+		},
+	},
+}
+
+// runCLI runs the command in args and returns the exit code.
+// Without a command, it converts or watches like hardsub always did.
+func runCLI(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runCommand(legacyCommand(), []string{"hardsub"}, args)
+	}
+	if args[0] == "help" {
+		printCommands(os.Stdout, commands, "hardsub")
+		return 0
+	}
+	cmd, names, rest := findCommand(commands, args)
+	if cmd == nil {
+		LogErrorln("unknown command:", strings.Join(names, " "))
+		printCommands(os.Stderr, commands, "hardsub")
+		return 2
+	}
+	if cmd.Run == nil {
+		printCommands(os.Stderr, cmd.Subcommands, "hardsub "+strings.Join(names, " "))
+		return 2
+	}
+	return runCommand(cmd, append([]string{"hardsub"}, names...), rest)
+}
+
+// legacyCommand is what runs without a command: watch when the watchforfiles setting is on, convert otherwise.
+func legacyCommand() *Command {
+	cmd, _, _ := findCommand(commands, []string{"convert"})
+	return &Command{
+		Args:        cmd.Args,
+		Description: "Without a command, hardsub watches the source directory when 'watchforfiles' is set and converts otherwise.\nRun 'hardsub help' for the commands.",
+		Flags:       cmd.Flags,
+		Run: func(f *flag.FlagSet) error {
+			if err := loadConfig(f); err != nil {
+				return err
+			}
+			if config.WatchForFiles && len(config.arguments.Files) == 0 && !config.arguments.DryRun {
+				return watch()
+			}
+			return convert()
+		},
+	}
+}
+
+// findCommand looks up the (sub)command named by the first arguments and returns it with its names and the rest of the arguments.
+func findCommand(cmds []*Command, args []string) (*Command, []string, []string) {
+	if len(args) == 0 {
+		return nil, nil, nil
+	}
+	for _, cmd := range cmds {
+		if cmd.Name != args[0] {
+			continue
+		}
+		if len(cmd.Subcommands) > 0 && len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+			sub, names, rest := findCommand(cmd.Subcommands, args[1:])
+			return sub, append([]string{cmd.Name}, names...), rest
+		}
+		return cmd, []string{cmd.Name}, args[1:]
+	}
+	return nil, args[:1], args[1:]
+}
+
+func runCommand(cmd *Command, names []string, args []string) int {
+	name := strings.Join(names, " ")
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.SortFlags = true
+	if cmd.Flags != nil {
+		cmd.Flags(f)
+	}
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] %s\n\n%s\n", name, cmd.Args, cmd.Description)
+		if f.Lookup("sourcedir") != nil {
+			fmt.Fprintln(os.Stderr, "\nMost of the configuration is in "+configFilename())
+			fmt.Fprintln(os.Stderr, "Every directory from the source directory up can have a "+directoryConfigName+" overriding it,")
+			fmt.Fprintln(os.Stderr, "and "+envPrefix+"<SETTING> environment variables override those. Every setting is a flag as well.")
+		}
+		if f.HasFlags() {
+			fmt.Fprintf(os.Stderr, "\nFlags:\n%s", f.FlagUsages())
+		}
+	}
+	if err := f.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if err := cmd.Run(f); err != nil {
+		if errors.Is(err, errUsage) {
+			f.Usage()
+			return 2
+		}
+		LogErrorln(err)
+		return 1
+	}
+	return 0
+}
+
+func printCommands(w io.Writer, cmds []*Command, prefix string) {
+	fmt.Fprintf(w, "usage: %s <command> [flags]\n\nCommands:\n", prefix)
+	for _, cmd := range cmds {
+		if len(cmd.Subcommands) == 0 {
+			fmt.Fprintf(w, "  %-14s %s\n", cmd.Name, cmd.Description)
+			continue
+		}
+		for _, sub := range cmd.Subcommands {
+			fmt.Fprintf(w, "  %-14s %s\n", cmd.Name+" "+sub.Name, sub.Description)
+		}
+	}
+	fmt.Fprintf(w, "\nRun '%s <command> --help' for the flags of a command.\n", prefix)
+}
+
+func runConvert(f *flag.FlagSet) error {
+	if err := loadConfig(f); err != nil {
+		return err
+	}
+	return convert()
+}
+
+// convert converts the files in the arguments, or the ones in the source directory.
+func convert() error {
+	var files []string
+	if len(config.arguments.Files) > 0 {
+		var err error
+		if files, err = expandFiles(config.arguments.Files, config.Extension); err != nil {
+			return err
+		}
+	}
+	if err := checkSubsFile(config.arguments.SubsFile, files); err != nil {
+		return err
+	}
+	if err := setupTools(); err != nil {
+		return err
+	}
+	var interrupted []string
+	if !config.arguments.DryRun {
+		interrupted = openJobStore(config)
+		openCrfCache()
+	}
+	if len(config.arguments.Files) > 0 {
+		if !config.arguments.DryRun {
+			for i := range files {
+				files[i] = detoxFile(files[i], config)
+			}
+		}
+		config.filesToConvert = files
+	} else {
+		if config.Detox && !config.arguments.DryRun {
+			Log("Detoxing directory...")
+			detoxWords := strings.Split(config.RemoveWords, ",")
+			if err := DetoxVideosInDirectory(config.arguments.SourceDirectory, videoExtensions(config.Extension), detoxWords...); err != nil {
+				LogErrorln("Cannot detox directory?!", err)
+			}
+			Log("done.")
+		}
+		files, err := videosInDirectory(config.arguments.SourceDirectory, config.Extension)
+		if err != nil {
+			return fmt.Errorf("could not read files from %s: %w", config.arguments.SourceDirectory, err)
+		}
+		config.filesToConvert = files
+	}
+	if len(config.arguments.Files) > 0 {
+		// the others wait until we convert their directory.
+		interrupted = requestedJobs(interrupted, files)
+	}
+	config.filesToConvert = resumeFirst(interrupted, config.filesToConvert)
+	return ConvertAllTheThings(config)
+}
+
+// checkSubsFile makes sure --subs is only given with a single video, the subs of one episode
+// don't belong in the others.
+func checkSubsFile(subs string, files []string) error {
+	if subs == "" || len(files) == 1 {
+		return nil
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("--subs needs the video to burn them into, give exactly one file")
+	}
+	return fmt.Errorf("--subs burns the subs into a single video, give exactly one file instead of %d", len(files))
+}
+
+// requestedJobs are the interrupted jobs for one of the files.
+func requestedJobs(interrupted, files []string) []string {
+	requested := map[string]bool{}
+	for _, f := range files {
+		requested[absPath(f)] = true
+	}
+	var jobs []string
+	for _, f := range interrupted {
+		if requested[absPath(f)] {
+			jobs = append(jobs, f)
+		}
+	}
+	return jobs
+}
+
+// resumeFirst puts the jobs that got interrupted in front of the files to convert, once.
+func resumeFirst(interrupted, files []string) []string {
+	if len(interrupted) == 0 {
+		return files
+	}
+	queued := map[string]bool{}
+	for _, f := range interrupted {
+		log.Println("Resuming interrupted job for", f)
+		queued[absPath(f)] = true
+	}
+	all := append([]string{}, interrupted...)
+	for _, f := range files {
+		if !queued[absPath(f)] {
+			all = append(all, f)
+		}
+	}
+	return all
+}
+
+func runWatch(f *flag.FlagSet) error {
+	if err := loadConfig(f); err != nil {
+		return err
+	}
+	return watch()
+}
+
+func watch() error {
+	if err := setupTools(); err != nil {
+		return err
+	}
+	openCrfCache()
+	WatchAndConvert(config, openJobStore(config))
+	return nil
+}
+
+func runCut(f *flag.FlagSet) error {
+	start, _ := f.GetString("start")
+	end, _ := f.GetString("end")
+	if start == "" || end == "" || f.NArg() == 0 {
+		return errUsage
+	}
+	if err := loadConfig(f); err != nil {
+		return err
+	}
+	if err := setupTools(); err != nil {
+		return err
+	}
+	profile, err := outputProfile(config)
+	if err != nil {
+		return err
+	}
+	encoder, err := chooseEncoder(config)
+	if err != nil {
+		return err
+	}
+	rate, err := cutRateControl(config)
+	if err != nil {
+		return err
+	}
+	files, err := expandFiles(f.Args(), "")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		output, err := cutFragmentFromVideo(file, start, end, profile.encoding(encoder, rate, config), nil)
+		if err != nil {
+			return fmt.Errorf("could not cut fragment from %s: %w", file, err)
+		}
+		fmt.Println(output)
+	}
+	return nil
+}
+
+func runFramesDump(f *flag.FlagSet) error {
+	at, _ := f.GetString("at")
+	timestamps := strings.FieldsFunc(at, func(c rune) bool { return c == ',' })
+	if len(timestamps) == 0 || f.NArg() == 0 {
+		return errUsage
+	}
+	if err := loadConfig(f); err != nil {
+		return err
+	}
+	if err := setupTools(); err != nil {
+		return err
+	}
+	files, err := expandFiles(f.Args(), "")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		for _, timestamp := range timestamps {
+			// ffmpeg -ss 00:01:00 -i input.mp4 -frames:v 1 output.png
+			name, err := DumpFrameFromVideoAt(file, timestamp)
+			if err != nil {
+				return fmt.Errorf("could not dump the frame at %s of %s: %w", timestamp, file, err)
+			}
+			fmt.Println(name)
+		}
+	}
+	return nil
+}
+
+func runFramesShow(f *flag.FlagSet) error {
+	if err := loadConfig(f); err != nil {
+		return err
+	}
+	var series []string
+	for name := range config.IntroFrames {
+		series = append(series, name)
+	}
+	sort.Strings(series)
+	for _, name := range series {
+		frames := config.IntroFrames[name]
+		fmt.Printf("%s\n  begin: %s\n  end:   %s\n", name, frames.Begin, frames.End)
+	}
+	return nil
+}
+
+func runProbe(f *flag.FlagSet) error {
+	if f.NArg() == 0 {
+		return errUsage
+	}
+	if err := loadConfig(f); err != nil {
+		return err
+	}
+	if err := setupTools(); err != nil {
+		return err
+	}
+	files, err := expandFiles(f.Args(), "")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := probe(os.Stdout, file); err != nil {
+			return fmt.Errorf("could not probe %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// probe shows the streams in videofile and the tracks a conversion would use.
+func probe(w io.Writer, videofile string) error {
+	info, err := GetFFprobeInfo(videofile)
+	if err != nil {
+		return err
+	}
+	props := GetVideoPropertiesWithFFProbe(videofile)
+	fmt.Fprintln(w, videofile)
+	fmt.Fprintf(w, "  duration:  %s\n", sexagesimal(props.Duration))
+	fmt.Fprintln(w, "  streams:")
+	for _, stream := range info.Streams {
+		line := fmt.Sprintf("    #%d %s %s", stream.Index, stream.CodecType, stream.CodecName)
+		if lang, ok := stream.Tags["language"]; ok {
+			line += " [" + lang + "]"
+		}
+		if title, ok := stream.Tags["title"]; ok {
+			line += fmt.Sprintf(" %q", title)
+		}
+		fmt.Fprintln(w, line)
+	}
+	mediaInfo, err := inspect(videofile)
+	if err != nil {
+		return err
+	}
+	selection, err := selectTracks(mediaInfo, config)
+	if err != nil {
+		return err
+	}
+	if config.arguments.Explain {
+		fmt.Fprintln(w, "  scores:")
+		selection.WriteExplanation(w)
+	}
+	tracks := &selection.Selected
+	if err := useSidecar(videofile, tracks, config); err != nil {
+		return err
+	}
+	planned := plannedTracks(mediaInfo, tracks)
+	fmt.Fprintln(w, "  selected:")
+	for _, t := range planned {
+		fmt.Fprintf(w, "    %-10s %s\n", t.Role+":", t)
+	}
+	fmt.Fprintf(w, "    %-10s %s\n", "subs type:", tracks.SubtitleType)
+	return nil
+}
+
+func runConfigInit(f *flag.FlagSet) error {
+	force, _ := f.GetBool("force")
+	filename := configFilename()
+	if FileExists(filename) && !force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", filename)
+	}
+	SaveDefaultConfig()
+	fmt.Println("Wrote the default config to", filename)
+	return nil
+}
+
+func runConfigShow(f *flag.FlagSet) error {
+	if err := loadConfig(f); err != nil {
+		return err
+	}
+	origin, _ := f.GetBool("origin")
+	ShowConfig(os.Stdout, koanfConfig, configOrigins, origin)
+	return nil
+}
+
+func runConfigEdit(f *flag.FlagSet) error {
+	filename := configFilename()
+	if !FileExists(filename) {
+		SaveDefaultConfig()
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	c := exec.Command("sh", "-c", editor+` "$1"`, "editor", filename)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("running %s: %w", editor, err)
+	}
+	wd, _ := os.Getwd()
+	if err := resolveConfig(filename, wd, nil, nil); err != nil {
+		return fmt.Errorf("the config doesn't load anymore: %w", err)
+	}
+	return nil
+}
+
+// expandFiles turns the arguments into the files to work on: globs get expanded and
+// directories give all the files in them with the extension, when it's not empty.
+func expandFiles(patterns []string, extension string) ([]string, error) {
+	var files []string
+	add := func(file string) {
+		if !containsString(files, file) {
+			files = append(files, file)
+		}
+	}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", pattern)
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				inDir, err := videosInDirectory(match, extension)
+				if err != nil {
+					return nil, err
+				}
+				for _, file := range inDir {
+					add(file)
+				}
+				continue
+			}
+			add(match)
+		}
+	}
+	return files, nil
+}
+
+// videosInDirectory lists the files in dir with one of the comma separated extensions, or all files when there are none.
+func videosInDirectory(dir, extensions string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if hasExtension(entry.Name(), videoExtensions(extensions)) {
+			files = append(files, path.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
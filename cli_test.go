@@ -0,0 +1,119 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantNames []string
+		wantRest  []string
+		found     bool
+	}{
+		{"command", []string{"convert", "a.mkv", "--crf", "20"}, []string{"convert"}, []string{"a.mkv", "--crf", "20"}, true},
+		{"subcommand", []string{"config", "show", "--origin"}, []string{"config", "show"}, []string{"--origin"}, true},
+		{"group without subcommand", []string{"frames", "--help"}, []string{"frames"}, []string{"--help"}, true},
+		{"unknown subcommand", []string{"config", "destroy"}, []string{"config", "destroy"}, []string{}, false},
+		{"unknown", []string{"transmogrify", "a.mkv"}, []string{"transmogrify"}, []string{"a.mkv"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, names, rest := findCommand(commands, tt.args)
+			if (cmd != nil) != tt.found {
+				t.Fatalf("findCommand() found = %v, want %v", cmd != nil, tt.found)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) || !reflect.DeepEqual(rest, tt.wantRest) {
+				t.Errorf("findCommand() = %v %v, want %v %v", names, rest, tt.wantNames, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestExpandFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"show_01.mkv", "show_02.mkv", "notes.txt", "season2/show_03.mkv"} {
+		os.MkdirAll(path.Dir(path.Join(dir, name)), 0o755)
+		os.WriteFile(path.Join(dir, name), nil, 0o644)
+	}
+	in := func(names ...string) []string {
+		var files []string
+		for _, name := range names {
+			files = append(files, path.Join(dir, name))
+		}
+		return files
+	}
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+		wantErr  bool
+	}{
+		{"plain file", in("notes.txt"), in("notes.txt"), false},
+		{"glob", in("show_*.mkv"), in("show_01.mkv", "show_02.mkv"), false},
+		{"directory", in("season2"), in("season2/show_03.mkv"), false},
+		{"no duplicates", in("show_01.mkv", "*.mkv"), in("show_01.mkv", "show_02.mkv"), false},
+		{"nothing matches", in("movie_*.mkv"), nil, true},
+		{"bad pattern", in("show_[.mkv"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandFiles(tt.patterns, "mkv")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeFirst(t *testing.T) {
+	wd, _ := os.Getwd()
+	interrupted := []string{path.Join(wd, "b.mkv")}
+	got := resumeFirst(interrupted, []string{"a.mkv", "b.mkv", "c.mkv"})
+	want := []string{path.Join(wd, "b.mkv"), "a.mkv", "c.mkv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resumeFirst() = %v, want %v", got, want)
+	}
+	// converting a.mkv only resumes the interrupted job for a.mkv.
+	interrupted = append(interrupted, path.Join(wd, "a.mkv"))
+	if got := requestedJobs(interrupted, []string{"a.mkv"}); !reflect.DeepEqual(got, interrupted[1:]) {
+		t.Errorf("requestedJobs() = %v, want %v", got, interrupted[1:])
+	}
+}
+
+func TestCheckSubsFile(t *testing.T) {
+	if err := checkSubsFile("show_01.ass", []string{"show_01.mkv"}); err != nil {
+		t.Errorf("checkSubsFile() with one video = %v", err)
+	}
+	if err := checkSubsFile("", []string{"show_01.mkv", "show_02.mkv"}); err != nil {
+		t.Errorf("checkSubsFile() without subs = %v", err)
+	}
+	if err := checkSubsFile("show_01.ass", []string{"show_01.mkv", "show_02.mkv"}); err == nil {
+		t.Error("the subs of one video shouldn't go into two")
+	}
+	if err := checkSubsFile("show_01.ass", nil); err == nil {
+		t.Error("the subs of one video shouldn't go into a whole directory")
+	}
+}
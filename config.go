@@ -16,137 +16,171 @@ limitations under the License.
 package main
 
 import (
-	"fmt"
-	"io/fs"
-	"os"
+	"strconv"
 	"strings"
-
-	"github.com/sanity-io/litter"
 )
 
 type IntroBoundaries struct {
-	Begin string
-	End   string
+	Begin string `json:"begin"`
+	End   string `json:"end"`
 }
 
 type Arguments struct {
-	SourceDirectory string `koanf:"sourcedir"`
-	CutStart        string `koanf:"cutstart"`
-	CutEnd          string `koanf:"cutend"`
-	OnlyCut         bool   `koanf:"onlycut"`
-	DumpFramesAt    string `koanf:"dumpframesat"`
-	File            string `koanf:"file"`
-	ForceAudioTrack int    `koanf:"forceaudiotrack"`
-	ForceSubsTrack  int    `koanf:"forcesubstrack"`
-	WatchForFiles   bool   `koanf:"watchforfiles"`
+	SourceDirectory string   `koanf:"sourcedir"`
+	Files           []string `koanf:"files"` // files and globs to convert instead of everything in SourceDirectory
+	ForceAudioTrack int      `koanf:"forceaudiotrack"`
+	ForceSubsTrack  int      `koanf:"forcesubstrack"`
+	Explain         bool     `koanf:"explain"` // show how the tracks scored
+	SubsFile        string   `koanf:"subs"`    // the subtitle file to burn in instead of a subtitle track
+	DryRun          bool     `koanf:"dryrun"`
+	JSON            bool     `koanf:"json"`
 }
 
 type Config struct {
-	AudioLang          string `koanf:"audiolang" toml:"audiolang" comment:"The audio language you want to use in the ouput video. (IETF language tag)"`
-	SubsLang           string `koanf:"subslang" toml:"subslang" comment:"The subs language you want to use. (IETF language tag)"`
-	SubsName           string `koanf:"subsname" toml:"subsname" comment:"What the subtitle trackname needs to contains."`
-	TargetDirectory    string `koanf:"targetdir" toml:"targetdir" comment:"Where to put the converted videos."`
-	OriginalsDirectory string `koanf:"originalsdir" toml:"originalsdir" comment:"Where to move the original files to."`
-	H26xTune           string `koanf:"h26xtune" toml:"h26xtune" comment:"The tuning to use for h26x encoding. (film/animation/fastdecode/zerolatency/none)"`
-	H26xPreset         string `koanf:"h26xpreset" toml:"h26xpreset" comment:"The preset to use for h26x encoding. (fast/medium/slow/etc..)"`
-	PostCmd            string `koanf:"postcmd" toml:"postcmd" comment:"The command to run on completion. Use %%o for the output filename."`
-	PostSubExtract     string `koanf:"postsubextract" toml:"postsubextract" comment:"The command to run after sub extraction, before conversion. Use %%s for subs filename."`
-	Extension          string `koanf:"extension" toml:"extension" comment:"Look for files of this extension to convert. (You really want to set this to mkv)"`
-	RemoveWords        string `koanf:"removewords" toml:"removewords" comment:"When detoxing, remove the words in the comma separated value you specify."`
-	filesToConvert     []fs.DirEntry
-	Crf                int                        `koanf:"crf" toml:"crf" comment:"Constant Rate Factor setting for ffmpeg."`
-	ExtractFonts       bool                       `koanf:"extractfonts" toml:"extractfonts" comment:"Extract the fonts from the mkv to use them in the hardcoding."`
-	FirstOnly          bool                       `koanf:"firstonly" toml:"firstonly" comment:"Only convert the first file. (For testing purposes)"`
-	Mkv                bool                       `koanf:"mkv" toml:"mkv" comment:"Make MKV files instead of MP4 files."`
-	H265               bool                       `koanf:"h265" toml:"h265" comment:"Use H265 encoding. Check if your CPU can do H265 encoding first, or this will be very slow."`
-	KeepSubs           bool                       `koanf:"keepsubs" toml:"keepsubs" comment:"Keep subs in the directory after conversion instead of deleting them."`
-	CleanupSubs        bool                       `koanf:"cleanupsubs" toml:"cleanupsubs" comment:"Clean up the subtitles (in the case of srt) to make them render better. Sometimes they render too big, use this in that case."`
-	Verbose            bool                       `koanf:"verbose" toml:"verbose" comment:"Give more output about what's going on."`
-	ForOldDevices      bool                       `koanf:"forolddevices" toml:"forolddevices" comment:"Use ffmpeg flags to get widest compatibility. (yuv stuff)"`
-	FastVersion        bool                       `koanf:"fastversion" toml:"fastversion" comment:"Do a second and third pass, making a video at 1.5x the speed."`
-	KeepSlowVersion    bool                       `koanf:"keepslowversion" toml:"keepslowversion" comment:"When making a fast version, don't delete the slow one."`
-	Detox              bool                       `koanf:"detox" toml:"detox" comment:"Remove all 'weird' characters from the filename. (you want this)"`
-	WatchForFiles      bool                       `koanf:"watchforfiles" toml:"watchforfiles" comment:"Watch for files in the directory and convert them as they appear."`
-	IntroFrames        map[string]IntroBoundaries `koanf:"introframes" toml:"introframes" comment:"The locations of the intro beginning and ending frames for specific series."`
-	PushoverToken      string                     `koanf:"pushovertoken" toml:"pushovertoken" comment:"The Pushover token."`
-	PushoverUserKey    string                     `koanf:"pushoveruserkey" toml:"pushoveruserkey" comment:"The Pushover User Key"`
-	arguments          Arguments                  `koanf:"arguments"`
+	AudioLang            string `koanf:"audiolang" toml:"audiolang" comment:"The audio languages you want to use in the ouput video, most wanted first. (comma separated IETF language tags)"`
+	SubsLang             string `koanf:"subslang" toml:"subslang" comment:"The subs languages you want to use, most wanted first. (comma separated IETF language tags)"`
+	SubsName             string `koanf:"subsname" toml:"subsname" comment:"Prefer subtitle tracks whose name contains this."`
+	AudioInclude         string `koanf:"audioinclude" toml:"audioinclude" comment:"Only use audio tracks whose name matches this regex. (empty allows all)"`
+	AudioExclude         string `koanf:"audioexclude" toml:"audioexclude" comment:"Never use audio tracks whose name matches this regex."`
+	SubsInclude          string `koanf:"subsinclude" toml:"subsinclude" comment:"Only use subtitle tracks whose name matches this regex. (empty allows all)"`
+	SubsExclude          string `koanf:"subsexclude" toml:"subsexclude" comment:"Never use subtitle tracks whose name matches this regex."`
+	Sidecars             string `koanf:"sidecars" toml:"sidecars" comment:"When to use the subtitle files next to the video, named like the video. (never/fallback/prefer, fallback only uses them when the video has no subs we want)"`
+	SubsCodecs           string `koanf:"subscodecs" toml:"subscodecs" comment:"The subtitle codecs to prefer, most wanted first. (comma separated: ass,srt,pgs,vobsub)"`
+	TargetDirectory      string `koanf:"targetdir" toml:"targetdir" comment:"Where to put the converted videos."`
+	OriginalsDirectory   string `koanf:"originalsdir" toml:"originalsdir" comment:"Where to move the original files to."`
+	WorkDirectory        string `koanf:"workdir" toml:"workdir" comment:"Where to make the temporary workspace for each conversion. (empty means inside targetdir)"`
+	Profile              string `koanf:"profile" toml:"profile" comment:"The kind of video to make. (mp4-h264/mp4-h264-compat/mp4-hevc/mkv-h264/mkv-hevc/webm-av1/webm-vp9 or one of your profiles, empty picks one with the mkv, h265 and forolddevices settings)"`
+	Encoder              string `koanf:"encoder" toml:"encoder" comment:"The video encoder, it has to make the video codec of the profile. (x264/x265/svtav1/vp9, or h264_vaapi/hevc_vaapi/h264_qsv/hevc_qsv/h264_nvenc/hevc_nvenc on a GPU, empty for the software one)"`
+	VaapiDevice          string `koanf:"vaapidevice" toml:"vaapidevice" comment:"The device the vaapi encoders use."`
+	RateControl          string `koanf:"ratecontrol" toml:"ratecontrol" comment:"How the encoder spends the bits. (crf, cappedcrf to stay under maxrate, abr for an average of videobitrate or size to fit in targetsize, both in two passes when the encoder can, or quality for the highest crf reaching qualitytarget in samples)"`
+	QualityMetric        string `koanf:"qualitymetric" toml:"qualitymetric" comment:"How the quality ratecontrol scores the samples. (vmaf needs an ffmpeg with libvmaf, or ssim)"`
+	Fps                  string `koanf:"fps" toml:"fps" comment:"The frame rate of the output, like 24, 23.976 or 24000/1001. (empty keeps the one of the video)"`
+	HDR                  string `koanf:"hdr" toml:"hdr" comment:"What to do with HDR video. (tonemap to SDR, or keep it HDR when the profile makes hevc with x265 or hevc_nvenc)"`
+	Tonemap              string `koanf:"tonemap" toml:"tonemap" comment:"How to tonemap HDR video to SDR. (hable/mobius/reinhard/clip/linear/gamma)"`
+	AudioBitrates        string `koanf:"audiobitrates" toml:"audiobitrates" comment:"The kbit/s of the audio for each codec. (comma separated codec:kbit/s, like aac:160,opus:128, empty leaves it to the encoder)"`
+	H26xTune             string `koanf:"h26xtune" toml:"h26xtune" comment:"The tuning to use for h26x encoding. (film/animation/fastdecode/zerolatency/none)"`
+	H26xPreset           string `koanf:"h26xpreset" toml:"h26xpreset" comment:"The preset to use for h26x encoding. (fast/medium/slow/etc..)"`
+	PostCmd              string `koanf:"postcmd" toml:"postcmd" comment:"The command to run on completion. Use %%o for the output filename."`
+	PostSubExtract       string `koanf:"postsubextract" toml:"postsubextract" comment:"The command to run after sub extraction, before conversion. Use %%s for subs filename."`
+	Extension            string `koanf:"extension" toml:"extension" comment:"Look for files with these extensions to convert. (comma separated, empty for all files)"`
+	RemoveWords          string `koanf:"removewords" toml:"removewords" comment:"When detoxing, remove the words in the comma separated value you specify."`
+	Stages               string `koanf:"stages" toml:"stages" comment:"The conversion stages to run, in order. (comma separated: probe,selecttracks,extractsubs,encode,speedup,cutintro,postprocess,archive)"`
+	filesToConvert       []string
+	Crf                  int                        `koanf:"crf" toml:"crf" comment:"Constant Rate Factor setting for ffmpeg. (0 uses the one of the profile)"`
+	MaxRate              int                        `koanf:"maxrate" toml:"maxrate" comment:"The most kbit/s the video can use with the cappedcrf ratecontrol."`
+	VideoBitrate         int                        `koanf:"videobitrate" toml:"videobitrate" comment:"The kbit/s of the video with the abr ratecontrol."`
+	TargetSize           int                        `koanf:"targetsize" toml:"targetsize" comment:"The MB the video has to fit in with the size ratecontrol."`
+	QualityTarget        float64                    `koanf:"qualitytarget" toml:"qualitytarget" comment:"The score the samples need with the quality ratecontrol. (0-100 for vmaf, 0-1 for ssim)"`
+	MaxWidth             int                        `koanf:"maxwidth" toml:"maxwidth" comment:"Scale the video down to fit this width, keeping its aspect ratio. (0 for any width)"`
+	MaxHeight            int                        `koanf:"maxheight" toml:"maxheight" comment:"Scale the video down to fit this height, keeping its aspect ratio. (0 for any height)"`
+	LoudnessTarget       float64                    `koanf:"loudnesstarget" toml:"loudnesstarget" comment:"The integrated loudness in LUFS loudnorm aims for. (EBU R128 says -23)"`
+	Workers              int                        `koanf:"workers" toml:"workers" comment:"How many files to convert at the same time."`
+	ThreadsPerWorker     int                        `koanf:"threadsperworker" toml:"threadsperworker" comment:"Limit the encoder threads for each worker. (0 lets the encoder decide)"`
+	JobRetries           int                        `koanf:"jobretries" toml:"jobretries" comment:"How many times to try a file that keeps failing or getting interrupted before giving up on it."`
+	ForcedScore          int                        `koanf:"forcedscore" toml:"forcedscore" comment:"Points for tracks flagged as forced when picking tracks. (negative to avoid them)"`
+	DefaultScore         int                        `koanf:"defaultscore" toml:"defaultscore" comment:"Points for tracks flagged as default when picking tracks."`
+	HearingImpairedScore int                        `koanf:"hearingimpairedscore" toml:"hearingimpairedscore" comment:"Points for tracks flagged for the hearing impaired when picking tracks."`
+	AudioChannels        int                        `koanf:"audiochannels" toml:"audiochannels" comment:"Prefer audio tracks with this many channels. (0 for no preference)"`
+	AudioTracks          int                        `koanf:"audiotracks" toml:"audiotracks" comment:"How many audio tracks to keep in mkv output, the best one of each language, like the original and a dub."`
+	AutoCrop             bool                       `koanf:"autocrop" toml:"autocrop" comment:"Crop the black bars ffmpeg's cropdetect finds around the picture."`
+	Downmix              bool                       `koanf:"downmix" toml:"downmix" comment:"Downmix surround audio to stereo. (when the profile encodes the audio)"`
+	Loudnorm             bool                       `koanf:"loudnorm" toml:"loudnorm" comment:"Normalize the loudness of the audio to loudnesstarget, measuring it first. (when the profile encodes the audio)"`
+	ExtractFonts         bool                       `koanf:"extractfonts" toml:"extractfonts" comment:"Extract the fonts attached to the video to use them in the hardcoding."`
+	FirstOnly            bool                       `koanf:"firstonly" toml:"firstonly" comment:"Only convert the first file. (For testing purposes)"`
+	Mkv                  bool                       `koanf:"mkv" toml:"mkv" comment:"Make MKV files instead of MP4 files. (when there's no profile setting)"`
+	H265                 bool                       `koanf:"h265" toml:"h265" comment:"Use H265 encoding. Check if your CPU can do H265 encoding first, or this will be very slow. (when there's no profile setting)"`
+	KeepSubs             bool                       `koanf:"keepsubs" toml:"keepsubs" comment:"Keep subs in the directory after conversion instead of deleting them."`
+	CleanupSubs          bool                       `koanf:"cleanupsubs" toml:"cleanupsubs" comment:"Clean up the subtitles (in the case of srt) to make them render better. Sometimes they render too big, use this in that case."`
+	Verbose              bool                       `koanf:"verbose" toml:"verbose" comment:"Give more output about what's going on."`
+	ForOldDevices        bool                       `koanf:"forolddevices" toml:"forolddevices" comment:"Use ffmpeg flags to get widest compatibility. (yuv stuff, when there's no profile setting)"`
+	FastVersion          bool                       `koanf:"fastversion" toml:"fastversion" comment:"Do a second and third pass, making a video at 1.5x the speed."`
+	KeepSlowVersion      bool                       `koanf:"keepslowversion" toml:"keepslowversion" comment:"When making a fast version, don't delete the slow one."`
+	Detox                bool                       `koanf:"detox" toml:"detox" comment:"Remove all 'weird' characters from the filename. (not needed for ffmpeg anymore, but makes for nicer filenames)"`
+	WatchForFiles        bool                       `koanf:"watchforfiles" toml:"watchforfiles" comment:"Watch for files in the directory and convert them as they appear."`
+	Profiles             map[string]Profile         `koanf:"profiles" toml:"profiles" comment:"Your own output profiles, by name. (container mp4/mkv/webm, video h264/hevc/av1/vp9, audio aac/opus/copy, crf and compat)"`
+	IntroFrames          map[string]IntroBoundaries `koanf:"introframes" toml:"introframes" comment:"The locations of the intro beginning and ending frames for specific series."`
+	PushoverToken        string                     `koanf:"pushovertoken" toml:"pushovertoken" comment:"The Pushover token."`
+	PushoverUserKey      string                     `koanf:"pushoveruserkey" toml:"pushoveruserkey" comment:"The Pushover User Key"`
+	arguments            Arguments                  `koanf:"arguments"`
 }
 
-func (c Config) FfmpegParametersForCutting(inputFile, outputFile string) string {
-	sb := strings.Builder{}
-	sb.WriteString("-y -hide_banner -loglevel error -stats -i ")
-	sb.WriteString(inputFile)
-	sb.WriteString(" -c:a aac")
-	videoCodec := "libx264"
-	if config.H265 {
-		videoCodec = "libx265"
-	}
-	sb.WriteString(" -c:v " + videoCodec)
-	sb.WriteString(fmt.Sprintf(" -crf %d", config.Crf))
-	h26xTune := ""
-	if config.H26xTune == "none" {
-		h26xTune = ""
-	} else {
-		h26xTune = " -tune " + config.H26xTune + " "
-	}
-	sb.WriteString(h26xTune)
-	sb.WriteString(" -preset " + config.H26xPreset)
+// the ffmpeg flags to get the widest compatibility. (yuv stuff)
+// The audio gets downmixed to stereo, at the bitrate of the audiobitrates setting.
+var oldDevicesOptions = []string{"-profile:v", "baseline", "-level", "3.0", "-pix_fmt", "yuv420p", "-movflags", "faststart"}
 
-	if config.ForOldDevices {
-		sb.WriteString(" -profile:v baseline -level 3.0 -pix_fmt yuv420p -ac 2 -b:a 128k -movflags faststart ")
+// threadOptions limits the threads the encoder uses, so parallel workers don't fight over the cores.
+func threadOptions(config Config, encoder Encoder) []string {
+	if config.ThreadsPerWorker <= 0 {
+		return nil
 	}
-	sb.WriteString(outputFile)
-	// convertCmd := fmt.Sprintf("-y -hide_banner -loglevel error -stats -i %s -map 0:%d -map 0:%d -vf subtitles=%s -c:a %s -c:v %s -crf %d -preset %s %s%s%s",
-	// 	videofile, output.VideoTrack, output.AudioTrack, subsfile, audioCodec, videoCodec, config.Crf, config.H26xPreset, h26xTune, oldDevices, outputFile)
-	return sb.String()
+	threads := strconv.Itoa(config.ThreadsPerWorker)
+	opts := []string{"-threads", threads}
+	if encoder.Name == "x265" {
+		// x265 uses its own thread pools and ignores -threads for those.
+		opts = append(opts, "-x265-params", "pools="+threads)
+	}
+	return opts
 }
 
 func DefaultConfig() Config {
 	return Config{
-		AudioLang:          "ja",
-		SubsLang:           "en",
-		SubsName:           "subtitles",
-		TargetDirectory:    "converted",
-		OriginalsDirectory: "originals",
-		H26xTune:           "animation",
-		H26xPreset:         "fast",
-		PostCmd:            "",
-		PostSubExtract:     "",
-		Extension:          "mkv",
-		RemoveWords:        "SubsPlease,EMBER",
-		Crf:                18,
-		ExtractFonts:       true,
-		FirstOnly:          false,
-		Mkv:                false,
-		H265:               false,
-		KeepSubs:           false,
-		CleanupSubs:        false,
-		Verbose:            false,
-		ForOldDevices:      false,
-		FastVersion:        false,
-		KeepSlowVersion:    false,
-		Detox:              true,
-		WatchForFiles:      false,
-	}
-}
-
-func PrepareDirectoryForConversion(config *Config) {
-	if config.Detox {
-		fmt.Print("Detoxing directory...")
-		detoxWords := strings.Split(config.RemoveWords, ",")
-		if err := DetoxMkvsInDirectory(config.arguments.SourceDirectory, detoxWords...); err != nil {
-			LogError("detoxing directory failed: %s %v", config.arguments.SourceDirectory, err)
-			os.Exit(1)
-		}
-		fmt.Print("done.\n")
-	}
-	files, err := os.ReadDir(config.arguments.SourceDirectory)
-	if err != nil {
-		LogError("cannot read directory: %s %v", config.arguments.SourceDirectory, err)
-	}
-	config.filesToConvert = files
-	if config.Verbose {
-		litter.Dump(config)
+		AudioLang:            "ja",
+		SubsLang:             "en",
+		SubsName:             "subtitles",
+		AudioInclude:         "",
+		AudioExclude:         "(?i)commentary",
+		SubsInclude:          "",
+		SubsExclude:          "(?i)signs|songs",
+		Sidecars:             sidecarsFallback,
+		SubsCodecs:           "ass,srt,pgs",
+		TargetDirectory:      "converted",
+		OriginalsDirectory:   "originals",
+		Profile:              "",
+		Encoder:              "",
+		VaapiDevice:          "/dev/dri/renderD128",
+		RateControl:          rateCrf,
+		QualityMetric:        metricVmaf,
+		Fps:                  "",
+		HDR:                  hdrTonemap,
+		Tonemap:              "hable",
+		AudioBitrates:        "",
+		H26xTune:             "animation",
+		H26xPreset:           "fast",
+		PostCmd:              "",
+		PostSubExtract:       "",
+		Extension:            "mkv,mp4,m4v,webm,ts,m2ts,avi,mov",
+		RemoveWords:          "SubsPlease,EMBER",
+		Stages:               strings.Join(DefaultStages, ","),
+		Crf:                  0,
+		MaxRate:              0,
+		VideoBitrate:         0,
+		TargetSize:           0,
+		QualityTarget:        95,
+		MaxWidth:             0,
+		MaxHeight:            0,
+		LoudnessTarget:       -23,
+		Workers:              1,
+		ThreadsPerWorker:     0,
+		JobRetries:           3,
+		ForcedScore:          -50,
+		DefaultScore:         10,
+		HearingImpairedScore: -20,
+		AudioChannels:        0,
+		AudioTracks:          1,
+		AutoCrop:             false,
+		Downmix:              false,
+		Loudnorm:             false,
+		ExtractFonts:         true,
+		FirstOnly:            false,
+		Mkv:                  false,
+		H265:                 false,
+		KeepSubs:             false,
+		CleanupSubs:          false,
+		Verbose:              false,
+		ForOldDevices:        false,
+		FastVersion:          false,
+		KeepSlowVersion:      false,
+		Detox:                true,
+		WatchForFiles:        false,
 	}
 }
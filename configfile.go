@@ -18,8 +18,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/knadh/koanf/parsers/toml"
@@ -33,17 +37,15 @@ import (
 var (
 	koanfConfig = koanf.New(".")
 	config      = Config{}
+	// where each setting in koanfConfig came from.
+	configOrigins = map[string]string{}
 )
 
-func InitConfig() {
-	// TODO: Add a second possible config file .hardsub.toml in the current directory that could also
-	// be read after the general config.
-	// Then read the command line arguments as well and override the config again.
-	if !FileExists(configFilename()) {
-		SaveDefaultConfig()
-	}
-	LoadConfig()
-}
+// the name of the per-directory config files, read from the source directory and all its parents.
+const directoryConfigName = ".hardsub.toml"
+
+// settings can also come from environment variables starting with this, like HARDSUB_CRF=20.
+const envPrefix = "HARDSUB_"
 
 func configFilename() string {
 	ucd, err := os.UserConfigDir()
@@ -62,61 +64,297 @@ func configFilename() string {
 	return filepath.Join(configDir, "hardsub.toml")
 }
 
-func LoadConfig() {
-	configFile := configFilename()
-	fp := file.Provider(configFile)
-	ReadConfigFile(fp)
-	f := flag.NewFlagSet("config", flag.ExitOnError)
-	f.Usage = func() {
-		fmt.Print("hardsub - A tool to burn subtitles into videos.\n\n")
-		fmt.Println("Most of the configuration is in " + configFile)
-		fmt.Print("\nExtra command line options:\n\n")
-		fmt.Println(f.FlagUsages())
-	}
-	f.String("file", "", "The specific file to operate on for cutting and frame dumping.")
-	f.Bool("onlycut", false, "Only cut, don't convert.")
-	f.String("cutstart", "", "A jpg of the frame to look for in the video to determine the start of the fragment to cut out.")
-	f.String("cutend", "", "A jpg of the frame to look for in the video to determine the end of the fragment to cut out.")
-	f.String("dumpframesat", "", "A comma-separated list of timestamps you want to make jpg dumps for.")
+// addConfigFlags adds the flags of the commands that use the config: the source directory
+// and a flag for every setting.
+func addConfigFlags(f *flag.FlagSet) {
+	wd, _ := os.Getwd()
+	f.String("sourcedir", wd, "The directory in which to look for videos and "+directoryConfigName+" files.")
+	registerConfigFlags(f)
+}
+
+// addTrackFlags adds the flags forcing the tracks to use.
+func addTrackFlags(f *flag.FlagSet) {
 	f.Int("force-audio-track", -1, "Force the audio track to use. (for example: 4)")
 	f.Int("force-subs-track", -1, "Force the subs track to use. (for example: 3)")
-	f.Bool("show-frames", false, "Show the intro frames config section.")
-	f.Bool("watchforfiles", false, "Watch the directory for incoming files and convert them.")
-	wd, _ := os.Getwd()
-	f.String("sourcedir", wd, "The directory in which to look for videos.")
-	f.Parse(os.Args[1:])
+	f.String("subs", "", "Burn in this srt, ass, ssa or sup file instead of a subtitle track. (converting a single video)")
+	f.Bool("explain", false, "Show how every audio and subtitle track scored when picking the tracks.")
+}
 
-	ka := koanf.New(".")
-	if err := ka.Load(posflag.Provider(f, ".", ka), nil); err != nil {
-		LogErrorln("cannot load the command line arguments:", err)
-		os.Exit(1)
+// loadConfig resolves the config from all its layers once the flags of the command are parsed,
+// writing the default user config first when there is none.
+func loadConfig(f *flag.FlagSet) error {
+	configFile := configFilename()
+	if !FileExists(configFile) {
+		SaveDefaultConfig()
 	}
-	config.arguments = Arguments{}
-	config.arguments.File = ka.String("file")
-	config.arguments.OnlyCut = ka.Bool("onlycut")
-	config.arguments.CutStart = ka.String("cutstart")
-	config.arguments.CutEnd = ka.String("cutend")
-	config.arguments.DumpFramesAt = ka.String("dumpframesat")
-	config.arguments.ForceAudioTrack = ka.Int("force-audio-track")
-	config.arguments.ForceSubsTrack = ka.Int("force-subs-track")
-	config.arguments.SourceDirectory = ka.String("sourcedir")
-	config.arguments.WatchForFiles = ka.Bool("watchforfiles")
-	if config.arguments.SourceDirectory == "" {
-		config.arguments.SourceDirectory = wd
+	arguments := Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, Files: f.Args()}
+	if dir, err := f.GetString("sourcedir"); err == nil {
+		arguments.SourceDirectory = dir
 	}
-	if ka.Bool("show-frames") {
-		fmt.Println(config.IntroFrames)
-		os.Exit(0)
+	if arguments.SourceDirectory == "" {
+		arguments.SourceDirectory, _ = os.Getwd()
 	}
+	if track, err := f.GetInt("force-audio-track"); err == nil {
+		arguments.ForceAudioTrack = track
+	}
+	if track, err := f.GetInt("force-subs-track"); err == nil {
+		arguments.ForceSubsTrack = track
+	}
+	if subs, err := f.GetString("subs"); err == nil {
+		arguments.SubsFile = subs
+	}
+	if explain, err := f.GetBool("explain"); err == nil {
+		arguments.Explain = explain
+	}
+	if dryRun, err := f.GetBool("dry-run"); err == nil {
+		arguments.DryRun = dryRun
+	}
+	if asJSON, err := f.GetBool("json"); err == nil {
+		arguments.JSON = asJSON
+	}
+	if err := resolveConfig(configFile, arguments.SourceDirectory, os.Environ(), f); err != nil {
+		return fmt.Errorf("cannot load the config: %w", err)
+	}
+	config.arguments = arguments
+	return nil
 }
 
-func ReadConfigFile(fp *file.File) {
-	koanfConfig = koanf.New(".")
-	if err := koanfConfig.Load(fp, toml.Parser()); err != nil {
-		LogErrorln("cannot load config file:", err)
-		os.Exit(1)
+// resolveConfig sets the config from all its layers, keeping track of where every setting came from.
+func resolveConfig(configFile, sourceDir string, environ []string, flags *flag.FlagSet) error {
+	layers, err := loadConfigLayers(configFile, sourceDir, environ, flags)
+	if err != nil {
+		return err
+	}
+	configLayers = layers
+	koanfConfig, configOrigins = mergeConfigLayers(layers)
+	config = Config{}
+	return koanfConfig.Unmarshal("", &config)
+}
+
+// configLayer is one of the places settings come from. Later layers override earlier ones.
+type configLayer struct {
+	origin    string
+	k         *koanf.Koanf
+	directory bool // a .hardsub.toml file
+}
+
+// configLayers are the layers the config got resolved from, to resolve it again for the videos
+// in other directories than the source directory. nil when the config didn't come from layers.
+var configLayers []configLayer
+
+// configForFile resolves the config for a video with the .hardsub.toml files of the directory
+// it's in, instead of those of the source directory. The arguments stay those of base.
+func configForFile(filename string, base Config) (Config, error) {
+	if configLayers == nil {
+		return base, nil
+	}
+	directory, err := directoryConfigLayers(filepath.Dir(filename))
+	if err != nil {
+		return base, err
+	}
+	var layers []configLayer
+	for _, layer := range configLayers {
+		if layer.directory {
+			continue
+		}
+		if layer.origin == "environment" {
+			// the directory files override the user config, the environment and the flags override them.
+			layers = append(layers, directory...)
+		}
+		layers = append(layers, layer)
+	}
+	merged, _ := mergeConfigLayers(layers)
+	var c Config
+	if err := merged.Unmarshal("", &c); err != nil {
+		return base, err
+	}
+	c.arguments, c.filesToConvert = base.arguments, base.filesToConvert
+	return c, nil
+}
+
+// loadConfigFile reads a toml config file as a layer.
+func loadConfigFile(filename string) (configLayer, error) {
+	k := koanf.New(".")
+	if err := k.Load(file.Provider(filename), toml.Parser()); err != nil {
+		return configLayer{}, fmt.Errorf("cannot load config file %s: %w", filename, err)
+	}
+	return configLayer{origin: filename, k: k}, nil
+}
+
+// directoryConfigLayers reads the .hardsub.toml files from the root down to dir.
+func directoryConfigLayers(dir string) ([]configLayer, error) {
+	var layers []configLayer
+	for _, filename := range directoryConfigFiles(dir) {
+		layer, err := loadConfigFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		layer.directory = true
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// loadConfigLayers reads, in order: the built-in defaults, the user config, the .hardsub.toml files
+// from the root down to sourceDir, the HARDSUB_* environment variables and the config settings
+// given as flags.
+func loadConfigLayers(configFile, sourceDir string, environ []string, flags *flag.FlagSet) ([]configLayer, error) {
+	defaults := koanf.New(".")
+	if err := defaults.Load(structs.Provider(DefaultConfig(), "koanf"), nil); err != nil {
+		return nil, err
+	}
+	layers := []configLayer{{origin: "defaults", k: defaults}}
+
+	if FileExists(configFile) {
+		layer, err := loadConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	directory, err := directoryConfigLayers(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	layers = append(layers, directory...)
+
+	fields := configFields()
+	env := koanf.New(".")
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, envPrefix))
+		kind, ok := fields[key]
+		if !ok {
+			continue
+		}
+		typed, err := parseSetting(kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		env.Set(key, typed)
+	}
+	layers = append(layers, configLayer{origin: "environment", k: env})
+
+	if flags != nil {
+		k := koanf.New(".")
+		// only the flags that were given and are config settings.
+		provider := posflag.ProviderWithFlag(flags, ".", nil, func(f *flag.Flag) (string, interface{}) {
+			if _, ok := fields[f.Name]; !ok {
+				return "", nil
+			}
+			return f.Name, posflag.FlagVal(flags, f)
+		})
+		if err := k.Load(provider, nil); err != nil {
+			return nil, err
+		}
+		layers = append(layers, configLayer{origin: "flags", k: k})
+	}
+	return layers, nil
+}
+
+// mergeConfigLayers merges the layers in order and tells which layer each resulting setting came from.
+func mergeConfigLayers(layers []configLayer) (*koanf.Koanf, map[string]string) {
+	merged := koanf.New(".")
+	origins := map[string]string{}
+	for _, layer := range layers {
+		merged.Merge(layer.k)
+		for _, key := range layer.k.Keys() {
+			origins[key] = layer.origin
+		}
+	}
+	return merged, origins
+}
+
+// directoryConfigFiles finds the .hardsub.toml files in dir and its parents, the one closest to dir last.
+func directoryConfigFiles(dir string) []string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for {
+		if candidate := filepath.Join(dir, directoryConfigName); FileExists(candidate) {
+			files = append([]string{candidate}, files...)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return files
+		}
+		dir = parent
+	}
+}
+
+// registerConfigFlags adds a flag for every setting in Config, named after its koanf tag
+// and described by its comment tag. The flags only override the config when they are given.
+func registerConfigFlags(f *flag.FlagSet) {
+	defaults := reflect.ValueOf(DefaultConfig())
+	t := defaults.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("koanf")
+		if key == "" || !field.IsExported() || f.Lookup(key) != nil {
+			continue
+		}
+		usage := field.Tag.Get("comment")
+		value := defaults.Field(i)
+		switch field.Type.Kind() {
+		case reflect.String:
+			f.String(key, value.String(), usage)
+		case reflect.Int:
+			f.Int(key, int(value.Int()), usage)
+		case reflect.Bool:
+			f.Bool(key, value.Bool(), usage)
+		case reflect.Float64:
+			f.Float64(key, value.Float(), usage)
+		}
+	}
+}
+
+// configFields are the names of all the settings in Config, with the kind of value they take.
+func configFields() map[string]reflect.Kind {
+	fields := map[string]reflect.Kind{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if key := field.Tag.Get("koanf"); key != "" && field.IsExported() {
+			fields[key] = field.Type.Kind()
+		}
+	}
+	return fields
+}
+
+// parseSetting turns the text of an environment variable into the kind of value the setting takes.
+func parseSetting(kind reflect.Kind, value string) (interface{}, error) {
+	switch kind {
+	case reflect.Int:
+		return strconv.Atoi(value)
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	case reflect.String:
+		return value, nil
+	}
+	return nil, fmt.Errorf("can't be set from the environment")
+}
+
+// ShowConfig prints the effective config, with the layer every setting came from when origin is set.
+func ShowConfig(w io.Writer, k *koanf.Koanf, origins map[string]string, origin bool) {
+	for _, key := range k.Keys() {
+		value := k.Get(key)
+		line := fmt.Sprintf("%s = %v", key, value)
+		if s, ok := value.(string); ok {
+			line = fmt.Sprintf("%s = %q", key, s)
+		}
+		if origin {
+			fmt.Fprintf(w, "%-50s # %s\n", line, origins[key])
+			continue
+		}
+		fmt.Fprintln(w, line)
 	}
-	koanfConfig.Unmarshal("", &config)
 }
 
 func SaveDefaultConfig() {
@@ -133,14 +371,19 @@ func SaveDefaultConfig() {
 }
 
 func (c *Config) IntroFramesForFilename(filename string) (IntroBoundaries, error) {
-	for k := range config.IntroFrames {
-		if strings.HasPrefix(strings.ToLower(filepath.Base(filename)), strings.ToLower(k)) {
-			return config.IntroFrames[k], nil
+	for k := range c.IntroFrames {
+		if hasSeriesPrefix(filename, k) {
+			return c.IntroFrames[k], nil
 		}
 	}
 	return IntroFramesForFilename(filename)
 }
 
+// hasSeriesPrefix tells if filename is a video of the series with prefix, like the keys of the introframes setting.
+func hasSeriesPrefix(filename, prefix string) bool {
+	return strings.HasPrefix(strings.ToLower(filepath.Base(filename)), strings.ToLower(prefix))
+}
+
 // go look for correctly named files in the configuration directory.
 func IntroFramesForFilename(filename string) (IntroBoundaries, error) {
 	configDir := filepath.Dir(configFilename())
@@ -158,14 +401,14 @@ func IntroFramesForFilename(filename string) (IntroBoundaries, error) {
 
 			if begin >= 0 && strings.Contains(filename, f.Name()[:begin]) {
 				ib.Begin = filepath.Join(configDir, f.Name())
-				fmt.Println("Found begin frame: ", ib.Begin)
+				log.Println("Found begin frame: ", ib.Begin)
 			}
 		}
 		if strings.HasSuffix(f.Name(), "_end.png") {
 			end := strings.Index(f.Name(), "_end.png")
 			if end >= 0 && strings.Contains(filename, f.Name()[:end]) {
 				ib.End = filepath.Join(configDir, f.Name())
-				fmt.Println("Found end frame: ", ib.End)
+				log.Println("Found end frame: ", ib.End)
 			}
 		}
 	}
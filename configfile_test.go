@@ -16,8 +16,13 @@ limitations under the License.
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+
+	flag "github.com/spf13/pflag"
 )
 
 func TestIntroFramesForFilename(t *testing.T) {
@@ -46,3 +51,138 @@ func TestIntroFramesForFilename(t *testing.T) {
 		})
 	}
 }
+
+// keepConfig restores the global config after the test changes it.
+func keepConfig(t *testing.T) {
+	t.Helper()
+	previous, previousKoanf, previousOrigins, previousLayers := config, koanfConfig, configOrigins, configLayers
+	t.Cleanup(func() {
+		config, koanfConfig, configOrigins, configLayers = previous, previousKoanf, previousOrigins, previousLayers
+	})
+}
+
+func TestResolveConfig(t *testing.T) {
+	keepConfig(t)
+	root := t.TempDir()
+	write := func(filename, content string) string {
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	userConfig := write(filepath.Join(root, "user", "hardsub.toml"), "crf = 20\naudiolang = \"en\"\nh26xpreset = \"slow\"\n")
+	series := filepath.Join(root, "videos", "series")
+	parentConfig := write(filepath.Join(root, "videos", ".hardsub.toml"), "subslang = \"de\"\ncrf = 21\n")
+	seriesConfig := write(filepath.Join(series, ".hardsub.toml"), "crf = 22\n[introframes.show]\nbegin = \"b.png\"\nend = \"e.png\"\n")
+	environ := []string{"HOME=/home/me", "HARDSUB_H26XPRESET=medium", "HARDSUB_RECORD=calls.json", "HARDSUB_NOTASETTING=1", "HARDSUB_WORKERS=3"}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Bool("watchforfiles", false, "")
+	flags.String("sourcedir", "", "")
+	flags.Parse([]string{"--watchforfiles", "--sourcedir", series})
+
+	if err := resolveConfig(userConfig, series, environ, flags); err != nil {
+		t.Fatal(err)
+	}
+	got := []any{config.Crf, config.AudioLang, config.SubsLang, config.H26xPreset, config.WatchForFiles, config.TargetDirectory, config.IntroFrames["show"].Begin, config.Workers}
+	want := []any{22, "en", "de", "medium", true, "converted", "b.png", 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %v, want %v", got, want)
+	}
+	wantOrigins := map[string]string{
+		"crf":                    seriesConfig,
+		"audiolang":              userConfig,
+		"subslang":               parentConfig,
+		"h26xpreset":             "environment",
+		"watchforfiles":          "flags",
+		"targetdir":              "defaults",
+		"introframes.show.begin": seriesConfig,
+	}
+	for key, want := range wantOrigins {
+		if configOrigins[key] != want {
+			t.Errorf("origin of %s = %q, want %q", key, configOrigins[key], want)
+		}
+	}
+	if koanfConfig.Exists("record") {
+		t.Error("HARDSUB_RECORD is not a setting and shouldn't end up in the config")
+	}
+
+	if _, err := loadConfigLayers(userConfig, series, []string{"HARDSUB_CRF=lots"}, nil); err == nil {
+		t.Error("a setting that doesn't parse should be an error")
+	}
+
+	var sb strings.Builder
+	ShowConfig(&sb, koanfConfig, configOrigins, true)
+	if !strings.Contains(sb.String(), `h26xpreset = "medium"`) || !strings.Contains(sb.String(), "# environment") {
+		t.Errorf("ShowConfig() doesn't show the preset with its origin:\n%s", sb.String())
+	}
+}
+
+func TestConfigForFile(t *testing.T) {
+	keepConfig(t)
+	root := t.TempDir()
+	userConfig := filepath.Join(root, "hardsub.toml")
+	os.WriteFile(userConfig, []byte("crf = 20\nsubslang = \"en\"\n"), 0o644)
+	for dir, content := range map[string]string{
+		"first":  "crf = 18\n",
+		"second": "crf = 26\nsubslang = \"de\"\n",
+	} {
+		os.MkdirAll(filepath.Join(root, "videos", dir), 0o755)
+		os.WriteFile(filepath.Join(root, "videos", dir, directoryConfigName), []byte(content), 0o644)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	flags.Parse([]string{"--subslang", "fr"})
+	// the source directory has no .hardsub.toml of its own, the videos are in the folders below it.
+	if err := resolveConfig(userConfig, filepath.Join(root, "videos"), nil, flags); err != nil {
+		t.Fatal(err)
+	}
+	config.arguments = Arguments{SourceDirectory: filepath.Join(root, "videos")}
+	tests := []struct {
+		file     string
+		crf      int
+		subsLang string
+	}{
+		{filepath.Join(root, "videos", "first", "show_01.mkv"), 18, "fr"},
+		{filepath.Join(root, "videos", "second", "show_01.mkv"), 26, "fr"},
+		{filepath.Join(root, "videos", "show_01.mkv"), 20, "fr"},
+	}
+	for _, tt := range tests {
+		got, err := configForFile(tt.file, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Crf != tt.crf || got.SubsLang != tt.subsLang || !reflect.DeepEqual(got.arguments, config.arguments) {
+			t.Errorf("configForFile(%s) = crf %d, subslang %q, %+v, want crf %d, subslang %q and the arguments",
+				tt.file, got.Crf, got.SubsLang, got.arguments, tt.crf, tt.subsLang)
+		}
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	keepConfig(t)
+	dir := t.TempDir()
+	userConfig := filepath.Join(dir, "hardsub.toml")
+	os.WriteFile(userConfig, []byte("crf = 20\nsubslang = \"de\"\nmkv = true\n"), 0o644)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	if flags.Lookup("introframes") != nil {
+		t.Error("maps can't be given on the command line")
+	}
+	if usage := flags.Lookup("h265").Usage; !strings.HasPrefix(usage, "Use H265 encoding.") {
+		t.Errorf("h265 flag usage = %q, want the comment tag", usage)
+	}
+	if err := flags.Parse([]string{"--crf", "24", "--h265", "--targetdir", "out"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveConfig(userConfig, dir, nil, flags); err != nil {
+		t.Fatal(err)
+	}
+	got := []any{config.Crf, config.H265, config.TargetDirectory, config.SubsLang, config.Mkv}
+	want := []any{24, true, "out", "de", true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,351 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encoder is a video encoder ffmpeg can use, in software or on a GPU.
+type Encoder struct {
+	Name     string // what the encoder setting calls it
+	FFmpeg   string // what ffmpeg calls it
+	Codec    string // h264, hevc, av1 or vp9
+	Hardware string // vaapi, qsv or nvenc, empty for the software encoders
+	TwoPass  bool   // can do two-pass encoding
+	quality  func(config Config, rate RateControl) []string
+}
+
+// encoders are the encoders the encoder setting can pick.
+var encoders = []Encoder{
+	{Name: "x264", FFmpeg: "libx264", Codec: "h264", TwoPass: true, quality: x26xQuality},
+	{Name: "x265", FFmpeg: "libx265", Codec: "hevc", TwoPass: true, quality: x26xQuality},
+	{Name: "svtav1", FFmpeg: "libsvtav1", Codec: "av1", quality: func(config Config, rate RateControl) []string {
+		return append(rateOptions("-crf", config, rate), "-preset", svtav1Preset(config.H26xPreset))
+	}},
+	{Name: "vp9", FFmpeg: "libvpx-vp9", Codec: "vp9", TwoPass: true, quality: func(config Config, rate RateControl) []string {
+		// with a crf, -b:v is the cap and 0 makes it a constant quality.
+		opts := []string{"-crf", strconv.Itoa(config.crf()), "-b:v", "0"}
+		switch rate.Mode {
+		case rateCappedCrf:
+			opts[3] = kbit(rate.Bitrate)
+		case rateAbr, rateSize:
+			opts = []string{"-b:v", kbit(rate.Bitrate)}
+		}
+		return append(opts, "-row-mt", "1")
+	}},
+	{Name: "h264_vaapi", FFmpeg: "h264_vaapi", Codec: "h264", Hardware: "vaapi", quality: vaapiQuality},
+	{Name: "hevc_vaapi", FFmpeg: "hevc_vaapi", Codec: "hevc", Hardware: "vaapi", quality: vaapiQuality},
+	{Name: "h264_qsv", FFmpeg: "h264_qsv", Codec: "h264", Hardware: "qsv", quality: qsvQuality},
+	{Name: "hevc_qsv", FFmpeg: "hevc_qsv", Codec: "hevc", Hardware: "qsv", quality: qsvQuality},
+	{Name: "h264_nvenc", FFmpeg: "h264_nvenc", Codec: "h264", Hardware: "nvenc", quality: nvencQuality},
+	{Name: "hevc_nvenc", FFmpeg: "hevc_nvenc", Codec: "hevc", Hardware: "nvenc", quality: nvencQuality},
+}
+
+func x26xQuality(config Config, rate RateControl) []string {
+	opts := append(rateOptions("-crf", config, rate), "-preset", config.H26xPreset)
+	if config.H26xTune != "none" {
+		opts = append(opts, "-tune", config.H26xTune)
+	}
+	return opts
+}
+
+// vaapiQuality uses a constant qp for the crf, which doesn't know about a cap.
+func vaapiQuality(config Config, rate RateControl) []string {
+	return rateOptions("-qp", config, rate)
+}
+
+func qsvQuality(config Config, rate RateControl) []string {
+	// the qsv encoders know the x264 preset names.
+	return append(rateOptions("-global_quality", config, rate), "-preset", config.H26xPreset)
+}
+
+func nvencQuality(config Config, rate RateControl) []string {
+	opts := append([]string{"-rc", "vbr"}, rateOptions("-cq", config, rate)...)
+	if rate.Mode == rateCrf || rate.Mode == rateCappedCrf {
+		// without -b:v 0 nvenc caps the quality at its default bitrate.
+		opts = append(opts, "-b:v", "0")
+	}
+	return opts
+}
+
+// rateOptions are the options for the rate control most encoders understand, with the option they take the crf as.
+func rateOptions(crfOption string, config Config, rate RateControl) []string {
+	switch rate.Mode {
+	case rateCappedCrf:
+		return []string{crfOption, strconv.Itoa(config.crf()), "-maxrate", kbit(rate.Bitrate), "-bufsize", kbit(2 * rate.Bitrate)}
+	case rateAbr, rateSize:
+		return []string{"-b:v", kbit(rate.Bitrate)}
+	}
+	return []string{crfOption, strconv.Itoa(config.crf())}
+}
+
+// kbit is a bitrate in kbit/s the way ffmpeg takes it.
+func kbit(rate int) string {
+	return strconv.Itoa(rate) + "k"
+}
+
+// svtav1Preset translates the x264 preset names to the numbered SVT-AV1 presets, which go from 0 (slowest) to 13.
+func svtav1Preset(preset string) string {
+	presets := map[string]string{
+		"ultrafast": "12", "superfast": "11", "veryfast": "10", "faster": "9", "fast": "8",
+		"medium": "6", "slow": "5", "slower": "4", "veryslow": "2", "placebo": "0",
+	}
+	if p, ok := presets[preset]; ok {
+		return p
+	}
+	return preset
+}
+
+// encoderNamed finds the encoder the encoder setting calls name.
+func encoderNamed(name string) (Encoder, bool) {
+	for _, e := range encoders {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Encoder{}, false
+}
+
+// softwareEncoder is the software encoder for the codec.
+func softwareEncoder(codec string) (Encoder, bool) {
+	for _, e := range encoders {
+		if e.Hardware == "" && e.Codec == codec {
+			return e, true
+		}
+	}
+	return Encoder{}, false
+}
+
+// Fallback is the software encoder for the same codec, which we use when the hardware isn't there.
+func (e Encoder) Fallback() Encoder {
+	if software, ok := softwareEncoder(e.Codec); ok {
+		return software
+	}
+	return e
+}
+
+// Globals are the ffmpeg options the encoder needs before the inputs.
+func (e Encoder) Globals(config Config) []string {
+	if e.Hardware == "vaapi" {
+		return []string{"-vaapi_device", config.VaapiDevice}
+	}
+	return nil
+}
+
+// Filters are the filters that go at the end of the video filter chain to get the frames to the encoder.
+func (e Encoder) Filters() []string {
+	switch e.Hardware {
+	case "vaapi":
+		return []string{"format=nv12", "hwupload"}
+	case "qsv":
+		return []string{"format=nv12"}
+	}
+	return nil
+}
+
+// Options are the output options selecting the encoder, its rate control and the pass it's doing.
+func (e Encoder) Options(config Config, rate RateControl) []string {
+	opts := []string{"-c:v", e.FFmpeg}
+	if e.quality != nil {
+		opts = append(opts, e.quality(config, rate)...)
+	}
+	if e.Hardware == "" {
+		opts = append(opts, threadOptions(config, e)...)
+	}
+	if rate.Pass == 0 {
+		return opts
+	}
+	if e.Name == "x265" {
+		// x265 has its own pass options, next to the thread pools.
+		return addX265Params(opts, fmt.Sprintf("pass=%d:stats=%s", rate.Pass, rate.PassLog+".log"))
+	}
+	return append(opts, "-pass", strconv.Itoa(rate.Pass), "-passlogfile", rate.PassLog)
+}
+
+// addX265Params adds params to the -x265-params in opts, ffmpeg only uses the last one.
+func addX265Params(opts []string, params string) []string {
+	for i := 0; i < len(opts)-1; i++ {
+		if opts[i] == "-x265-params" {
+			opts[i+1] += ":" + params
+			return opts
+		}
+	}
+	return append(opts, "-x265-params", params)
+}
+
+// apply makes cmd encode the video with e. Commands with a filter graph need to add Filters to it themselves.
+func (e Encoder) apply(cmd *FFmpegCommand, config Config, rate RateControl) *FFmpegCommand {
+	cmd.Globals(e.Globals(config)...)
+	if cmd.filterComplex == "" {
+		cmd.VideoFilter(e.Filters()...)
+	}
+	return cmd.Options(e.Options(config, rate)...)
+}
+
+// outputEncoding makes a command encode the video and audio, see Profile.encoding.
+type outputEncoding func(cmd *FFmpegCommand) *FFmpegCommand
+
+// the encoders ffmpeg has, found with ffmpeg -encoders. They get found again when the tools change, for the tests.
+var (
+	ffmpegEncodersMutex sync.Mutex
+	ffmpegEncodersTools ToolRunner
+	ffmpegEncodersFound map[string]bool
+)
+
+var encodersArgs = []string{"-hide_banner", "-encoders"}
+
+// ffmpegEncoders asks ffmpeg which video encoders it has, the first time it's needed.
+func ffmpegEncoders() (map[string]bool, error) {
+	ffmpegEncodersMutex.Lock()
+	defer ffmpegEncodersMutex.Unlock()
+	if ffmpegEncodersFound != nil && ffmpegEncodersTools == tools {
+		return ffmpegEncodersFound, nil
+	}
+	output, err := toolOutput("ffmpeg", encodersArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the ffmpeg encoders: %w", err)
+	}
+	found := parseEncoders(string(output))
+	if len(found) == 0 {
+		return nil, fmt.Errorf("ffmpeg -encoders didn't list any video encoders")
+	}
+	ffmpegEncodersFound, ffmpegEncodersTools = found, tools
+	return ffmpegEncodersFound, nil
+}
+
+// parseEncoders reads the video encoders from the output of ffmpeg -encoders, which lists them like
+//
+//	V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+//
+// after a legend that ends with a line of dashes.
+func parseEncoders(output string) map[string]bool {
+	found := map[string]bool{}
+	legend := true
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if legend {
+			legend = len(fields) == 0 || !strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "V") {
+			continue
+		}
+		found[fields[1]] = true
+	}
+	return found
+}
+
+// chooseEncoder picks the encoder the config asks for, or the software encoder for the same codec
+// when ffmpeg doesn't have the hardware one.
+func chooseEncoder(config Config) (Encoder, error) {
+	encoder, err := configuredEncoder(config)
+	if err != nil {
+		return Encoder{}, err
+	}
+	available, err := ffmpegEncoders()
+	if err != nil {
+		// ffmpeg will tell us soon enough.
+		Log(err)
+		return encoder, nil
+	}
+	if available[encoder.FFmpeg] {
+		return encoder, nil
+	}
+	if fallback := encoder.Fallback(); encoder.Hardware != "" && available[fallback.FFmpeg] {
+		log.Printf("ffmpeg doesn't have the %s encoder, using %s instead.\n", encoder.FFmpeg, fallback.FFmpeg)
+		return fallback, nil
+	}
+	return Encoder{}, fmt.Errorf("ffmpeg doesn't have the %s encoder for the %s encoder setting", encoder.FFmpeg, encoder.Name)
+}
+
+// configuredEncoder is the encoder the config asks for, whether ffmpeg has it or not.
+// Without an encoder setting, it's the software encoder for the video codec of the profile.
+func configuredEncoder(config Config) (Encoder, error) {
+	profile, err := outputProfile(config)
+	if err != nil {
+		return Encoder{}, err
+	}
+	if config.Encoder == "" {
+		encoder, _ := softwareEncoder(profile.Video)
+		return encoder, nil
+	}
+	encoder, ok := encoderNamed(config.Encoder)
+	if !ok {
+		var names []string
+		for _, e := range encoders {
+			names = append(names, e.Name)
+		}
+		return Encoder{}, fmt.Errorf("unknown encoder %q, use one of %s", config.Encoder, strings.Join(names, ", "))
+	}
+	if encoder.Codec != profile.Video {
+		return Encoder{}, fmt.Errorf("the %s encoder makes %s video, the %s profile needs %s", encoder.Name, encoder.Codec, profile.Name, profile.Video)
+	}
+	return encoder, nil
+}
+
+// encodeWithFallback runs the commands encode makes for the encoder. When a hardware encoder fails
+// to initialise, it runs them again with the software encoder. Other failures, like a full disk,
+// would fail in software as well and get returned as they are.
+// It returns the encoder that made the output.
+func encodeWithFallback(encoder Encoder, run func([]*FFmpegCommand) error, encode func(Encoder) []*FFmpegCommand) (Encoder, error) {
+	err := run(encode(encoder))
+	if err == nil || encoder.Hardware == "" || !hardwareInitFailed(err, encoder) {
+		return encoder, err
+	}
+	fallback := encoder.Fallback()
+	log.Printf("The %s encoder failed (%v), trying again with %s.\n", encoder.FFmpeg, err, fallback.FFmpeg)
+	return fallback, run(encode(fallback))
+}
+
+// what ffmpeg writes when a hardware encoder can't get at its device, in lowercase.
+var hardwareInitFailures = []string{
+	"failed to initialise vaapi", "failed to initialize vaapi", "no va display found", "device creation failed",
+	"cannot load libcuda", "cannot load nvcuda", "no capable devices found", "openencodesessionex failed",
+	"error creating a mfx session", "unsupported hardware",
+}
+
+// hardwareInitFailed tells from the end of ffmpeg's stderr if the encoder failed because it couldn't
+// initialise its device. Opening the output stream failing only counts when the encoder complained about it.
+func hardwareInitFailed(err error, encoder Encoder) bool {
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		return false
+	}
+	encoderFailed, openFailed := false, false
+	for _, line := range toolErr.Stderr {
+		line = strings.ToLower(line)
+		for _, failure := range hardwareInitFailures {
+			if strings.Contains(line, failure) {
+				return true
+			}
+		}
+		if strings.Contains(line, "["+encoder.FFmpeg+" @") {
+			encoderFailed = true
+		}
+		if strings.Contains(line, "error initializing output stream") || strings.Contains(line, "error while opening encoder") {
+			openFailed = true
+		}
+	}
+	return encoderFailed && openFailed
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cannedEncoders answers ffmpeg -encoders like an ffmpeg with x264, x265, vp9, SVT-AV1, vaapi and h264_nvenc.
+func cannedEncoders(t *testing.T) FakeResponse {
+	t.Helper()
+	output, err := os.ReadFile("testdata/ffmpeg-encoders.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FakeResponse{Name: "ffmpeg", Args: encodersArgs, Stdout: string(output)}
+}
+
+func TestParseEncoders(t *testing.T) {
+	found := parseEncoders(cannedEncoders(t).Stdout)
+	for _, name := range []string{"libx264", "libx265", "libvpx-vp9", "libsvtav1", "h264_vaapi", "hevc_vaapi", "h264_nvenc"} {
+		if !found[name] {
+			t.Errorf("didn't find %s", name)
+		}
+	}
+	for _, name := range []string{"aac", "srt", "hevc_nvenc", "------", "V....."} {
+		if found[name] {
+			t.Errorf("found %s, which isn't a video encoder", name)
+		}
+	}
+}
+
+func TestChooseEncoder(t *testing.T) {
+	useFakeRunner(t, cannedEncoders(t))
+	tests := []struct {
+		name    string
+		config  Config
+		want    string
+		wantErr string
+	}{
+		{"default", Config{}, "libx264", ""},
+		{"h265", Config{H265: true}, "libx265", ""},
+		{"profile", Config{Profile: "webm-av1"}, "libsvtav1", ""},
+		{"setting", Config{Profile: "webm-vp9", Encoder: "vp9"}, "libvpx-vp9", ""},
+		{"hardware", Config{H265: true, Encoder: "hevc_vaapi"}, "hevc_vaapi", ""},
+		{"missing hardware", Config{Profile: "mkv-hevc", Encoder: "hevc_nvenc"}, "libx265", ""},
+		{"missing qsv", Config{Encoder: "h264_qsv"}, "libx264", ""},
+		{"unknown", Config{Encoder: "x266"}, "", `unknown encoder "x266"`},
+		{"other codec", Config{Encoder: "hevc_vaapi"}, "", "the mp4-h264 profile needs h264"},
+		{"unknown profile", Config{Profile: "avi-divx"}, "", `unknown profile "avi-divx"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := chooseEncoder(tt.config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("chooseEncoder() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.FFmpeg != tt.want {
+				t.Errorf("chooseEncoder() = %s, %v, want %s", got.FFmpeg, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseEncoderWithoutSoftware(t *testing.T) {
+	useFakeRunner(t, FakeResponse{Name: "ffmpeg", Args: encodersArgs, Stdout: " ------\n V....D h264_vaapi           H.264/AVC (VAAPI) (codec h264)\n"})
+	if _, err := chooseEncoder(Config{H265: true, Encoder: "hevc_qsv"}); err == nil {
+		t.Error("want an error when ffmpeg has neither the encoder nor its fallback")
+	}
+	if got, err := chooseEncoder(Config{Encoder: "h264_vaapi"}); err != nil || got.Name != "h264_vaapi" {
+		t.Errorf("chooseEncoder() = %s, %v, want h264_vaapi", got.Name, err)
+	}
+}
+
+func TestEncoderApply(t *testing.T) {
+	config := DefaultConfig()
+	tests := []struct {
+		encoder string
+		want    []string
+	}{
+		{"x264", []string{"-i", "in.mkv", "-c:v", "libx264", "-crf", "18", "-preset", "fast", "-tune", "animation", "out.mp4"}},
+		{"svtav1", []string{"-i", "in.mkv", "-c:v", "libsvtav1", "-crf", "18", "-preset", "8", "out.mp4"}},
+		{"h264_vaapi", []string{"-vaapi_device", "/dev/dri/renderD128", "-i", "in.mkv", "-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi", "-qp", "18", "out.mp4"}},
+		{"hevc_nvenc", []string{"-i", "in.mkv", "-c:v", "hevc_nvenc", "-rc", "vbr", "-cq", "18", "-b:v", "0", "out.mp4"}},
+	}
+	for _, tt := range tests {
+		encoder, _ := encoderNamed(tt.encoder)
+		got := encoder.apply(NewFFmpegCommand().Input("in.mkv"), config, RateControl{Mode: rateCrf}).Output("out.mp4").Args()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.encoder, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeWithFallback(t *testing.T) {
+	vaapi, _ := encoderNamed("h264_vaapi")
+	var ran []string
+	run := func(cmds []*FFmpegCommand) error {
+		ran = append(ran, cmds[0].String())
+		if strings.Contains(cmds[0].String(), "vaapi") {
+			// what ffmpeg does when it cannot open the device.
+			return &ToolError{Name: "ffmpeg", ExitCode: 1, Stderr: []string{
+				"[AVHWDeviceContext @ 0x55d0] Failed to initialise VAAPI connection: -1 (unknown libva error).",
+				"Device creation failed: -5.",
+			}}
+		}
+		return nil
+	}
+	encode := func(e Encoder) []*FFmpegCommand {
+		return []*FFmpegCommand{e.apply(NewFFmpegCommand().Input("in.mkv"), DefaultConfig(), RateControl{Mode: rateCrf}).Output("out.mp4")}
+	}
+	used, err := encodeWithFallback(vaapi, run, encode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used.Name != "x264" || len(ran) != 2 || !strings.Contains(ran[1], "-c:v libx264") {
+		t.Errorf("used %s after running %v, want a second run with x264", used.Name, ran)
+	}
+
+	x264, _ := encoderNamed("x264")
+	ran = nil
+	fail := func(cmds []*FFmpegCommand) error {
+		ran = append(ran, cmds[0].String())
+		return &ExitError{Name: "ffmpeg", Code: 1}
+	}
+	if _, err := encodeWithFallback(x264, fail, encode); err == nil || len(ran) != 1 {
+		t.Errorf("a failing software encoder ran %d times with error %v, want once with an error", len(ran), err)
+	}
+}
+
+func TestEncodeWithoutFallback(t *testing.T) {
+	nvenc, _ := encoderNamed("h264_nvenc")
+	encode := func(e Encoder) []*FFmpegCommand {
+		return []*FFmpegCommand{e.apply(NewFFmpegCommand().Input("in.mkv"), DefaultConfig(), RateControl{Mode: rateCrf}).Output("out.mp4")}
+	}
+	tests := []struct {
+		name     string
+		err      error
+		fallback bool
+	}{
+		{"disk full", &ToolError{Name: "ffmpeg", ExitCode: 1, Failure: failureDiskFull, Stderr: []string{
+			"[mp4 @ 0x55d0] Error writing trailer: No space left on device"}}, false},
+		{"missing font", &ToolError{Name: "ffmpeg", ExitCode: 1, Failure: failureMissingFont, Stderr: []string{
+			"[Parsed_subtitles_0 @ 0x55d0] fontselect: failed to find any fallback with glyph 0x3042", "Error initializing output stream 0:0"}}, false},
+		{"cancelled", context.Canceled, false},
+		{"no cuda", &ToolError{Name: "ffmpeg", ExitCode: 1, Stderr: []string{
+			"[h264_nvenc @ 0x55d0] Cannot load libcuda.so.1"}}, true},
+		{"encoder won't open", &ToolError{Name: "ffmpeg", ExitCode: 1, Stderr: []string{
+			"[h264_nvenc @ 0x55d0] InitializeEncoder failed: invalid param (8)",
+			"Error initializing output stream 0:0 -- Error while opening encoder for output stream #0:0"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			run := func(cmds []*FFmpegCommand) error {
+				runs++
+				if runs == 1 {
+					return tt.err
+				}
+				return nil
+			}
+			used, err := encodeWithFallback(nvenc, run, encode)
+			if tt.fallback {
+				if err != nil || used.Name != "x264" || runs != 2 {
+					t.Errorf("used %s after %d runs with error %v, want x264 after falling back", used.Name, runs, err)
+				}
+				return
+			}
+			if err != tt.err || used.Name != "h264_nvenc" || runs != 1 {
+				t.Errorf("used %s after %d runs with error %v, want the first error without falling back", used.Name, runs, err)
+			}
+		})
+	}
+}
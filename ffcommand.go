@@ -0,0 +1,164 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"strings"
+)
+
+// FFmpegCommand builds the argument list for an ffmpeg invocation.
+// Every argument stays a separate string, so filenames with spaces or quotes don't need detoxing.
+type FFmpegCommand struct {
+	globals       []string
+	inputs        []ffmpegInput
+	filterComplex string
+	maps          []string
+	videoFilters  []string
+	audioFilters  []string
+	options       []string
+	output        string
+}
+
+type ffmpegInput struct {
+	options []string
+	path    string
+}
+
+func NewFFmpegCommand() *FFmpegCommand {
+	return &FFmpegCommand{}
+}
+
+// quietFFmpeg is the command we use most: overwrite the output and only show errors and stats.
+func quietFFmpeg() *FFmpegCommand {
+	return NewFFmpegCommand().Globals("-y", "-hide_banner", "-loglevel", "error", "-stats")
+}
+
+// Globals adds options that go before the inputs.
+func (c *FFmpegCommand) Globals(opts ...string) *FFmpegCommand {
+	c.globals = append(c.globals, opts...)
+	return c
+}
+
+// Input adds an input file, the options apply to this input only. (-ss, -loop, -f, ...)
+func (c *FFmpegCommand) Input(path string, opts ...string) *FFmpegCommand {
+	c.inputs = append(c.inputs, ffmpegInput{options: opts, path: path})
+	return c
+}
+
+func (c *FFmpegCommand) Map(specs ...string) *FFmpegCommand {
+	c.maps = append(c.maps, specs...)
+	return c
+}
+
+// FilterComplex sets the -filter_complex graph. Values inside it need escaping with escapeFilterValue.
+func (c *FFmpegCommand) FilterComplex(graph string) *FFmpegCommand {
+	c.filterComplex = graph
+	return c
+}
+
+// VideoFilter adds filters to the -vf chain.
+func (c *FFmpegCommand) VideoFilter(filters ...string) *FFmpegCommand {
+	c.videoFilters = append(c.videoFilters, filters...)
+	return c
+}
+
+// AudioFilter adds filters to the -af chain.
+func (c *FFmpegCommand) AudioFilter(filters ...string) *FFmpegCommand {
+	c.audioFilters = append(c.audioFilters, filters...)
+	return c
+}
+
+// Options adds output options, like the codecs and their settings.
+func (c *FFmpegCommand) Options(opts ...string) *FFmpegCommand {
+	c.options = append(c.options, opts...)
+	return c
+}
+
+// X265Params adds params to the -x265-params of the command, ffmpeg only uses the last one.
+func (c *FFmpegCommand) X265Params(params string) *FFmpegCommand {
+	if params != "" {
+		c.options = addX265Params(c.options, params)
+	}
+	return c
+}
+
+func (c *FFmpegCommand) Output(path string) *FFmpegCommand {
+	c.output = path
+	return c
+}
+
+// Args returns the arguments to pass to ffmpeg.
+func (c *FFmpegCommand) Args() []string {
+	args := append([]string{}, c.globals...)
+	for _, input := range c.inputs {
+		args = append(args, input.options...)
+		args = append(args, "-i", input.path)
+	}
+	if c.filterComplex != "" {
+		args = append(args, "-filter_complex", c.filterComplex)
+	}
+	for _, m := range c.maps {
+		args = append(args, "-map", m)
+	}
+	if len(c.videoFilters) > 0 {
+		args = append(args, "-vf", strings.Join(c.videoFilters, ","))
+	}
+	if len(c.audioFilters) > 0 {
+		args = append(args, "-af", strings.Join(c.audioFilters, ","))
+	}
+	args = append(args, c.options...)
+	if c.output != "" {
+		args = append(args, c.output)
+	}
+	return args
+}
+
+// String returns the command the way you'd type it in a shell, for logging.
+func (c *FFmpegCommand) String() string {
+	return shellJoin(append([]string{"ffmpeg"}, c.Args()...))
+}
+
+// escapeFilterValue escapes a value (like a filename) for use as a filter option
+// in a -vf or -filter_complex filtergraph.
+// ffmpeg unescapes twice: once when parsing the graph and once when parsing the filter options.
+func escapeFilterValue(value string) string {
+	optionEscaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	graphEscaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+	return graphEscaper.Replace(optionEscaper.Replace(value))
+}
+
+// concatFileLine is the line for filename in the input file for ffmpeg's concat demuxer.
+func concatFileLine(filename string) string {
+	return "file '" + strings.ReplaceAll(filename, "'", `'\''`) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if !strings.ContainsAny(arg, " \t\n'\"\\$`|&;()<>[]*?!#~{}") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFFmpegCommandArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  *FFmpegCommand
+		want []string
+	}{
+		{
+			"filename with spaces",
+			quietFFmpeg().
+				Input("My Show - 01 [1080p].mkv").
+				Map("0:0", "0:1").
+				VideoFilter("subtitles="+escapeFilterValue("My Show - 01 [1080p].ass")).
+				Options("-c:v", "libx264").
+				Output("converted/My Show - 01 [1080p].mp4"),
+			[]string{
+				"-y", "-hide_banner", "-loglevel", "error", "-stats",
+				"-i", "My Show - 01 [1080p].mkv",
+				"-map", "0:0", "-map", "0:1",
+				"-vf", `subtitles=My Show - 01 \[1080p\].ass`,
+				"-c:v", "libx264",
+				"converted/My Show - 01 [1080p].mp4",
+			},
+		},
+		{
+			"input options and filter complex",
+			NewFFmpegCommand().
+				Input("video.mkv").
+				Input("frame.png", "-loop", "1").
+				FilterComplex("blend=difference:shortest=1").
+				AudioFilter("atempo=1.5").
+				Output("-"),
+			[]string{
+				"-i", "video.mkv",
+				"-loop", "1", "-i", "frame.png",
+				"-filter_complex", "blend=difference:shortest=1",
+				"-af", "atempo=1.5",
+				"-",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cmd.Args(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Args() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeFilterValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain.ass", "plain.ass"},
+		{"C:/subs/ep1.ass", `C\\:/subs/ep1.ass`},
+		{"it's.ass", `it\\\'s.ass`},
+		{"a,b;c[d].ass", `a\,b\;c\[d\].ass`},
+		{`back\slash.ass`, `back\\\\slash.ass`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := escapeFilterValue(tt.value); got != tt.want {
+				t.Errorf("escapeFilterValue() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFFmpegCommandString(t *testing.T) {
+	cmd := NewFFmpegCommand().Input("it's a video.mkv").Output("out.mp4")
+	want := `ffmpeg -i 'it'\''s a video.mkv' out.mp4`
+	if got := cmd.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
+
+func Test_concatFileLine(t *testing.T) {
+	if got, want := concatFileLine("/tmp/it's.mp4"), `file '/tmp/it'\''s.mp4'`; got != want {
+		t.Errorf("concatFileLine() = %s, want %s", got, want)
+	}
+}
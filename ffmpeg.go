@@ -17,163 +17,104 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/schollz/progressbar/v3"
 )
 
+// VideoProperties is what the progress of a run on a video gets measured against.
 type VideoProperties struct {
-	Filename        string
-	NrOfVideoFrames int
-	Duration        string
+	Filename string
+	Duration time.Duration // of the container, 0 when ffprobe doesn't know
 }
 
+// GetVideoPropertiesWithFFProbe asks ffprobe for the duration of the video in filename.
 func GetVideoPropertiesWithFFProbe(filename string) VideoProperties {
-	ffprobe, err := FindInPath("ffprobe")
-	if err != nil {
-		fmt.Println("No ffprobe found:", err)
-		return VideoProperties{}
-	}
-	ffprobeCommand := ffprobe + " -v error -select_streams v:0 -count_packets -show_entries stream=nb_read_packets -print_format csv " + filename
-	// output, err := OutputForBashCommand(ffprobeCommand)
-	// ffprobe -i video -show_entries format=duration -v quiet -sexagesimal -of csv
-	output, err := OutputForCommand(ffprobeCommand)
-	if err != nil {
-		fmt.Println("Could not get VideoProperties with FFprobe:", err)
-		return VideoProperties{}
-	}
-	nrOfPackets := strings.TrimSpace(strings.Split(string(output), ",")[1])
-	packets, err := strconv.Atoi(nrOfPackets)
-	if err != nil {
-		fmt.Println("Number of packets not a number?!", "|"+nrOfPackets+"|")
-		return VideoProperties{}
-	}
-	durationCommand := fmt.Sprintf("%s -i %s -show_entries format=duration -v quiet -sexagesimal -of csv", ffprobe, filename)
-	output, err = OutputForCommand(durationCommand)
-	if err != nil {
-		fmt.Println("Could not get duration with ffprobe")
-	}
-	duration := strings.TrimSpace(strings.Split(string(output), ",")[1])
-	return VideoProperties{
-		Filename:        filename,
-		NrOfVideoFrames: packets,
-		Duration:        duration,
+	props := VideoProperties{Filename: filename}
+	if info, err := GetFFprobeInfo(filename); err != nil {
+		fmt.Println("Could not get duration with ffprobe:", err)
+	} else {
+		props.Duration = info.MediaInfo().Duration
 	}
+	return props
 }
 
-func GetVideoParamsFromFFMpeg(filename string) VideoProperties {
-	fmt.Println("Getting video properties of", filename)
-	cmd := exec.Command("ffmpeg", "-i", filename)
-	stderr, _ := cmd.StderrPipe()
-	err := cmd.Start()
-	if err != nil {
-		log.Println("error while getting video parameters: ", err)
-	}
-	scanner := bufio.NewScanner(stderr)
-	scanner.Split(bufio.ScanLines)
-	var SawVideoStream bool
-
-	for scanner.Scan() {
-		m := scanner.Text()
-		if strings.Contains(m, "Stream") {
-			if strings.Contains(m, "Video") {
-				SawVideoStream = true
-			} else {
-				SawVideoStream = false
-			}
-		}
+func RunAndParseFfmpeg(args []string, prop VideoProperties) error {
+	return runFfmpeg(args, prop, nil)
+}
 
-		if SawVideoStream && strings.Contains(m, "NUMBER_OF_FRAMES") {
-			fmt.Println("Saw NUMBER_OF_FRAMES")
-			frameStr := strings.TrimSpace(strings.Split(m, ":")[1])
-			frames, err := strconv.Atoi(frameStr)
-			fmt.Println(frameStr, frames)
-			if err != nil {
-				return VideoProperties{}
+// runFfmpeg runs ffmpeg and reports how far along it is to progress, or to a terminal progress bar when nil.
+// ffmpeg writes its progress to stderr as blocks of key=value lines, each ending with a progress line.
+func runFfmpeg(args []string, prop VideoProperties, progress ProgressReporter) error {
+	if progress == nil {
+		progress = &terminalProgress{}
+	}
+	args = append([]string{"-progress", "pipe:2"}, args...)
+	started := time.Now()
+	event := ProgressEvent{Kind: ProgressBegin, Description: prop.Filename, Total: prop.Duration}
+	progress.Report(event)
+	Log(shellJoin(append([]string{"ffmpeg"}, args...)))
+	err := streamTool(context.Background(), "ffmpeg", args, func(stderr io.Reader) {
+		scanner := bufio.NewScanner(stderr)
+		// the -stats lines end with a carriage return.
+		scanner.Split(scanLinesOrReturns)
+		for scanner.Scan() {
+			if event.update(scanner.Text()) {
+				event.Kind, event.Elapsed = ProgressUpdate, time.Since(started)
+				progress.Report(event)
 			}
-			return VideoProperties{Filename: filename, NrOfVideoFrames: frames}
 		}
-	}
-	return VideoProperties{Filename: filename}
+	})
+	event.Kind, event.Elapsed, event.Failed = ProgressEnd, time.Since(started), err != nil
+	progress.Report(event)
+	return err
 }
 
-func RunAndParseFfmpeg(args string, prop VideoProperties) error {
-	bar := progressbar.NewOptions(
-		prop.NrOfVideoFrames,
-		progressbar.OptionUseANSICodes(true),
-		progressbar.OptionSetPredictTime(true),
-		progressbar.OptionSetDescription(prop.Filename),
-		progressbar.OptionShowElapsedTimeOnFinish(),
-		progressbar.OptionShowDescriptionAtLineEnd(),
-		progressbar.OptionSetRenderBlankState(false),
-	)
-	Log("ffmpeg", args)
-	cmd := exec.Command("ffmpeg", strings.Split(args, " ")...)
-
-	stderr, _ := cmd.StderrPipe() // for some reason ffmpeg outputs to stderr only.
-	cmd.Start()
-
-	scanner := bufio.NewScanner(stderr)
-	scanner.Split(bufio.ScanWords)
-	nextIsFrame := false
-	for scanner.Scan() {
-		m := scanner.Text()
-		if nextIsFrame {
-			nextIsFrame = false
-			curFrame, err := strconv.Atoi(m)
-			if err == nil && (!config.WatchForFiles || !config.arguments.WatchForFiles) {
-				bar.Set(curFrame)
-				// if we're not showing a progress bar yet, show progression of frames encoded.
-				if curFrame < bar.GetMax()/100 {
-					fmt.Printf("\r%d/%d : %s", curFrame, prop.NrOfVideoFrames, prop.Filename)
-				}
-				continue
-			} else {
-				fmt.Println(err)
-			}
-
-		}
-		if strings.HasPrefix(m, "frame=") {
-			if len(m) > 6 {
-				// need to extract frames now, since no space separates the frames and
-				// and the label 'frame='
-				curFrame, err := strconv.Atoi(m[6:])
-				if err == nil {
-					_ = bar.Set(curFrame)
-					continue
-				}
-			} else {
-				nextIsFrame = true
-			}
-		} else {
-			nextIsFrame = false
-		}
+// scanLinesOrReturns splits what ffmpeg writes in lines ending with a newline or a carriage return.
+func scanLinesOrReturns(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
 	}
-	cmd.Wait()
-	if !cmd.ProcessState.Success() {
-		return fmt.Errorf("exitcode %d", cmd.ProcessState.ExitCode())
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
 	}
-	fmt.Printf("\n")
-	return nil
+	return 0, nil, nil
 }
 
-func FastFile(inputFilePath string, outputFilePath string) error {
+func FastFile(inputFilePath string, outputFilePath string, progress ProgressReporter) error {
 	inputProps := GetVideoPropertiesWithFFProbe(inputFilePath)
-	firstPassArgs := fmt.Sprintf("-i %s -map 0:v -c:v copy -bsf:v h264_mp4toannexb raw.h264", inputFilePath)
-	defer os.RemoveAll("raw.h264")
-	err := RunAndParseFfmpeg(firstPassArgs, inputProps)
+	firstPass, secondPass, rawFile := fastFileCommands(inputFilePath, outputFilePath)
+	defer os.RemoveAll(rawFile)
+	err := runFfmpeg(firstPass.Args(), inputProps, progress)
 	if err != nil {
 		return err
 	}
-	ffmpegArgs := fmt.Sprintf("-fflags +genpts -r 36 -i raw.h264 -i %s -map 0:v -c:v copy -map 1:a -af atempo=1.5 -movflags faststart %s", inputFilePath, outputFilePath)
-	return RunAndParseFfmpeg(ffmpegArgs, inputProps)
+	return runFfmpeg(secondPass.Args(), inputProps, progress)
+}
+
+// fastFileCommands returns the two passes making the 1.5x version and the intermediate file between them.
+func fastFileCommands(inputFilePath, outputFilePath string) (firstPass, secondPass *FFmpegCommand, rawFile string) {
+	// named after the output, so parallel conversions don't overwrite each other's.
+	rawFile = strings.TrimSuffix(outputFilePath, path.Ext(outputFilePath)) + ".raw.h264"
+	firstPass = NewFFmpegCommand().
+		Input(inputFilePath).
+		Map("0:v").
+		Options("-c:v", "copy", "-bsf:v", "h264_mp4toannexb").
+		Output(rawFile)
+	secondPass = NewFFmpegCommand().
+		Input(rawFile, "-fflags", "+genpts", "-r", "36").
+		Input(inputFilePath).
+		Map("0:v", "1:a").
+		AudioFilter("atempo=1.5").
+		Options("-c:v", "copy", "-movflags", "faststart").
+		Output(outputFilePath)
+	return firstPass, secondPass, rawFile
 }
 
 /* 1.5x
@@ -183,89 +124,132 @@ rm raw.h264
 */
 
 func SearchForFrame(videoFile, frameImage string) (time.Duration, error) {
-	// ffmpeg -loglevel info -i video.mkv -loop 1 -i frameImage.jpg -an -filter_complex "blend=difference:shortest=1,blackframe=98:32" -f null -
-	args := fmt.Sprintf("-loglevel info -i %s -loop 1 -i %s -an -filter_complex blend=difference:shortest=1,blackframe=98:32 -f null -progress - -", videoFile, frameImage)
-
-	cmd := exec.Command("ffmpeg", strings.Split(args, " ")...)
-
-	stderr, _ := cmd.StderrPipe() // for some reason ffmpeg outputs to stderr only.
-	cmd.Start()
-	// [Parsed_blackframe_1 @ 0x9f27880] frame:2470 pblack:100 pts:103020 t:103.020000 type:I last_keyframe:2448
-	scanner := bufio.NewScanner(stderr)
-	scanner.Split(bufio.ScanWords)
-	for scanner.Scan() {
-		m := scanner.Text()
-		if strings.HasPrefix(m, "t:") {
-			if s, err := strconv.ParseFloat(m[2:], 64); err == nil {
-				cmd.Process.Kill()
-				return time.ParseDuration(fmt.Sprintf("%fs", s))
+	cmd := searchFrameCommand(videoFile, frameImage)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	found := false
+	var seconds float64
+	// for some reason ffmpeg outputs to stderr only.
+	err := streamTool(ctx, "ffmpeg", cmd.Args(), func(stderr io.Reader) {
+		// [Parsed_blackframe_1 @ 0x9f27880] frame:2470 pblack:100 pts:103020 t:103.020000 type:I last_keyframe:2448
+		scanner := bufio.NewScanner(stderr)
+		scanner.Split(bufio.ScanWords)
+		for scanner.Scan() {
+			m := scanner.Text()
+			if strings.HasPrefix(m, "t:") {
+				if s, err := strconv.ParseFloat(m[2:], 64); err == nil {
+					found = true
+					seconds = s
+					cancel() // no need to look at the rest of the video.
+					return
+				}
 			}
 		}
+	})
+	if found {
+		return time.ParseDuration(fmt.Sprintf("%fs", seconds))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot find frame: %w", err)
 	}
 	return 0, fmt.Errorf("cannot find frame")
 }
 
+func searchFrameCommand(videoFile, frameImage string) *FFmpegCommand {
+	// ffmpeg -loglevel info -i video.mkv -loop 1 -i frameImage.jpg -an -filter_complex "blend=difference:shortest=1,blackframe=98:32" -f null -
+	return NewFFmpegCommand().
+		Globals("-loglevel", "info").
+		Input(videoFile).
+		Input(frameImage, "-loop", "1").
+		FilterComplex("blend=difference:shortest=1,blackframe=98:32").
+		Options("-an", "-f", "null", "-progress", "-").
+		Output("-")
+}
+
+// sexagesimal formats d the way ffprobe -sexagesimal does, like 0:23:40.046000.
+func sexagesimal(d time.Duration) string {
+	micros := d.Microseconds()
+	return fmt.Sprintf("%d:%02d:%02d.%06d", micros/3600e6, micros/60e6%60, micros/1e6%60, micros%1e6)
+}
+
 func formatDuration(d time.Duration) string {
 	t := time.Unix(0, 0).UTC()
 	return t.Add(d).Format("15:04:05.000")
 }
 
 // returns the full name of the videoFile with the fragment cut out.
-func cutFromVideo2(ts_start, ts_end time.Duration, filename string) (string, error) {
-	baseFilename := path.Base(filename)
-	extension := path.Ext(filename)
-	noIntroFile := strings.ReplaceAll(filename, extension, "_NOINTRO"+extension)
-	firstPart := strings.ReplaceAll(filename, baseFilename, "first_"+baseFilename)
-	lastPart := strings.ReplaceAll(filename, baseFilename, "last_"+path.Base(filename))
+func cutFromVideo2(ts_start, ts_end time.Duration, filename string, encode outputEncoding, progress ProgressReporter) (string, error) {
 	videoProps := GetVideoPropertiesWithFFProbe(filename)
 	start := formatDuration(ts_start)
 	end := formatDuration(ts_end)
-	// first make the pre-fragment video
-	// TODO: we need to put the config params for the video encoding also in here.
-	// -ar 48000 -ac 2
 	fmt.Println("start", start, "end", end)
-	if start != "00:00:00.000" {
-		firstArgs := fmt.Sprintf("-y -i %s -ss 00:00:00 -to %s -c:v libx264 -c:a aac %s", filename, start, firstPart)
-		lastArgs := fmt.Sprintf("-y -i %s -ss %s -to %s -c:v libx264 -c:a aac %s", filename, end, videoProps.Duration, lastPart)
-		concatInput := fmt.Sprintf("file '%s'\nfile '%s'", firstPart, lastPart)
-		os.WriteFile("concat.txt", []byte(concatInput), 0o644)
-		// defer os.RemoveAll("concat.txt")
-		concatArgs := fmt.Sprintf("-y -f concat -safe 0 -i concat.txt -c:v libx264 -c:a aac -ar 48000 -ac 2 %s", noIntroFile)
-		fmt.Println("ffmpeg", firstArgs, "\nffmpeg", lastArgs, "\nffmpeg", concatArgs)
-		fmt.Println("Cutting first part...")
-		if err := RunAndParseFfmpeg(firstArgs, videoProps); err != nil {
-			fmt.Println(err)
-			return "", err
+	cut := planCut(start, end, sexagesimal(videoProps.Duration), filename, encode)
+	if cut.concatFile != "" {
+		if err := os.WriteFile(cut.concatFile, []byte(cut.concatInput), 0o644); err != nil {
+			return "", fmt.Errorf("cannot write the concat file: %w", err)
 		}
-		fmt.Println("Cutting second part...")
-		if err := RunAndParseFfmpeg(lastArgs, videoProps); err != nil {
-			fmt.Println(err)
-			return "", err
-		}
-		fmt.Println("Concatenating the two pieces...")
-		if err := RunAndParseFfmpeg(concatArgs, videoProps); err != nil {
-			fmt.Println(err)
-			return "", err
+		defer os.RemoveAll(cut.concatFile)
+		fmt.Println(cut.commands[0], "\n"+cut.commands[1].String(), "\n"+cut.commands[2].String())
+	}
+	steps := []string{"Cutting first part...", "Cutting second part...", "Concatenating the two pieces..."}
+	for i, cmd := range cut.commands {
+		if len(cut.commands) > 1 {
+			fmt.Println(steps[i])
 		}
-		os.RemoveAll(firstPart)
-		os.RemoveAll(lastPart)
-	} else {
-		lastArgs := fmt.Sprintf("-y -i %s -ss %s -to %s -c:v libx264 -c:a aac %s", filename, end, videoProps.Duration, noIntroFile)
-
-		if err := RunAndParseFfmpeg(lastArgs, videoProps); err != nil {
+		if err := runFfmpeg(cmd.Args(), videoProps, progress); err != nil {
 			fmt.Println(err)
 			return "", err
 		}
 	}
-	return noIntroFile, nil
+	for _, part := range cut.parts {
+		os.RemoveAll(part)
+	}
+	return cut.noIntroFile, nil
+}
 
+// cutPlan is how a fragment gets cut out of a video: the commands to run in order,
+// the pieces they make along the way and the resulting file.
+type cutPlan struct {
+	commands    []*FFmpegCommand
+	parts       []string
+	concatFile  string
+	concatInput string
+	noIntroFile string
 }
 
-func CutFragmentFromVideo(config Config) (string, error) {
-	return cutFragmentFromVideo(config.arguments.File, config.arguments.CutStart, config.arguments.CutEnd)
+// planCut makes the commands cutting the fragment between the timestamps start and end out of filename,
+// encoding it the way encode does.
+func planCut(start, end, duration, filename string, encode outputEncoding) cutPlan {
+	baseFilename := path.Base(filename)
+	extension := path.Ext(filename)
+	cut := cutPlan{noIntroFile: strings.ReplaceAll(filename, extension, "_NOINTRO"+extension)}
+	if start == "00:00:00.000" {
+		lastCmd := encode(NewFFmpegCommand().Globals("-y").Input(filename).
+			Options("-ss", end, "-to", duration)).
+			Output(cut.noIntroFile)
+		cut.commands = []*FFmpegCommand{lastCmd}
+		return cut
+	}
+	// first make the pre-fragment video
+	firstPart := strings.ReplaceAll(filename, baseFilename, "first_"+baseFilename)
+	lastPart := strings.ReplaceAll(filename, baseFilename, "last_"+baseFilename)
+	firstCmd := encode(NewFFmpegCommand().Globals("-y").Input(filename).
+		Options("-ss", "00:00:00", "-to", start)).
+		Output(firstPart)
+	lastCmd := encode(NewFFmpegCommand().Globals("-y").Input(filename).
+		Options("-ss", end, "-to", duration)).
+		Output(lastPart)
+	cut.concatInput = concatFileLine(firstPart) + "\n" + concatFileLine(lastPart)
+	cut.concatFile = cut.noIntroFile + ".concat.txt"
+	concatCmd := encode(NewFFmpegCommand().Globals("-y").Input(cut.concatFile, "-f", "concat", "-safe", "0").
+		Options("-ar", "48000", "-ac", "2")).
+		Output(cut.noIntroFile)
+	cut.commands = []*FFmpegCommand{firstCmd, lastCmd, concatCmd}
+	cut.parts = []string{firstPart, lastPart}
+	return cut
 }
 
-func cutFragmentFromVideo(filename, beginframe, endframe string) (string, error) {
+func cutFragmentFromVideo(filename, beginframe, endframe string, encode outputEncoding, progress ProgressReporter) (string, error) {
 	// TODO: Search for the frames in the frame folder, matching on the name?
 	fmt.Println("Looking for start of fragment...")
 	start, err := SearchForFrame(filename, beginframe)
@@ -281,7 +265,7 @@ func cutFragmentFromVideo(filename, beginframe, endframe string) (string, error)
 		return "", err
 	}
 	fmt.Printf("Cutting out fragment between %v and %v\n", start, stop)
-	return cutFromVideo2(start, stop, filename)
+	return cutFromVideo2(start, stop, filename, encode, progress)
 }
 
 func DumpFrameFromVideoAt(videoFile, time string) (string, error) {
@@ -290,9 +274,9 @@ func DumpFrameFromVideoAt(videoFile, time string) (string, error) {
 	jpegname := strings.ReplaceAll(videoFile, path.Base(videoFile), "FRAME_"+timestr+"_"+strings.ReplaceAll(path.Base(videoFile), path.Ext(videoFile), ".png"))
 
 	fmt.Println(timestr, jpegname)
-	cmd := "-ss " + time + " -i " + videoFile + " -frames:v 1 " + jpegname
-	fmt.Println("ffmpeg", cmd)
-	err := RunAndParseFfmpeg(cmd, GetVideoPropertiesWithFFProbe(videoFile))
+	cmd := NewFFmpegCommand().Input(videoFile, "-ss", time).Options("-frames:v", "1").Output(jpegname)
+	fmt.Println(cmd)
+	err := RunAndParseFfmpeg(cmd.Args(), GetVideoPropertiesWithFFProbe(videoFile))
 	return jpegname, err
 }
 
@@ -3,14 +3,19 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestGetFFprobeInfo(t *testing.T) {
+	useRecordedRunner(t, "testdata/testvideo2.json")
 	got, err := GetFFprobeInfo("testvideo2.mkv")
 	if err != nil {
 		fmt.Println(err)
 		t.Fatal(err)
 	}
+	if len(got.Streams) != 6 {
+		t.Errorf("GetFFprobeInfo() found %d streams, want 6", len(got.Streams))
+	}
 	for _, stream := range got.Streams {
 		fmt.Printf("Stream: %s\n", stream.CodecType)
 		lang, err := stream.GetLanguage()
@@ -22,3 +27,11 @@ func TestGetFFprobeInfo(t *testing.T) {
 	got.ShowSubtitles()
 	got.ShowChapters()
 }
+
+func TestGetVideoPropertiesWithFFProbe(t *testing.T) {
+	useRecordedRunner(t, "testdata/testvideo2.json")
+	want := VideoProperties{Filename: "testvideo2.mkv", Duration: 23*time.Minute + 40046*time.Millisecond}
+	if got := GetVideoPropertiesWithFFProbe("testvideo2.mkv"); got != want {
+		t.Errorf("GetVideoPropertiesWithFFProbe() = %v, want %v", got, want)
+	}
+}
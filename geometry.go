@@ -0,0 +1,253 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// Crop is the part of the picture that's left without the black bars.
+type Crop struct {
+	Width, Height, X, Y int
+}
+
+func (c Crop) String() string {
+	return fmt.Sprintf("%d:%d:%d:%d", c.Width, c.Height, c.X, c.Y)
+}
+
+// Geometry is how the video gets cropped, scaled, retimed and tonemapped before the subs get burned in,
+// so they get rendered at the size and in the colors of the output.
+type Geometry struct {
+	Width, Height int   // of the input, 0 when we don't know
+	Crop          *Crop // nil keeps the whole picture
+	OutWidth      int   // the size after cropping and scaling, 0 when we don't know
+	OutHeight     int
+	MaxWidth      int // the size the output has to fit in, 0 for any size
+	MaxHeight     int
+	Fps           string  // empty keeps the frame rate
+	Tonemap       string  // the algorithm turning HDR video into SDR, empty leaves the colors alone
+	HDR           *Colors // the colors of HDR video that stays HDR, nil when the output is SDR
+}
+
+// fpsValue is a frame rate the fps filter understands, like 24, 23.976 or 24000/1001.
+var fpsValue = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(/[0-9]+)?$`)
+
+// checkFps checks the fps setting.
+func checkFps(fps string) error {
+	if fps != "" && !fpsValue.MatchString(fps) {
+		return fmt.Errorf("invalid fps %q, use a frame rate like 24, 23.976 or 24000/1001", fps)
+	}
+	return nil
+}
+
+// fitSize scales width x height down to fit in maxWidth x maxHeight, keeping the aspect ratio.
+// A max of 0 doesn't limit that side. The sizes stay even, the encoders need that for yuv420p.
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	even := func(size int) int { return int(float64(size)*scale/2+0.5) * 2 }
+	if scale == 1 {
+		even = func(size int) int { return size &^ 1 }
+	}
+	return even(width), even(height)
+}
+
+// Filters are the video filters doing the cropping, scaling, retiming and tonemapping, in that order.
+func (g Geometry) Filters() []string {
+	var filters []string
+	if g.Crop != nil {
+		filters = append(filters, "crop="+g.Crop.String())
+	}
+	switch {
+	case g.OutWidth > 0 && g.croppedWidth() != g.OutWidth || g.OutHeight > 0 && g.croppedHeight() != g.OutHeight:
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", g.OutWidth, g.OutHeight))
+	case g.OutWidth == 0 && (g.MaxWidth > 0 || g.MaxHeight > 0):
+		// without the size of the input, ffmpeg has to work it out.
+		fit := func(size int, side string) string {
+			if size <= 0 {
+				return side
+			}
+			return fmt.Sprintf(`min(%s\,%d)`, side, size)
+		}
+		filters = append(filters, fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=decrease:force_divisible_by=2",
+			fit(g.MaxWidth, "iw"), fit(g.MaxHeight, "ih")))
+	}
+	if g.Fps != "" {
+		filters = append(filters, "fps="+g.Fps)
+	}
+	if g.Tonemap != "" {
+		filters = append(filters, tonemapFilters(g.Tonemap)...)
+	}
+	return filters
+}
+
+func (g Geometry) croppedWidth() int {
+	if g.Crop != nil {
+		return g.Crop.Width
+	}
+	return g.Width
+}
+
+func (g Geometry) croppedHeight() int {
+	if g.Crop != nil {
+		return g.Crop.Height
+	}
+	return g.Height
+}
+
+// scale is how much the picture gets scaled, 1 when we don't know.
+func (g Geometry) scale() float64 {
+	if g.OutWidth == 0 || g.croppedWidth() == 0 {
+		return 1
+	}
+	return float64(g.OutWidth) / float64(g.croppedWidth())
+}
+
+// geometry works out how the video gets cropped, scaled and retimed the first time a stage needs it.
+func (j *Job) geometry() (Geometry, error) {
+	if j.Geometry != nil {
+		return *j.Geometry, nil
+	}
+	g := Geometry{MaxWidth: j.Config.MaxWidth, MaxHeight: j.Config.MaxHeight, Fps: j.Config.Fps}
+	if err := checkFps(g.Fps); err != nil {
+		return g, err
+	}
+	info, err := j.mediaInfo()
+	if err != nil {
+		return g, err
+	}
+	video, ok := j.videoTrack(info)
+	if ok {
+		g.Width, g.Height = video.Width, video.Height
+	}
+	if j.Config.AutoCrop {
+		crop, err := j.detectCrop(info.Duration)
+		if err != nil {
+			return g, err
+		}
+		if crop != nil && (crop.Width != g.Width || crop.Height != g.Height) {
+			log.Printf("Cropping %s to %dx%d.\n", j.Input, crop.Width, crop.Height)
+			g.Crop = crop
+		}
+	}
+	if g.croppedWidth() > 0 && g.croppedHeight() > 0 {
+		g.OutWidth, g.OutHeight = fitSize(g.croppedWidth(), g.croppedHeight(), g.MaxWidth, g.MaxHeight)
+	}
+	if err := j.handleHDR(&g, info); err != nil {
+		return g, err
+	}
+	j.Geometry = &g
+	return g, nil
+}
+
+// videoTrack is the selected video track, or the first one before the tracks are selected.
+func (j *Job) videoTrack(info *media.MediaInfo) (media.Track, bool) {
+	if j.Tracks != nil {
+		return info.Track(j.Tracks.VideoTrack)
+	}
+	videos := info.TracksOfType(media.Video)
+	if len(videos) == 0 {
+		return media.Track{}, false
+	}
+	return videos[0], true
+}
+
+// how long cropdetect looks at each sample.
+const cropSampleLength = 10 * time.Second
+
+// detectCrop runs cropdetect on samples spread over the video, and keeps everything that's
+// picture in any of them, so a dark scene doesn't cut off the rest. It's nil when cropdetect found nothing.
+func (j *Job) detectCrop(duration time.Duration) (*Crop, error) {
+	video := "0:v:0"
+	if j.Tracks != nil {
+		video = j.mapTrack(j.Tracks.VideoTrack)
+	}
+	var found *Crop
+	for _, start := range sampleTimes(duration) {
+		crop, err := cropdetect(cropCommand(j.Input, video, start))
+		if err != nil {
+			return nil, fmt.Errorf("cannot detect the black bars of %s: %w", j.Input, err)
+		}
+		if crop != nil {
+			found = found.union(*crop)
+		}
+	}
+	return found, nil
+}
+
+// cropCommand runs cropdetect on cropSampleLength of the video from start.
+func cropCommand(input, video string, start time.Duration) *FFmpegCommand {
+	return NewFFmpegCommand().
+		Globals("-hide_banner", "-nostats").
+		Input(input, "-ss", formatDuration(start), "-t", formatDuration(cropSampleLength)).
+		Map(video).
+		VideoFilter("cropdetect").
+		Options("-an", "-sn", "-f", "null").
+		Output("-")
+}
+
+// cropdetect runs the command and gives the last crop cropdetect logged.
+func cropdetect(cmd *FFmpegCommand) (*Crop, error) {
+	Log(cmd)
+	var found *Crop
+	err := streamTool(context.Background(), "ffmpeg", cmd.Args(), func(stderr io.Reader) {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if crop, ok := parseCrop(scanner.Text()); ok {
+				found = &crop
+			}
+		}
+	})
+	return found, err
+}
+
+var cropLine = regexp.MustCompile(`crop=(\d+):(\d+):(\d+):(\d+)`)
+
+// parseCrop reads the crop from a line cropdetect logs:
+//
+//	[Parsed_cropdetect_0 @ 0x55d4] x1:0 x2:1919 y1:140 y2:939 w:1920 h:800 x:0 y:140 pts:12012 t:12.012000 limit:0.094118 crop=1920:800:0:140
+func parseCrop(line string) (Crop, bool) {
+	var crop Crop
+	m := cropLine.FindStringSubmatch(line)
+	if m == nil {
+		return crop, false
+	}
+	fmt.Sscanf(m[0], "crop=%d:%d:%d:%d", &crop.Width, &crop.Height, &crop.X, &crop.Y)
+	return crop, crop.Width > 0 && crop.Height > 0
+}
+
+// union is the smallest crop that keeps both crops, c can be nil.
+func (c *Crop) union(other Crop) *Crop {
+	if c == nil {
+		return &other
+	}
+	x, y := min(c.X, other.X), min(c.Y, other.Y)
+	right, bottom := max(c.X+c.Width, other.X+other.Width), max(c.Y+c.Height, other.Y+other.Height)
+	return &Crop{Width: right - x, Height: bottom - y, X: x, Y: y}
+}
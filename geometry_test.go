@@ -0,0 +1,156 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gertm/hardsub/media"
+)
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		name                string
+		width, height       int
+		maxWidth, maxHeight int
+		wantW, wantH        int
+	}{
+		{"no max", 1920, 1080, 0, 0, 1920, 1080},
+		{"max width", 1920, 1080, 1280, 0, 1280, 720},
+		{"max height", 1920, 1080, 0, 480, 854, 480},
+		{"height limits more", 1920, 800, 1280, 480, 1152, 480},
+		{"already small", 640, 480, 1280, 720, 640, 480},
+		{"stays even", 1920, 800, 1280, 0, 1280, 534},
+		{"odd input", 721, 481, 0, 0, 720, 480},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w, h := fitSize(tt.width, tt.height, tt.maxWidth, tt.maxHeight); w != tt.wantW || h != tt.wantH {
+				t.Errorf("fitSize() = %dx%d, want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestGeometryFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry Geometry
+		want     []string
+	}{
+		{"nothing", Geometry{Width: 1920, Height: 1080, OutWidth: 1920, OutHeight: 1080}, nil},
+		{"scale", Geometry{Width: 1920, Height: 1080, OutWidth: 1280, OutHeight: 720, MaxWidth: 1280}, []string{"scale=1280:720"}},
+		{"crop", Geometry{Width: 1920, Height: 1080, Crop: &Crop{1920, 800, 0, 140}, OutWidth: 1920, OutHeight: 800}, []string{"crop=1920:800:0:140"}},
+		{"everything", Geometry{Width: 1920, Height: 1080, Crop: &Crop{1920, 800, 0, 140}, OutWidth: 1280, OutHeight: 534, MaxWidth: 1280, Fps: "24000/1001"},
+			[]string{"crop=1920:800:0:140", "scale=1280:534", "fps=24000/1001"}},
+		{"unknown size", Geometry{MaxHeight: 720}, []string{`scale=iw:min(ih\,720):force_original_aspect_ratio=decrease:force_divisible_by=2`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.geometry.Filters(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Filters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFps(t *testing.T) {
+	for _, fps := range []string{"", "24", "23.976", "24000/1001"} {
+		if err := checkFps(fps); err != nil {
+			t.Errorf("checkFps(%q) = %v", fps, err)
+		}
+	}
+	for _, fps := range []string{"fast", "24fps", "-1", "1/2/3"} {
+		if err := checkFps(fps); err == nil {
+			t.Errorf("checkFps(%q) accepts it", fps)
+		}
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	line := "[Parsed_cropdetect_0 @ 0x55d4] x1:0 x2:1919 y1:140 y2:939 w:1920 h:800 x:0 y:140 pts:12012 t:12.012000 limit:0.094118 crop=1920:800:0:140"
+	if crop, ok := parseCrop(line); !ok || crop != (Crop{1920, 800, 0, 140}) {
+		t.Errorf("parseCrop() = %v, %v", crop, ok)
+	}
+	if _, ok := parseCrop("frame=  240 fps=120 q=-0.0 size=N/A"); ok {
+		t.Error("parseCrop() found a crop in a progress line")
+	}
+	// a dark scene crops more, the union keeps the picture of both.
+	var crop *Crop
+	crop = crop.union(Crop{1920, 800, 0, 140})
+	crop = crop.union(Crop{1600, 600, 160, 240})
+	crop = crop.union(Crop{1920, 816, 0, 132})
+	if *crop != (Crop{1920, 816, 0, 132}) {
+		t.Errorf("union() = %v", *crop)
+	}
+}
+
+func TestEncodeCommandGeometry(t *testing.T) {
+	job := NewJob("show_01.mkv", Config{})
+	job.Media, job.Probe = &media.MediaInfo{}, &media.VideoProbeInfo{}
+	job.Tracks = &SelectedTracks{VideoTrack: 0, AudioTrack: 1, SubsTrack: 2}
+	job.SubsFile = "show_01.ass"
+	geometry := Geometry{Width: 1920, Height: 1080, OutWidth: 1280, OutHeight: 720, MaxWidth: 1280, Fps: "24"}
+	encoder, _ := softwareEncoder("h264")
+	cmd := encodeCommand(job, Profile{Container: "mp4", Video: "h264", Audio: "aac"}, encoder, RateControl{Mode: rateCrf}, geometry, []AudioOutput{{Map: "0:1"}}, "")
+	// the subs get rendered at the output size.
+	if want := "-vf scale=1280:720,fps=24,subtitles=show_01.ass"; !strings.Contains(cmd.String(), want) {
+		t.Errorf("encodeCommand() = %s, want %s", cmd, want)
+	}
+}
+
+func TestAutoCropPicturePlan(t *testing.T) {
+	dir := t.TempDir()
+	video := path.Join(dir, "movie.mp4")
+	useFakeRunner(t,
+		FakeResponse{
+			Name: "ffprobe",
+			Args: append(ffprobe_args, video),
+			Stdout: `{"streams": [
+			{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080},
+			{"index": 1, "codec_name": "aac", "codec_type": "audio", "channels": 2, "tags": {"language": "jpn"}},
+			{"index": 2, "codec_name": "hdmv_pgs_subtitle", "codec_type": "subtitle", "width": 1920, "height": 1080, "tags": {"language": "eng"}}],
+			"format": {"filename": "` + video + `", "duration": "6000.000000"}}`,
+		},
+		FakeResponse{
+			Name:   "ffmpeg",
+			Stderr: "[Parsed_cropdetect_0 @ 0x55d4] x1:0 x2:1919 y1:140 y2:939 w:1920 h:800 x:0 y:140 pts:12012 t:12.012000 crop=1920:800:0:140\n",
+		},
+	)
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = path.Join(dir, "converted")
+	cfg.Stages = "selecttracks,extractsubs,encode"
+	cfg.AutoCrop = true
+	cfg.MaxWidth = 1280
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, DryRun: true}
+	pipeline, err := PipelineFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob(video, cfg)
+	job.Plan = &Plan{Input: video}
+	if err := pipeline.Run(job); err != nil {
+		t.Fatal(err)
+	}
+	// the subs cover the whole picture, so they go up with the crop.
+	want := "'[0:0]crop=1920:800:0:140,scale=1280:534[video];[0:s:0]scale=1280:720[subs];[video][subs]overlay=x=0:y=-93[v]'"
+	if encode := job.Plan.Commands[len(job.Plan.Commands)-1]; !strings.Contains(encode, want) {
+		t.Errorf("encode command doesn't contain %s: %s", want, encode)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// the values of the 'hdr' setting.
+const (
+	hdrTonemap = "tonemap" // turn HDR video into SDR before burning in the subs
+	hdrKeep    = "keep"    // keep HDR video HDR when the profile makes 10-bit hevc, tonemap otherwise
+)
+
+// the algorithms of ffmpeg's tonemap filter.
+var tonemapAlgorithms = []string{"hable", "mobius", "reinhard", "clip", "linear", "gamma"}
+
+// checkHDR checks the hdr and tonemap settings, empty ones tonemap with hable.
+func checkHDR(config Config) error {
+	if config.HDR != "" && config.HDR != hdrTonemap && config.HDR != hdrKeep {
+		return fmt.Errorf("unknown hdr setting %q, use %s or %s", config.HDR, hdrTonemap, hdrKeep)
+	}
+	if config.Tonemap != "" && !slices.Contains(tonemapAlgorithms, config.Tonemap) {
+		return fmt.Errorf("unknown tonemap algorithm %q, use one of %s", config.Tonemap, strings.Join(tonemapAlgorithms, ", "))
+	}
+	return nil
+}
+
+// Colors are the color tags of a video, ffmpeg needs them to tag the output the same.
+type Colors struct {
+	Primaries, Transfer, Space string
+	MasterDisplay              string // the mastering display of HDR10 video the way x265 wants it, empty when we don't know it
+	MaxCLL                     string // the content light levels of HDR10 video, as x265's max-cll
+}
+
+// tonemapFilters turn HDR video into bt709 SDR with the algorithm. zscale goes to linear light,
+// where tonemap does its work, and back.
+func tonemapFilters(algorithm string) []string {
+	return []string{
+		"zscale=t=linear:npl=100",
+		"format=gbrpf32le",
+		"zscale=p=bt709",
+		"tonemap=tonemap=" + algorithm + ":desat=0",
+		"zscale=t=bt709:m=bt709:r=tv",
+		"format=yuv420p",
+	}
+}
+
+// keepsHDR tells if the encoder can make 10-bit hevc, and how it needs the frames for that.
+func keepsHDR(encoder Encoder) ([]string, bool) {
+	switch encoder.Name {
+	case "x265":
+		return []string{"-pix_fmt", "yuv420p10le"}, true
+	case "hevc_nvenc":
+		return []string{"-profile:v", "main10", "-pix_fmt", "p010le"}, true
+	}
+	return nil, false
+}
+
+// hdrOptions tag the output with the colors of the HDR input, and make the encoder keep 10 bits.
+// They're empty when the video doesn't stay HDR.
+func (g Geometry) hdrOptions(encoder Encoder) []string {
+	if g.HDR == nil {
+		return nil
+	}
+	opts, _ := keepsHDR(encoder)
+	return append(opts, "-color_primaries", g.HDR.Primaries, "-color_trc", g.HDR.Transfer, "-colorspace", g.HDR.Space)
+}
+
+// hdr10Params make x265 write the HDR10 static metadata of the input into the output.
+// hevc_nvenc can't, the output gets only the color tags.
+func (g Geometry) hdr10Params(encoder Encoder) string {
+	if g.HDR == nil || encoder.Name != "x265" {
+		return ""
+	}
+	var params []string
+	if g.HDR.MasterDisplay != "" {
+		params = append(params, "master-display="+g.HDR.MasterDisplay)
+	}
+	if g.HDR.MaxCLL != "" {
+		params = append(params, "max-cll="+g.HDR.MaxCLL)
+	}
+	return strings.Join(params, ":")
+}
+
+// hdr10Metadata gives the mastering display and content light levels of the stream, the way x265 wants them:
+// G(x,y)B(x,y)R(x,y)WP(x,y)L(max,min) in units of 0.00002 and 0.0001 cd/m², and MaxCLL,MaxFALL.
+// They're empty when ffprobe didn't find them.
+func hdr10Metadata(stream media.Stream) (masterDisplay, maxCLL string) {
+	if display, ok := stream.SideData(media.MasteringDisplayMetadata); ok {
+		var values []int
+		for _, v := range []struct {
+			rational string
+			unit     int
+		}{
+			{display.GreenX, 50000}, {display.GreenY, 50000}, {display.BlueX, 50000}, {display.BlueY, 50000},
+			{display.RedX, 50000}, {display.RedY, 50000}, {display.WhitePointX, 50000}, {display.WhitePointY, 50000},
+			{display.MaxLuminance, 10000}, {display.MinLuminance, 10000},
+		} {
+			value, ok := inUnits(v.rational, v.unit)
+			if !ok {
+				values = nil
+				break
+			}
+			values = append(values, value)
+		}
+		if values != nil {
+			masterDisplay = fmt.Sprintf("G(%d,%d)B(%d,%d)R(%d,%d)WP(%d,%d)L(%d,%d)",
+				values[0], values[1], values[2], values[3], values[4], values[5], values[6], values[7], values[8], values[9])
+		}
+	}
+	if light, ok := stream.SideData(media.ContentLightLevelMetadata); ok {
+		maxCLL = fmt.Sprintf("%d,%d", light.MaxContent, light.MaxAverage)
+	}
+	return masterDisplay, maxCLL
+}
+
+// inUnits turns a rational like 34000/50000 into a whole number of 1/unit.
+func inUnits(rational string, unit int) (int, bool) {
+	var num, den int
+	if n, _ := fmt.Sscanf(rational, "%d/%d", &num, &den); n != 2 || den <= 0 {
+		return 0, false
+	}
+	return int(math.Round(float64(num) * float64(unit) / float64(den))), true
+}
+
+// videoStream is what ffprobe knows about the video track of the job.
+func (j *Job) videoStream(info *media.MediaInfo) (media.Stream, bool) {
+	video, ok := j.videoTrack(info)
+	if !ok {
+		return media.Stream{}, false
+	}
+	probe, err := j.probeInfo()
+	if err != nil {
+		return media.Stream{}, false
+	}
+	index, ok := media.NewTrackMap(*info, *probe).StreamIndex(video.ID)
+	if !ok {
+		return media.Stream{}, false
+	}
+	return probe.Stream(index)
+}
+
+// handleHDR makes the geometry tonemap HDR video, or keep it HDR when the settings want that
+// and the encoder can.
+func (j *Job) handleHDR(g *Geometry, info *media.MediaInfo) error {
+	stream, ok := j.videoStream(info)
+	if !ok || !stream.IsHDR() {
+		return nil
+	}
+	if j.Config.HDR == hdrKeep {
+		encoder, err := j.encoder()
+		if err != nil {
+			return err
+		}
+		if _, ok := keepsHDR(encoder); ok {
+			log.Printf("Keeping %s HDR (%s).\n", j.Input, stream.ColorTransfer)
+			g.HDR = &Colors{Primaries: orDefault(stream.ColorPrimaries, "bt2020"), Transfer: stream.ColorTransfer, Space: orDefault(stream.ColorSpace, "bt2020nc")}
+			g.HDR.MasterDisplay, g.HDR.MaxCLL = hdr10Metadata(stream)
+			if g.hdr10Params(encoder) == "" && (g.HDR.MasterDisplay != "" || g.HDR.MaxCLL != "") {
+				log.Printf("The %s encoder drops the mastering display and light levels of %s.\n", encoder.Name, j.Input)
+			}
+			return nil
+		}
+		log.Printf("The %s encoder can't keep %s HDR, tonemapping it.\n", encoder.Name, j.Input)
+	}
+	g.Tonemap = orDefault(j.Config.Tonemap, tonemapAlgorithms[0])
+	Log("Tonemapping", j.Input, "from", stream.ColorTransfer, "with", g.Tonemap)
+	return nil
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
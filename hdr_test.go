@@ -0,0 +1,136 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gertm/hardsub/media"
+)
+
+func TestCheckHDR(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"defaults", Config{}, false},
+		{"keep", Config{HDR: hdrKeep, Tonemap: "mobius"}, false},
+		{"unknown hdr", Config{HDR: "dolbyvision"}, true},
+		{"unknown algorithm", Config{HDR: hdrTonemap, Tonemap: "aces"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkHDR(tt.config); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkHDR() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// the HDR10 static metadata of a movie mastered on a P3 display, the way ffprobe shows it.
+const hdr10SideData = `{"side_data_type": "Mastering display metadata",
+	"red_x": "34000/50000", "red_y": "16000/50000", "green_x": "13250/50000", "green_y": "34500/50000",
+	"blue_x": "7500/50000", "blue_y": "3000/50000", "white_point_x": "15635/50000", "white_point_y": "16450/50000",
+	"min_luminance": "50/10000", "max_luminance": "10000000/10000"},
+	{"side_data_type": "Content light level metadata", "max_content": 1000, "max_average": 400}`
+
+// hdrPlan plans the encode of an HDR10 mp4 with picture subs.
+func hdrPlan(t *testing.T, tweak func(cfg *Config)) string {
+	t.Helper()
+	dir := t.TempDir()
+	video := path.Join(dir, "movie.mp4")
+	useFakeRunner(t, FakeResponse{
+		Name: "ffprobe",
+		Args: append(ffprobe_args, video),
+		Stdout: `{"streams": [
+			{"index": 0, "codec_name": "hevc", "codec_type": "video", "width": 3840, "height": 2160, "pix_fmt": "yuv420p10le",
+			 "color_space": "bt2020nc", "color_transfer": "smpte2084", "color_primaries": "bt2020", "side_data_list": [` + hdr10SideData + `]},
+			{"index": 1, "codec_name": "aac", "codec_type": "audio", "channels": 2, "tags": {"language": "eng"}},
+			{"index": 2, "codec_name": "hdmv_pgs_subtitle", "codec_type": "subtitle", "width": 3840, "height": 2160, "tags": {"language": "eng"}}],
+			"format": {"filename": "` + video + `", "duration": "60.000000"}}`,
+	})
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = path.Join(dir, "converted")
+	cfg.Stages = "selecttracks,extractsubs,encode"
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, DryRun: true}
+	tweak(&cfg)
+	pipeline, err := PipelineFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob(video, cfg)
+	job.Plan = &Plan{Input: video}
+	if err := pipeline.Run(job); err != nil {
+		t.Fatal(err)
+	}
+	return job.Plan.Commands[len(job.Plan.Commands)-1]
+}
+
+func TestHDRPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		tweak    func(cfg *Config)
+		want     []string
+		dontWant []string
+	}{
+		{"tonemap", func(cfg *Config) { cfg.Tonemap = "mobius" }, []string{
+			"'[0:0]zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=mobius:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p[video];[video][0:s:0]overlay[v]'",
+		}, []string{"-color_trc"}},
+		{"keep", func(cfg *Config) { cfg.HDR, cfg.Profile = hdrKeep, "mkv-hevc" }, []string{
+			"'[0:0][0:s:0]overlay=format=yuv420p10[v]'",
+			"-c:v libx265",
+			"-pix_fmt yuv420p10le -color_primaries bt2020 -color_trc smpte2084 -colorspace bt2020nc",
+			"master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50):max-cll=1000,400",
+		}, []string{"tonemap"}},
+		{"keep without hevc", func(cfg *Config) { cfg.HDR, cfg.Profile = hdrKeep, "mp4-h264" }, []string{
+			"tonemap=tonemap=hable",
+		}, []string{"-color_trc", "yuv420p10"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encode := hdrPlan(t, tt.tweak)
+			for _, want := range tt.want {
+				if !strings.Contains(encode, want) {
+					t.Errorf("encode command doesn't contain %s: %s", want, encode)
+				}
+			}
+			for _, dontWant := range tt.dontWant {
+				if strings.Contains(encode, dontWant) {
+					t.Errorf("encode command contains %s: %s", dontWant, encode)
+				}
+			}
+		})
+	}
+}
+
+func TestHDR10Metadata(t *testing.T) {
+	var stream media.Stream
+	if err := json.Unmarshal([]byte(`{"codec_type": "video", "side_data_list": [`+hdr10SideData+`]}`), &stream); err != nil {
+		t.Fatal(err)
+	}
+	display, light := hdr10Metadata(stream)
+	if want := "G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50)"; display != want {
+		t.Errorf("master-display = %s, want %s", display, want)
+	}
+	if light != "1000,400" {
+		t.Errorf("max-cll = %s, want 1000,400", light)
+	}
+	if display, light := hdr10Metadata(media.Stream{CodecType: "video"}); display != "" || light != "" {
+		t.Errorf("hdr10Metadata() without side data = %q, %q", display, light)
+	}
+}
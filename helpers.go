@@ -23,10 +23,9 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
 	"strings"
 
-	"github.com/buger/jsonparser"
+	"github.com/gertm/hardsub/media"
 	"github.com/sanity-io/litter"
 )
 
@@ -77,15 +76,16 @@ func DetoxFilename(filename string, remove ...string) string {
 	return path.Join(path.Dir(filename), sb.String())
 }
 
-func DetoxMkvsInDirectory(dirname string, remove ...string) error {
+// DetoxVideosInDirectory detoxes the names of the videos with one of the extensions in dirname,
+// and of the subtitle files next to them so they keep matching.
+func DetoxVideosInDirectory(dirname string, extensions []string, remove ...string) error {
 	toxic, err := os.ReadDir(dirname)
 	if err != nil {
-		LogErrorln("cannot read the filenames in directory", dirname, err)
-		os.Exit(1)
+		return fmt.Errorf("cannot read the filenames in directory %s: %w", dirname, err)
 	}
 	for _, f := range toxic {
 		fullname := path.Join(dirname, f.Name())
-		if strings.ToLower(path.Ext(fullname)) == ".mkv" {
+		if hasExtension(fullname, extensions) || hasExtension(fullname, sidecarExtensions) {
 			dt := DetoxFilename(fullname, remove...)
 			if f.Name() != dt {
 				err := os.Rename(fullname, dt)
@@ -98,6 +98,29 @@ func DetoxMkvsInDirectory(dirname string, remove ...string) error {
 	return nil
 }
 
+// videoExtensions are the extensions in the 'extension' setting, without the dots.
+func videoExtensions(setting string) []string {
+	var extensions []string
+	for _, ext := range splitList(setting) {
+		extensions = append(extensions, strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	return extensions
+}
+
+// hasExtension tells if filename has one of the extensions, ignoring case. No extensions means any will do.
+func hasExtension(filename string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+	return ext != "" && containsString(extensions, ext)
+}
+
+// isMatroska tells if mkvmerge can tell us about videofile, or if we need to ask ffprobe.
+func isMatroska(videofile string) bool {
+	return hasExtension(videofile, []string{"mkv", "mk3d", "mka", "webm"})
+}
+
 func RunBashCommand(cmd string) error {
 	c := exec.Command("bash", "-c", cmd)
 	c.Stdout = os.Stdout
@@ -131,22 +154,20 @@ func createDirectoryIfNeeded(dirName string) error {
 	return errors.New("shouldn't really get here")
 }
 
-func copyFontsToLocalFontsDir(sourcedir string) error {
-	files, err := os.ReadDir(sourcedir)
-	if err != nil {
-		LogErrorln("Cannot read the directory we just created?!", err, files)
-	}
+func copyFontsToLocalFontsDir(sourcedir string, fonts []media.Attachment) error {
 	userHome, err := os.UserHomeDir()
 	if err != nil {
 		LogErrorln("Cannot get our home directory!", err)
 	}
 	dotFonts := path.Join(userHome, ".fonts")
-	for _, file := range files {
-		if strings.Index(strings.ToLower(file.Name()), ".ttf") > 0 ||
-			strings.Index(strings.ToLower(file.Name()), ".otf") > 0 {
-			logV("Fonts: Copying %s to %s\n", file.Name(), dotFonts)
-			copyFile(path.Join(sourcedir, file.Name()), path.Join(dotFonts, file.Name()))
+	for _, font := range fonts {
+		name := path.Base(font.FileName)
+		if !FileExists(path.Join(sourcedir, name)) {
+			LogErrorln("ffmpeg didn't dump the font", name)
+			continue
 		}
+		logV("Fonts: Copying %s to %s\n", name, dotFonts)
+		copyFile(path.Join(sourcedir, name), path.Join(dotFonts, name))
 	}
 	return nil
 }
@@ -174,10 +195,17 @@ func copyFile(src, dst string) {
 }
 
 func refreshFonts() {
-	exec.Command("fc-cache", "-f", "-v").Wait()
+	if _, err := toolOutput("fc-cache", "-f", "-v"); err != nil {
+		Log("refreshing the font cache failed:", err)
+	}
 }
 
-func extractFonts(workingdir, videofile string) error {
+// extractFonts dumps the fonts attached to the video and installs them for libass.
+func extractFonts(workingdir, videofile string, fonts []media.Attachment) error {
+	if len(fonts) == 0 {
+		logV("Fonts: %s has no fonts attached\n", videofile)
+		return nil
+	}
 	attachmentsDirectory := path.Join(workingdir, "attachments")
 	err := os.MkdirAll(attachmentsDirectory, os.ModePerm)
 	if err != nil {
@@ -185,110 +213,57 @@ func extractFonts(workingdir, videofile string) error {
 		// the video conversion will work without the custom fonts, so we don't need to fail on this.
 		return nil
 	}
-	// ffmpeg -dump_attachment:t "" -i input.mkv
-	currentDir, _ := os.Getwd() // let's assume we can know where we are.
-	os.Chdir(attachmentsDirectory)
-	defer os.Chdir(currentDir)
-	exec.Command("ffmpeg", "-dump_attachment:t", "", "-i", videofile).Output()
+	// ffmpeg complains about the missing output file after dumping, so the error doesn't mean anything.
+	toolOutput("ffmpeg", dumpFontsArgs(attachmentsDirectory, videofile, fonts)...)
 	// copy all fonts to the ~/.fonts directory
-	if err := copyFontsToLocalFontsDir(attachmentsDirectory); err != nil {
+	if err := copyFontsToLocalFontsDir(attachmentsDirectory, fonts); err != nil {
 		return err
 	}
 	refreshFonts()
 	return nil
 }
 
-func GetConfigFilenameForVideo(path string) string {
-	return strings.Replace(path, filepath.Ext(path), ".hcConfig", 1)
+// dumpFontsArgs makes ffmpeg write each font to dir, picking it by its filename, so it doesn't write
+// them to the working directory, which all workers share.
+// ffmpeg -dump_attachment:m:filename:font.ttf dir/font.ttf -i input.mkv
+func dumpFontsArgs(dir, videofile string, fonts []media.Attachment) []string {
+	var args []string
+	for _, font := range fonts {
+		if strings.Contains(font.FileName, ":") {
+			// it would end the stream specifier.
+			LogErrorln("cannot dump the font", font.FileName, "with a colon in its name")
+			continue
+		}
+		args = append(args, "-dump_attachment:m:filename:"+font.FileName, path.Join(dir, path.Base(font.FileName)))
+	}
+	return append(args, "-i", videofile)
 }
 
-// , config Config, output *SelectedTracks
+// SelectTracksWithMkvMerge picks the tracks to use by scoring them with the rules in the config.
 func SelectTracksWithMkvMerge(path string, config Config) (*SelectedTracks, error) {
 	Log("Getting tracks with mkvmerge...", path)
-	output := SelectedTracks{
-		AudioTrack: -1,
-		VideoTrack: -1,
-		SubsTrack:  -1,
-	}
-	raw, err := exec.Command("mkvmerge", "-J", path).Output()
+	info, err := GetMkvMergeInfo(path)
 	if err != nil {
 		fmt.Println("Running mkvmerge failed")
 		return &SelectedTracks{}, err
 	}
-	var audioTracks []int
-	var subsTracks []int
-	jsonparser.ArrayEach(raw, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		trackType, _ := jsonparser.GetString(value, "type")
-		codec, _ := jsonparser.GetString(value, "codec")
-		codec_id, _ := jsonparser.GetString(value, "properties", "codec_id")
-		id, _ := jsonparser.GetInt(value, "id")
-		Log(id, trackType, codec, codec_id)
-		switch trackType {
-		case "video":
-			if output.VideoTrack == -1 {
-				output.VideoTrack = int(id)
-			}
-		case "audio":
-			lang, _ := jsonparser.GetString(value, "properties", "language_ietf")
-			audioTracks = append(audioTracks, int(id))
-			if lang == config.AudioLang && output.AudioTrack == -1 {
-				output.AudioTrack = int(id)
-			}
-		case "subtitles":
-			lang, _ := jsonparser.GetString(value, "properties", "language_ietf")
-			Log("Config subslang", config.SubsLang)
-			Log("Language", lang)
-			subsTracks = append(subsTracks, int(id))
-
-			if strings.HasPrefix(lang, config.SubsLang) && output.SubsTrack == -1 {
-				trackName, err := jsonparser.GetString(value, "properties", "track_name")
-				Log("Trackname", trackName)
-				if err == nil {
-					if !strings.Contains(strings.ToLower(trackName), "songs") {
-						output.SubsTrack = int(id)
-					} else {
-						fmt.Println(err)
-					}
-				} else {
-					Log("no name for the track found, so let's assume it's the right one for now")
-					output.SubsTrack = int(id)
-				}
-				switch codec_id {
-				case "S_TEXT/ASS", "S_TEXT/SSA", "SAA/ASS":
-					if config.Verbose {
-						fmt.Printf("%s has SSA subs\n", path)
-					}
-					output.SubtitleType = SSA_ASS
-				case "S_TEXT/UTF8":
-					if config.Verbose {
-						fmt.Printf("%s has SRT subtitles\n", path)
-					}
-					output.SubtitleType = SRT
-				case "S_HDMV/PGS", "S_IMAGE/BMP", "S_DVDSUB", "S_VOBSUB":
-					if config.Verbose {
-						fmt.Printf("%s has picture based subtitles\n", path)
-					}
-					output.SubtitleType = PICTURE
-				}
-			}
-		}
-	}, "tracks")
-	if output.AudioTrack == -1 && len(audioTracks) == 1 {
-		output.AudioTrack = audioTracks[0]
-	}
-	if output.SubsTrack == -1 && len(subsTracks) == 1 {
-		output.SubsTrack = subsTracks[0]
-	}
-	if config.arguments.ForceAudioTrack != -1 {
-		output.AudioTrack = config.arguments.ForceAudioTrack
+	return selectedTracks(info, config)
+}
+
+// selectedTracks picks the tracks to use out of the ones in info, explaining why when asked to.
+func selectedTracks(info *media.MediaInfo, config Config) (*SelectedTracks, error) {
+	selection, err := selectTracks(info, config)
+	if err != nil {
+		return &SelectedTracks{}, err
 	}
-	if config.arguments.ForceSubsTrack != -1 {
-		output.SubsTrack = config.arguments.ForceSubsTrack
+	if config.arguments.Explain {
+		fmt.Println(info.Filename)
+		selection.WriteExplanation(os.Stdout)
 	}
 	if config.Verbose {
-		litter.Dump(output)
+		litter.Dump(selection.Selected)
 	}
-	return &output, nil
+	return &selection.Selected, nil
 }
 
 func FindInPath(exe string) (string, error) {
@@ -16,8 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"os"
+	"path"
 	"reflect"
 	"testing"
+
+	"github.com/gertm/hardsub/media"
 )
 
 func Test_logV(t *testing.T) {
@@ -119,24 +123,24 @@ func TestDetoxFilename(t *testing.T) {
 	}
 }
 
-func TestDetoxMkvsInDirectory(t *testing.T) {
-	type args struct {
-		dirname string
-		remove  []string
+func TestDetoxVideosInDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"[Group] My Show - 01.mp4", "[Group] My Show - 01.en.srt", "Some notes.txt"} {
+		if err := os.WriteFile(path.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
 	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		// TODO: Add test cases.
+	if err := DetoxVideosInDirectory(dir, []string{"mkv", "mp4"}, "Group"); err != nil {
+		t.Fatal(err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := DetoxMkvsInDirectory(tt.args.dirname, tt.args.remove...); (err != nil) != tt.wantErr {
-				t.Errorf("DetoxMkvsInDirectory() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
+	var got []string
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	want := []string{"My_Show_-_01.en.srt", "My_Show_-_01.mp4", "Some notes.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("detoxed to %v, want %v", got, want)
 	}
 }
 
@@ -183,6 +187,7 @@ func Test_createDirectoryIfNeeded(t *testing.T) {
 func Test_copyFontsToLocalFontsDir(t *testing.T) {
 	type args struct {
 		sourcedir string
+		fonts     []media.Attachment
 	}
 	tests := []struct {
 		name    string
@@ -193,7 +198,7 @@ func Test_copyFontsToLocalFontsDir(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := copyFontsToLocalFontsDir(tt.args.sourcedir); (err != nil) != tt.wantErr {
+			if err := copyFontsToLocalFontsDir(tt.args.sourcedir, tt.args.fonts); (err != nil) != tt.wantErr {
 				t.Errorf("copyFontsToLocalFontsDir() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -235,40 +240,41 @@ func Test_extractFonts(t *testing.T) {
 	type args struct {
 		workingdir string
 		videofile  string
+		fonts      []media.Attachment
 	}
 	tests := []struct {
 		name    string
 		args    args
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{"no fonts attached", args{t.TempDir(), "nofonts.mkv", nil}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := extractFonts(tt.args.workingdir, tt.args.videofile); (err != nil) != tt.wantErr {
+			if err := extractFonts(tt.args.workingdir, tt.args.videofile, tt.args.fonts); (err != nil) != tt.wantErr {
 				t.Errorf("extractFonts() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func TestGetConfigFilenameForVideo(t *testing.T) {
-	type args struct {
-		path string
-	}
-	tests := []struct {
-		name string
-		args args
-		want string
-	}{
-		// TODO: Add test cases.
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := GetConfigFilenameForVideo(tt.args.path); got != tt.want {
-				t.Errorf("GetConfigFilenameForVideo() = %v, want %v", got, tt.want)
-			}
-		})
+func Test_extractFontsToWorkspace(t *testing.T) {
+	fake := useFakeRunner(t, FakeResponse{Name: "ffmpeg", Stderr: "At least one output file must be specified", ExitCode: 1})
+	t.Setenv("HOME", t.TempDir())
+	workingdir := t.TempDir()
+	fonts := []media.Attachment{{FileName: "Arial Bold.ttf"}, {FileName: "bad:name.otf"}, {FileName: "Gothic.otf"}}
+	if err := extractFonts(workingdir, "/in/show.mkv", fonts); err != nil {
+		t.Fatal(err)
+	}
+	// the fonts go to the workspace without changing the working directory, which the other workers use.
+	attachments := path.Join(workingdir, "attachments")
+	want := ToolInvocation{Name: "ffmpeg", Args: []string{
+		"-dump_attachment:m:filename:Arial Bold.ttf", path.Join(attachments, "Arial Bold.ttf"),
+		"-dump_attachment:m:filename:Gothic.otf", path.Join(attachments, "Gothic.otf"),
+		"-i", "/in/show.mkv",
+	}}
+	if calls := fake.Invocations(); len(calls) == 0 || !reflect.DeepEqual(calls[0], want) {
+		t.Errorf("extractFonts() ran %v, want %v", calls, want)
 	}
 }
 
@@ -277,16 +283,41 @@ func TestSelectTracksWithMkvMerge(t *testing.T) {
 		path   string
 		config Config
 	}
+	noForcing := Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1}
+	withArguments := func(args Arguments) Config {
+		c := DefaultConfig()
+		c.arguments = args
+		return c
+	}
 	tests := []struct {
 		name    string
 		args    args
 		want    *SelectedTracks
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			"skips the songs track",
+			args{"testvideo2.mkv", withArguments(noForcing)},
+			&SelectedTracks{VideoTrack: 0, AudioTrack: 1, SubsTrack: 4, SubtitleType: SSA_ASS},
+			false,
+		},
+		{
+			"forced tracks",
+			args{"testvideo2.mkv", withArguments(Arguments{ForceAudioTrack: 2, ForceSubsTrack: 3})},
+			&SelectedTracks{VideoTrack: 0, AudioTrack: 2, SubsTrack: 3, SubtitleType: SSA_ASS},
+			false,
+		},
+		{
+			"mkvmerge fails",
+			args{"broken.mkv", Config{arguments: noForcing}},
+			&SelectedTracks{},
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			fake := useRecordedRunner(t, "testdata/testvideo2.json")
+			fake.Responses = append(fake.Responses, FakeResponse{Name: "mkvmerge", Args: []string{"-J", "broken.mkv"}, ExitCode: 2})
 			got, err := SelectTracksWithMkvMerge(tt.args.path, tt.args.config)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("SelectTracksWithMkvMerge() error = %v, wantErr %v", err, tt.wantErr)
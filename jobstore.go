@@ -0,0 +1,304 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobQueued     JobState = "queued"
+	JobExtracting JobState = "extracting"
+	JobEncoding   JobState = "encoding"
+	JobCutting    JobState = "cutting"
+	JobFinishing  JobState = "finishing" // the output is complete, running postcmd and moving the original
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed"
+)
+
+// the state a job is in while running each stage.
+var stageStates = map[string]JobState{
+	"probe":        JobExtracting,
+	"selecttracks": JobExtracting,
+	"extractsubs":  JobExtracting,
+	"encode":       JobEncoding,
+	"speedup":      JobEncoding,
+	"cutintro":     JobCutting,
+	"postprocess":  JobFinishing,
+	"archive":      JobFinishing,
+}
+
+type JobRecord struct {
+	Input    string    `json:"input"`
+	State    JobState  `json:"state"`
+	Output   string    `json:"output,omitempty"`
+	Files    []string  `json:"files,omitempty"` // everything the job wrote, removed when it gets interrupted
+	Stage    string    `json:"stage,omitempty"` // the last stage that finished
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Command  string    `json:"command,omitempty"` // the tool that failed
+	ExitCode int       `json:"exitcode,omitempty"`
+	Stderr   []string  `json:"stderr,omitempty"` // the last lines the tool wrote
+	Time     time.Time `json:"time"`
+}
+
+// setError records why the job failed, with the command, exit code and stderr when a tool failed,
+// or forgets it when err is nil.
+func (r *JobRecord) setError(err error) {
+	r.Error, r.Command, r.ExitCode, r.Stderr = "", "", 0, nil
+	if err == nil {
+		return
+	}
+	r.Error = err.Error()
+	var toolErr *ToolError
+	if errors.As(err, &toolErr) {
+		r.Command, r.ExitCode, r.Stderr = toolErr.Command, toolErr.ExitCode, toolErr.Stderr
+	}
+}
+
+func (r JobRecord) finished() bool {
+	return r.State == JobDone || r.State == JobFailed
+}
+
+// JobStore keeps track of the state of every job in a JSON lines file, so we know
+// what was going on when hardsub got killed. The last line for an input wins.
+type JobStore struct {
+	mu       sync.Mutex
+	filename string
+	jobs     map[string]JobRecord
+}
+
+// jobStore is where the pipeline records its progress, nothing gets recorded when it's nil.
+var jobStore *JobStore
+
+func jobStoreFilename() string {
+	return filepath.Join(filepath.Dir(configFilename()), "jobs.jsonl")
+}
+
+// OpenJobStore reads the job records in filename and compacts the file to one line per job.
+func OpenJobStore(filename string) (*JobStore, error) {
+	s := &JobStore{filename: filename, jobs: map[string]JobRecord{}}
+	f, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec JobRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// most likely the last line, half written when we got killed.
+				Log("skipping broken job record:", err)
+				continue
+			}
+			s.jobs[rec.Input] = rec
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("cannot read job store %s: %w", filename, err)
+		}
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *JobStore) compact() error {
+	tmp := s.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, rec := range s.Records() {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+func absPath(input string) string {
+	if abs, err := filepath.Abs(input); err == nil {
+		return abs
+	}
+	return input
+}
+
+// Update changes the record for input and appends it to the file.
+func (s *JobStore) Update(input string, f func(*JobRecord)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := absPath(input)
+	rec, ok := s.jobs[key]
+	if !ok {
+		rec = JobRecord{Input: key}
+	}
+	f(&rec)
+	rec.Time = time.Now()
+	s.jobs[key] = rec
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(raw, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *JobStore) Get(input string) (JobRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.jobs[absPath(input)]
+	return rec, ok
+}
+
+// Records returns all jobs, oldest first.
+func (s *JobStore) Records() []JobRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]JobRecord, 0, len(s.jobs))
+	for _, rec := range s.jobs {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records
+}
+
+// GaveUp tells if the input failed too many times to try it again.
+func (s *JobStore) GaveUp(input string, retries int) (JobRecord, bool) {
+	rec, ok := s.Get(input)
+	return rec, ok && rec.State == JobFailed && rec.Attempts >= retries
+}
+
+// RecoverJobs cleans up after the jobs that got interrupted and returns the inputs that can run again.
+// The jobs that only need finishing up keep their state, so they only run the stages that were left.
+func RecoverJobs(store *JobStore, config Config) []string {
+	var retry []string
+	for _, rec := range store.Records() {
+		if rec.finished() {
+			continue
+		}
+		if rec.State == JobFinishing {
+			// the output is done, we only need to finish up.
+			retry = append(retry, rec.Input)
+			continue
+		}
+		for _, f := range rec.Files {
+			if err := os.RemoveAll(f); err == nil {
+				Log("Removed partial output", f)
+			}
+		}
+		var reason string
+		switch {
+		case !FileExists(rec.Input):
+			reason = "original is gone"
+		case rec.Attempts >= config.JobRetries:
+			reason = fmt.Sprintf("interrupted %d times while %s", rec.Attempts, rec.State)
+		}
+		if reason != "" {
+			log.Printf("Giving up on %s: %s\n", rec.Input, reason)
+			store.Update(rec.Input, func(r *JobRecord) {
+				r.State = JobFailed
+				r.Error = reason
+				r.Files = nil
+			})
+			continue
+		}
+		Log("Interrupted while", rec.State, rec.Input)
+		store.Update(rec.Input, func(r *JobRecord) {
+			r.State = JobQueued
+			r.Files = nil
+		})
+		retry = append(retry, rec.Input)
+	}
+	return retry
+}
+
+// finishingRecord gives the record of the job for input when it got interrupted after publishing
+// its output, so it only needs the stages after the recorded one.
+func finishingRecord(input string) (JobRecord, bool) {
+	if jobStore == nil {
+		return JobRecord{}, false
+	}
+	rec, ok := jobStore.Get(input)
+	return rec, ok && rec.State == JobFinishing
+}
+
+// record updates the job in the job store, when there is one.
+func (j *Job) record(f func(*JobRecord)) {
+	if jobStore == nil || j.DryRun() {
+		return
+	}
+	if err := jobStore.Update(j.Input, f); err != nil {
+		LogErrorln("cannot update job store:", err)
+	}
+}
+
+// fail records that the job failed with err, and returns it.
+func (j *Job) fail(err error) error {
+	j.record(func(r *JobRecord) {
+		r.State = JobFailed
+		r.setError(err)
+	})
+	return err
+}
+
+func (j *Job) setState(state JobState) {
+	if state == "" {
+		return
+	}
+	j.record(func(r *JobRecord) {
+		r.State = state
+		r.Output = absPath(j.OutputFile)
+		if j.Workspace != "" && !j.published && !containsString(r.Files, absPath(j.Workspace)) {
+			// everything the job writes is in there until it's published.
+			r.Files = append(r.Files, absPath(j.Workspace))
+		}
+	})
+}
+
+func containsString(lst []string, s string) bool {
+	for _, a := range lst {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useJobStore makes the pipeline record its jobs in a fresh store for the duration of the test.
+func useJobStore(t *testing.T) *JobStore {
+	t.Helper()
+	store, err := OpenJobStore(path.Join(t.TempDir(), "jobs.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := jobStore
+	jobStore = store
+	t.Cleanup(func() { jobStore = previous })
+	return store
+}
+
+func TestJobStoreReopen(t *testing.T) {
+	filename := path.Join(t.TempDir(), "jobs.jsonl")
+	store, err := OpenJobStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Update("/videos/a.mkv", func(r *JobRecord) { r.State = JobQueued })
+	store.Update("/videos/a.mkv", func(r *JobRecord) { r.State = JobEncoding; r.Attempts = 1 })
+	store.Update("/videos/b.mkv", func(r *JobRecord) { r.State = JobDone })
+
+	// simulate getting killed halfway through writing a line.
+	f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0o644)
+	f.WriteString(`{"input":"/videos/a.mkv","sta`)
+	f.Close()
+
+	reopened, err := OpenJobStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, ok := reopened.Get("/videos/a.mkv")
+	if !ok || rec.State != JobEncoding || rec.Attempts != 1 {
+		t.Errorf("Get() = %+v, want the encoding state from the last complete line", rec)
+	}
+	raw, _ := os.ReadFile(filename)
+	if lines := strings.Count(string(raw), "\n"); lines != 2 {
+		t.Errorf("compacted store has %d lines, want 2", lines)
+	}
+}
+
+func TestRecoverJobs(t *testing.T) {
+	dir := t.TempDir()
+	store := useJobStore(t)
+	write := func(name string) string {
+		f := path.Join(dir, name)
+		os.WriteFile(f, []byte("data"), 0o644)
+		return f
+	}
+	interrupted := write("interrupted.mkv")
+	partial := write("interrupted.mp4")
+	tooOften := write("toooften.mkv")
+	finishing := write("finishing.mkv")
+	finishedOutput := write("finishing.mp4")
+
+	store.Update(interrupted, func(r *JobRecord) { r.State = JobEncoding; r.Attempts = 1; r.Files = []string{partial} })
+	store.Update(tooOften, func(r *JobRecord) { r.State = JobCutting; r.Attempts = 3 })
+	store.Update(path.Join(dir, "vanished.mkv"), func(r *JobRecord) { r.State = JobExtracting; r.Attempts = 1 })
+	store.Update(finishing, func(r *JobRecord) { r.State = JobFinishing; r.Attempts = 1; r.Output = finishedOutput })
+	store.Update(write("done.mkv"), func(r *JobRecord) { r.State = JobDone })
+
+	cfg := Config{JobRetries: 3, TargetDirectory: dir, OriginalsDirectory: path.Join(dir, "originals")}
+	retry := RecoverJobs(store, cfg)
+
+	if want := []string{interrupted, finishing}; !reflect.DeepEqual(retry, want) {
+		t.Errorf("RecoverJobs() = %v, want %v", retry, want)
+	}
+	if FileExists(partial) {
+		t.Error("partial output of the interrupted job was not removed")
+	}
+	if !FileExists(finishedOutput) || !FileExists(finishing) {
+		t.Error("finishing job should keep its output and its original until it runs")
+	}
+	wantStates := map[string]JobState{
+		interrupted:                    JobQueued,
+		tooOften:                       JobFailed,
+		path.Join(dir, "vanished.mkv"): JobFailed,
+		finishing:                      JobFinishing,
+	}
+	for input, want := range wantStates {
+		if rec, _ := store.Get(input); rec.State != want {
+			t.Errorf("%s is %s, want %s", path.Base(input), rec.State, want)
+		}
+	}
+	if _, gaveUp := store.GaveUp(tooOften, cfg.JobRetries); !gaveUp {
+		t.Error("GaveUp() should be true after too many attempts")
+	}
+}
+
+func TestRecoverFinishingJob(t *testing.T) {
+	dir := t.TempDir()
+	store := useJobStore(t)
+	input := path.Join(dir, "show_01.mkv")
+	output := path.Join(dir, "show_01.mp4")
+	os.WriteFile(input, []byte("data"), 0o644)
+	os.WriteFile(output, []byte("converted"), 0o644)
+	// it got killed after cutting the intro, before the postcmd ran.
+	store.Update(input, func(r *JobRecord) { r.State = JobFinishing; r.Stage = "cutintro"; r.Attempts = 1; r.Output = output })
+
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = dir
+	cfg.OriginalsDirectory = path.Join(dir, "originals")
+	cfg.PostCmd = "touch %%o.posted"
+	retry := RecoverJobs(store, cfg)
+	if !reflect.DeepEqual(retry, []string{input}) {
+		t.Fatalf("RecoverJobs() = %v, want %v", retry, []string{input})
+	}
+	if FileExists(output + ".posted") {
+		t.Error("the postcmd ran before the job got queued")
+	}
+
+	// the queue only runs the stages that were left.
+	var finished []BatchResult
+	queue := newJobQueue(cfg, convert_file, func(result BatchResult) { finished = append(finished, result) }, nil)
+	queue.Add(input)
+	queue.Wait()
+	if !FileExists(output + ".posted") {
+		t.Error("the postcmd didn't run")
+	}
+	if !FileExists(path.Join(dir, "originals", "show_01.mkv")) {
+		t.Error("the original didn't get archived")
+	}
+	if len(finished) != 1 || finished[0].Err != nil || finished[0].Output != output {
+		t.Errorf("finished %+v, want the job with its output", finished)
+	}
+	if rec, _ := store.Get(input); rec.State != JobDone || rec.Stage != "archive" {
+		t.Errorf("recorded %+v, want done after archiving", rec)
+	}
+}
+
+func TestPipelineRecordsJobs(t *testing.T) {
+	store := useJobStore(t)
+	var ran []string
+	p := &Pipeline{Stages: []Stage{
+		fakeStage{name: "encode", ran: &ran},
+		fakeStage{name: "cutintro", ran: &ran, err: errors.New("boom")},
+	}}
+	job := NewJob("video.mkv", Config{TargetDirectory: t.TempDir()})
+	p.Run(job)
+	rec, ok := store.Get("video.mkv")
+	if !ok {
+		t.Fatal("pipeline did not record the job")
+	}
+	if rec.State != JobFailed || rec.Attempts != 1 || !strings.Contains(rec.Error, "boom") {
+		t.Errorf("recorded %+v, want a failed first attempt", rec)
+	}
+	if !containsString(rec.Files, absPath(job.Workspace)) {
+		t.Errorf("recorded files %v don't include the workspace", rec.Files)
+	}
+}
+
+func TestPipelineRecordsToolErrors(t *testing.T) {
+	store := useJobStore(t)
+	toolErr := &ToolError{Name: "ffmpeg", Command: "ffmpeg -i video.mkv video.mp4", ExitCode: 1,
+		Failure: failureDiskFull, Stderr: []string{"No space left on device"}}
+	p := &Pipeline{Stages: []Stage{fakeStage{name: "encode", ran: new([]string), err: fmt.Errorf("encoding: %w", toolErr)}}}
+	p.Run(NewJob("video.mkv", Config{TargetDirectory: t.TempDir()}))
+	rec, _ := store.Get("video.mkv")
+	if rec.Command != toolErr.Command || rec.ExitCode != 1 || !reflect.DeepEqual(rec.Stderr, toolErr.Stderr) {
+		t.Errorf("recorded %+v, want the command, exit code and stderr of the tool", rec)
+	}
+	// the next attempt forgets them.
+	p.Stages = []Stage{fakeStage{name: "encode", ran: new([]string), output: true}}
+	p.Run(NewJob("video.mkv", Config{TargetDirectory: t.TempDir()}))
+	if rec, _ := store.Get("video.mkv"); rec.Command != "" || rec.Stderr != nil {
+		t.Errorf("recorded %+v after a successful attempt", rec)
+	}
+}
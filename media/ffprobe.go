@@ -0,0 +1,270 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseFFprobe reads the JSON ffprobe prints with -show_format -show_streams -show_chapters.
+func ParseFFprobe(data []byte) (*VideoProbeInfo, error) {
+	var result VideoProbeInfo
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("could not unmarshal ffprobe output: %w", err)
+	}
+	return &result, nil
+}
+
+type VideoProbeInfo struct {
+	Streams  []Stream       `json:"streams"`
+	Format   Format         `json:"format"`
+	Chapters []ProbeChapter `json:"chapters"`
+}
+
+type Subtitle struct {
+	Index    int
+	Title    string
+	Language string
+}
+
+func (vpi VideoProbeInfo) ShowSubtitles() {
+	for _, stream := range vpi.Streams {
+		if stream.IsSubtitle() {
+			fmt.Printf("CodecName: %s, CodecTagString: %s, CodecTag: %s\n", stream.CodecName, stream.CodecTagString, stream.CodecTag)
+			if lang, ok := stream.Tags["language"]; ok {
+				fmt.Println("  Language:", lang)
+			}
+			if title, ok := stream.Tags["title"]; ok {
+				fmt.Println("Subs title:", title)
+			}
+		}
+	}
+}
+
+func (vpi VideoProbeInfo) ShowChapters() {
+	fmt.Printf("Chapter count: %d\n", len(vpi.Chapters))
+	for _, chapter := range vpi.Chapters {
+		fmt.Println(chapter)
+	}
+}
+
+type Stream struct {
+	Index              int    `json:"index"`
+	CodecName          string `json:"codec_name"`
+	CodecLongName      string `json:"codec_long_name"`
+	Profile            string `json:"profile"`
+	CodecType          string `json:"codec_type"`
+	CodecTagString     string `json:"codec_tag_string"`
+	CodecTag           string `json:"codec_tag"`
+	Width              int    `json:"width"`
+	Height             int    `json:"height"`
+	Channels           int    `json:"channels"`
+	ChannelLayout      string `json:"channel_layout"`
+	CodedWidth         int    `json:"coded_width"`
+	CodedHeight        int    `json:"coded_height"`
+	ClosedCaptions     int    `json:"closed_captions"`
+	FilmGrain          int    `json:"film_grain"`
+	HasBFrames         int    `json:"has_b_frames"`
+	SampleAspectRatio  string `json:"sample_aspect_ratio"`
+	DisplayAspectRatio string `json:"display_aspect_ratio"`
+	PixFmt             string `json:"pix_fmt"`
+	Level              int    `json:"level"`
+	ColorRange         string `json:"color_range"`
+	ColorSpace         string `json:"color_space"`
+	ColorTransfer      string `json:"color_transfer"`
+	ColorPrimaries     string `json:"color_primaries"`
+	ChromaLocation     string `json:"chroma_location"`
+	FieldOrder         string `json:"field_order"`
+	Refs               int    `json:"refs"`
+	IsAvc              string `json:"is_avc"`
+	NalLengthSize      string `json:"nal_length_size"`
+	RFrameRate         string `json:"r_frame_rate"`
+	AvgFrameRate       string `json:"avg_frame_rate"`
+	TimeBase           string `json:"time_base"`
+	StartPts           int    `json:"start_pts"`
+	StartTime          string `json:"start_time"`
+	BitRate            string `json:"bit_rate"`
+	BitsPerRawSample   string `json:"bits_per_raw_sample"`
+	ExtradataSize      int    `json:"extradata_size"`
+	Disposition        struct {
+		Default         int `json:"default"`
+		Dub             int `json:"dub"`
+		Original        int `json:"original"`
+		Comment         int `json:"comment"`
+		Lyrics          int `json:"lyrics"`
+		Karaoke         int `json:"karaoke"`
+		Forced          int `json:"forced"`
+		HearingImpaired int `json:"hearing_impaired"`
+		VisualImpaired  int `json:"visual_impaired"`
+		CleanEffects    int `json:"clean_effects"`
+		AttachedPic     int `json:"attached_pic"`
+		TimedThumbnails int `json:"timed_thumbnails"`
+		Captions        int `json:"captions"`
+		Descriptions    int `json:"descriptions"`
+		Metadata        int `json:"metadata"`
+		Dependent       int `json:"dependent"`
+		StillImage      int `json:"still_image"`
+	} `json:"disposition"`
+	Tags         map[string]string `json:"tags"`
+	SideDataList []SideData        `json:"side_data_list"`
+}
+
+// SideData is extra data of a stream, like the HDR10 static metadata.
+// The chromaticities and luminances are rationals, like "34000/50000".
+type SideData struct {
+	SideDataType string `json:"side_data_type"`
+	RedX         string `json:"red_x"`
+	RedY         string `json:"red_y"`
+	GreenX       string `json:"green_x"`
+	GreenY       string `json:"green_y"`
+	BlueX        string `json:"blue_x"`
+	BlueY        string `json:"blue_y"`
+	WhitePointX  string `json:"white_point_x"`
+	WhitePointY  string `json:"white_point_y"`
+	MinLuminance string `json:"min_luminance"`
+	MaxLuminance string `json:"max_luminance"`
+	MaxContent   int    `json:"max_content"`
+	MaxAverage   int    `json:"max_average"`
+}
+
+// the side data types of the HDR10 static metadata.
+const (
+	MasteringDisplayMetadata  = "Mastering display metadata"
+	ContentLightLevelMetadata = "Content light level metadata"
+)
+
+// SideData finds the side data of the type in the stream.
+func (stream Stream) SideData(kind string) (SideData, bool) {
+	for _, data := range stream.SideDataList {
+		if data.SideDataType == kind {
+			return data, true
+		}
+	}
+	return SideData{}, false
+}
+
+func (stream Stream) GetLanguage() (string, error) {
+	for k, v := range stream.Tags {
+		if strings.TrimSpace(strings.ToLower(k)) == "language" {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("no language tag found in this stream")
+}
+
+func (stream Stream) IsSubtitle() bool {
+	return stream.CodecType == "subtitle"
+}
+
+func (stream Stream) IsVideo() bool {
+	return stream.CodecType == "video"
+}
+
+func (stream Stream) IsAudio() bool {
+	return stream.CodecType == "audio"
+}
+
+// IsHDR tells if the stream is HDR10 (PQ) or HLG video.
+func (stream Stream) IsHDR() bool {
+	return stream.IsVideo() && (stream.ColorTransfer == "smpte2084" || stream.ColorTransfer == "arib-std-b67")
+}
+
+type Format struct {
+	Filename       string            `json:"filename"`
+	NbStreams      int               `json:"nb_streams"`
+	NbPrograms     int               `json:"nb_programs"`
+	FormatName     string            `json:"format_name"`
+	FormatLongName string            `json:"format_long_name"`
+	StartTime      string            `json:"start_time"`
+	Duration       string            `json:"duration"`
+	Size           string            `json:"size"`
+	BitRate        string            `json:"bit_rate"`
+	ProbeScore     int               `json:"probe_score"`
+	Tags           map[string]string `json:"tags"`
+}
+
+type ProbeChapter struct {
+	ID        int               `json:"id"`
+	TimeBase  string            `json:"time_base"`
+	Start     int               `json:"start"`
+	StartTime string            `json:"start_time"`
+	End       int64             `json:"end"`
+	EndTime   string            `json:"end_time"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// seconds reads the seconds ffprobe prints as a duration.
+func seconds(s string) time.Duration {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(f * float64(time.Second)).Round(time.Microsecond)
+}
+
+// trackTypes maps the ffprobe codec types to the mkvmerge track types.
+var trackTypes = map[string]string{"video": Video, "audio": Audio, "subtitle": Subtitles}
+
+// MediaInfo turns the ffprobe output into the common model. The tracks get the stream index as id.
+func (vpi VideoProbeInfo) MediaInfo() MediaInfo {
+	info := MediaInfo{
+		Filename:  vpi.Format.Filename,
+		Container: vpi.Format.FormatName,
+		Duration:  seconds(vpi.Format.Duration),
+	}
+	for _, stream := range vpi.Streams {
+		// mkvmerge calls cover pictures attachments as well, they're not the video.
+		if stream.CodecType == "attachment" || stream.Disposition.AttachedPic == 1 {
+			info.Attachments = append(info.Attachments, Attachment{
+				ID:          stream.Index,
+				FileName:    stream.Tags["filename"],
+				ContentType: stream.Tags["mimetype"],
+			})
+			continue
+		}
+		trackType, ok := trackTypes[stream.CodecType]
+		if !ok {
+			continue
+		}
+		lang, _ := stream.GetLanguage()
+		info.Tracks = append(info.Tracks, Track{
+			ID:              stream.Index,
+			Type:            trackType,
+			Codec:           stream.CodecName,
+			CodecID:         stream.CodecName,
+			Language:        lang,
+			Name:            stream.Tags["title"],
+			Forced:          stream.Disposition.Forced == 1,
+			Default:         stream.Disposition.Default == 1,
+			HearingImpaired: stream.Disposition.HearingImpaired == 1,
+			Channels:        stream.Channels,
+			Width:           stream.Width,
+			Height:          stream.Height,
+		})
+	}
+	for _, chapter := range vpi.Chapters {
+		info.Chapters = append(info.Chapters, Chapter{
+			Title: chapter.Tags["title"],
+			Start: seconds(chapter.StartTime),
+			End:   seconds(chapter.EndTime),
+		})
+	}
+	return info
+}
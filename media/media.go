@@ -0,0 +1,138 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package media reads what mkvmerge and ffprobe tell about a video into one model.
+package media
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// MediaInfo is what we know about a video file, whichever tool told us.
+type MediaInfo struct {
+	Filename    string
+	Container   string
+	Duration    time.Duration
+	Tracks      []Track
+	Attachments []Attachment
+	Chapters    []Chapter
+}
+
+// Track types, as mkvmerge names them.
+const (
+	Video     = "video"
+	Audio     = "audio"
+	Subtitles = "subtitles"
+)
+
+// Track is a video, audio or subtitle track.
+type Track struct {
+	ID              int    // the mkvmerge track id, or the ffprobe stream index when ffprobe told us
+	Type            string // Video, Audio or Subtitles
+	Codec           string
+	CodecID         string // like S_TEXT/ASS for mkvmerge, like ass for ffprobe
+	Language        string
+	Name            string
+	Forced          bool
+	Default         bool
+	HearingImpaired bool
+	Channels        int
+	Width           int
+	Height          int
+}
+
+// Attachment is a file stored in the video, mostly fonts for the subtitles.
+type Attachment struct {
+	ID          int
+	FileName    string
+	ContentType string
+	Size        int64
+}
+
+// Chapter is a named part of the video.
+type Chapter struct {
+	Title string
+	Start time.Duration
+	End   time.Duration
+}
+
+// SubsCodec gives the short name of the subtitle codec: ass, srt, pgs, vobsub, dvbsub or bmp.
+func (t Track) SubsCodec() string {
+	switch t.CodecID {
+	case "S_TEXT/ASS", "S_TEXT/SSA", "SAA/ASS", "ass", "ssa":
+		return "ass"
+	case "S_TEXT/UTF8", "subrip", "srt", "mov_text", "S_TEXT/WEBVTT", "webvtt":
+		// mp4 and webm text subs get burned in like srt.
+		return "srt"
+	case "S_HDMV/PGS", "hdmv_pgs_subtitle":
+		return "pgs"
+	case "S_DVDSUB", "S_VOBSUB", "dvd_subtitle":
+		return "vobsub"
+	case "S_IMAGE/BMP":
+		return "bmp"
+	case "dvb_subtitle":
+		return "dvbsub"
+	}
+	return strings.ToLower(t.CodecID)
+}
+
+// TracksOfType returns the tracks of one type, in the order they're in the file.
+func (m MediaInfo) TracksOfType(trackType string) []Track {
+	var tracks []Track
+	for _, t := range m.Tracks {
+		if t.Type == trackType {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+// Track finds a track by its id.
+func (m MediaInfo) Track(id int) (Track, bool) {
+	for _, t := range m.Tracks {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return Track{}, false
+}
+
+// IsFont tells if the attachment is a font we can give to libass.
+func (a Attachment) IsFont() bool {
+	if strings.HasPrefix(a.ContentType, "font/") ||
+		strings.Contains(a.ContentType, "truetype") ||
+		strings.Contains(a.ContentType, "opentype") {
+		return true
+	}
+	switch strings.ToLower(path.Ext(a.FileName)) {
+	case ".ttf", ".otf", ".ttc":
+		return true
+	}
+	return false
+}
+
+// Fonts returns the attachments that are fonts.
+func (m MediaInfo) Fonts() []Attachment {
+	var fonts []Attachment
+	for _, a := range m.Attachments {
+		if a.IsFont() {
+			fonts = append(fonts, a)
+		}
+	}
+	return fonts
+}
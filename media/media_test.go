@@ -0,0 +1,118 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package media
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recorded returns what a tool run with arg printed in the recording of the tools run on testvideo2.mkv.
+func recorded(t *testing.T, name, arg string) []byte {
+	data, err := os.ReadFile("../testdata/testvideo2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recording []struct {
+		Name   string
+		Args   []string
+		Stdout string
+	}
+	if err := json.Unmarshal(data, &recording); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recording {
+		if r.Name != name {
+			continue
+		}
+		for _, a := range r.Args {
+			if a == arg {
+				return []byte(r.Stdout)
+			}
+		}
+	}
+	t.Fatalf("no recording for %s", name)
+	return nil
+}
+
+var wantTracks = []Track{
+	{ID: 0, Type: Video, Width: 1920, Height: 1080, Language: "und", Default: true},
+	{ID: 1, Type: Audio, Language: "ja", Channels: 2, Default: true},
+	{ID: 2, Type: Audio, Language: "en", Name: "English Dub", Channels: 6},
+	{ID: 3, Type: Subtitles, Language: "en", Name: "Signs & Songs", Forced: true},
+	{ID: 4, Type: Subtitles, Language: "en", Name: "Full Subtitles", Default: true},
+}
+
+// withoutCodecs leaves out the codecs, which the tools name differently.
+func withoutCodecs(tracks []Track) []Track {
+	var stripped []Track
+	for _, t := range tracks {
+		t.Codec, t.CodecID = "", ""
+		stripped = append(stripped, t)
+	}
+	return stripped
+}
+
+func TestMkvMergeMediaInfo(t *testing.T) {
+	output, err := ParseMkvMerge(recorded(t, "mkvmerge", "-J"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := output.MediaInfo()
+	if info.Duration != 23*time.Minute+40046*time.Millisecond {
+		t.Errorf("duration %s", info.Duration)
+	}
+	if got := withoutCodecs(info.Tracks); !reflect.DeepEqual(got, wantTracks) {
+		t.Errorf("tracks\n%+v\nwant\n%+v", got, wantTracks)
+	}
+	if got := info.Tracks[4].SubsCodec(); got != "ass" {
+		t.Errorf("subs codec %s, want ass", got)
+	}
+	want := []Attachment{{ID: 1, FileName: "OpenSans-Semibold.ttf", ContentType: "font/ttf", Size: 221328}}
+	if !reflect.DeepEqual(info.Fonts(), want) {
+		t.Errorf("fonts %+v, want %+v", info.Fonts(), want)
+	}
+}
+
+func TestFFprobeMediaInfo(t *testing.T) {
+	output, err := ParseFFprobe(recorded(t, "ffprobe", "-show_streams"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := output.MediaInfo()
+	if info.Duration != 23*time.Minute+40046*time.Millisecond {
+		t.Errorf("duration %s", info.Duration)
+	}
+	// ffprobe knows the languages by their ISO 639-2 code and doesn't know the video's.
+	want := withoutCodecs(wantTracks)
+	want[0].Language = ""
+	want[1].Language, want[2].Language, want[3].Language, want[4].Language = "jpn", "eng", "eng", "eng"
+	if got := withoutCodecs(info.Tracks); !reflect.DeepEqual(got, want) {
+		t.Errorf("tracks\n%+v\nwant\n%+v", got, want)
+	}
+	if got := info.Tracks[4].SubsCodec(); got != "ass" {
+		t.Errorf("subs codec %s, want ass", got)
+	}
+	if len(info.Fonts()) != 1 || info.Fonts()[0].FileName != "OpenSans-Semibold.ttf" {
+		t.Errorf("fonts %+v", info.Fonts())
+	}
+	if len(info.Chapters) != 4 || info.Chapters[1] != (Chapter{Title: "Opening", Start: 90007 * time.Millisecond, End: 180013 * time.Millisecond}) {
+		t.Errorf("chapters %+v", info.Chapters)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MkvMergeOutput is what mkvmerge -J prints.
+type MkvMergeOutput struct {
+	Container struct {
+		Type       string `json:"type"`
+		Properties struct {
+			DateLocal             time.Time `json:"date_local"`
+			DateUtc               time.Time `json:"date_utc"`
+			MuxingApplication     string    `json:"muxing_application"`
+			SegmentUID            string    `json:"segment_uid"`
+			WritingApplication    string    `json:"writing_application"`
+			ContainerType         int       `json:"container_type"`
+			Duration              int64     `json:"duration"` // in nanoseconds
+			IsProvidingTimestamps bool      `json:"is_providing_timestamps"`
+		} `json:"properties"`
+		Recognized bool `json:"recognized"`
+		Supported  bool `json:"supported"`
+	} `json:"container"`
+	FileName    string               `json:"file_name"`
+	Attachments []MkvMergeAttachment `json:"attachments"`
+	Chapters    []struct {
+		NumEntries int `json:"num_entries"`
+	} `json:"chapters"`
+	Errors                      []string        `json:"errors"`
+	Warnings                    []string        `json:"warnings"`
+	Tracks                      []MkvMergeTrack `json:"tracks"`
+	IdentificationFormatVersion int             `json:"identification_format_version"`
+}
+
+type MkvMergeAttachment struct {
+	ID          int    `json:"id"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Description string `json:"description"`
+	Size        int64  `json:"size"`
+}
+
+type MkvMergeTrack struct {
+	ID         int                     `json:"id"`
+	Type       string                  `json:"type"`
+	Codec      string                  `json:"codec"`
+	Properties MkvMergeTrackProperties `json:"properties"`
+}
+
+// MkvMergeTrackProperties holds the properties of every kind of track, only the ones
+// that make sense for the type of the track are filled in.
+type MkvMergeTrackProperties struct {
+	CodecID                string `json:"codec_id"`
+	Language               string `json:"language"`
+	LanguageIETF           string `json:"language_ietf"`
+	TrackName              string `json:"track_name"`
+	Number                 int    `json:"number"`
+	UID                    uint64 `json:"uid"`
+	DefaultTrack           bool   `json:"default_track"`
+	EnabledTrack           bool   `json:"enabled_track"`
+	ForcedTrack            bool   `json:"forced_track"`
+	HearingImpaired        bool   `json:"flag_hearing_impaired"`
+	DefaultDuration        int64  `json:"default_duration"`
+	MinimumTimestamp       int64  `json:"minimum_timestamp"`
+	PixelDimensions        string `json:"pixel_dimensions"`
+	DisplayDimensions      string `json:"display_dimensions"`
+	AudioChannels          int    `json:"audio_channels"`
+	AudioSamplingFrequency int    `json:"audio_sampling_frequency"`
+}
+
+// ParseMkvMerge reads the output of mkvmerge -J.
+func ParseMkvMerge(data []byte) (*MkvMergeOutput, error) {
+	var output MkvMergeOutput
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("cannot read the mkvmerge output: %w", err)
+	}
+	return &output, nil
+}
+
+// MediaInfo turns the mkvmerge output into the common model.
+// mkvmerge only counts the chapters, so those stay empty.
+func (o MkvMergeOutput) MediaInfo() MediaInfo {
+	info := MediaInfo{
+		Filename:  o.FileName,
+		Container: o.Container.Type,
+		Duration:  time.Duration(o.Container.Properties.Duration),
+	}
+	for _, t := range o.Tracks {
+		p := t.Properties
+		lang := p.LanguageIETF
+		if lang == "" {
+			lang = p.Language
+		}
+		track := Track{
+			ID:              t.ID,
+			Type:            t.Type,
+			Codec:           t.Codec,
+			CodecID:         p.CodecID,
+			Language:        lang,
+			Name:            p.TrackName,
+			Forced:          p.ForcedTrack,
+			Default:         p.DefaultTrack,
+			HearingImpaired: p.HearingImpaired,
+			Channels:        p.AudioChannels,
+		}
+		fmt.Sscanf(p.PixelDimensions, "%dx%d", &track.Width, &track.Height)
+		info.Tracks = append(info.Tracks, track)
+	}
+	for _, a := range o.Attachments {
+		info.Attachments = append(info.Attachments, Attachment{ID: a.ID, FileName: a.FileName, ContentType: a.ContentType, Size: a.Size})
+	}
+	return info
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package media
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StreamFilter tells if a stream is one we're looking for.
+type StreamFilter func(Stream) bool
+
+// WithLanguage finds the streams in one of the languages. Both the two and three letter
+// codes work, so "en" finds the streams ffprobe calls "eng".
+func WithLanguage(langs ...string) StreamFilter {
+	return func(s Stream) bool {
+		lang, err := s.GetLanguage()
+		if err != nil {
+			return false
+		}
+		for _, want := range langs {
+			if SameLanguage(lang, want) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithTitle finds the streams whose title contains part, ignoring case.
+func WithTitle(part string) StreamFilter {
+	part = strings.ToLower(part)
+	return func(s Stream) bool {
+		return strings.Contains(strings.ToLower(s.Tags["title"]), part)
+	}
+}
+
+// WithCodec finds the streams with one of the codecs, as ffprobe names them.
+func WithCodec(codecs ...string) StreamFilter {
+	return func(s Stream) bool {
+		for _, codec := range codecs {
+			if strings.EqualFold(s.CodecName, codec) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Forced finds the streams flagged as forced.
+func Forced(s Stream) bool { return s.Disposition.Forced == 1 }
+
+// Default finds the streams flagged as default.
+func Default(s Stream) bool { return s.Disposition.Default == 1 }
+
+// HearingImpaired finds the streams flagged for the hearing impaired.
+func HearingImpaired(s Stream) bool { return s.Disposition.HearingImpaired == 1 }
+
+// Not finds the streams the filter doesn't.
+func Not(filter StreamFilter) StreamFilter {
+	return func(s Stream) bool { return !filter(s) }
+}
+
+// StreamsOfType returns the streams of a codec type that pass all the filters, in the order they're in the file.
+func (vpi VideoProbeInfo) StreamsOfType(codecType string, filters ...StreamFilter) []Stream {
+	var streams []Stream
+	for _, s := range vpi.Streams {
+		if s.CodecType != codecType || s.Disposition.AttachedPic == 1 {
+			continue
+		}
+		matches := true
+		for _, filter := range filters {
+			if !filter(s) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+func (vpi VideoProbeInfo) VideoStreams(filters ...StreamFilter) []Stream {
+	return vpi.StreamsOfType("video", filters...)
+}
+
+func (vpi VideoProbeInfo) AudioStreams(filters ...StreamFilter) []Stream {
+	return vpi.StreamsOfType("audio", filters...)
+}
+
+func (vpi VideoProbeInfo) SubtitleStreams(filters ...StreamFilter) []Stream {
+	return vpi.StreamsOfType("subtitle", filters...)
+}
+
+// Stream finds a stream by its index.
+func (vpi VideoProbeInfo) Stream(index int) (Stream, bool) {
+	for _, s := range vpi.Streams {
+		if s.Index == index {
+			return s, true
+		}
+	}
+	return Stream{}, false
+}
+
+// typeIndex tells the how many'th stream of its type the stream with index is.
+func (vpi VideoProbeInfo) typeIndex(index int) (int, bool) {
+	stream, ok := vpi.Stream(index)
+	if !ok {
+		return 0, false
+	}
+	for n, s := range vpi.StreamsOfType(stream.CodecType) {
+		if s.Index == index {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// MapSpec gives the ffmpeg stream specifier for the stream with index in input 0,
+// relative to its type so it's the same whatever else is in the container: 0:a:1 for the second audio stream.
+func (vpi VideoProbeInfo) MapSpec(index int) (string, error) {
+	stream, ok := vpi.Stream(index)
+	if !ok {
+		return "", fmt.Errorf("no stream %d", index)
+	}
+	if _, ok := trackTypes[stream.CodecType]; !ok {
+		return "", fmt.Errorf("stream %d is not a video, audio or subtitle stream", index)
+	}
+	n, _ := vpi.typeIndex(index)
+	return fmt.Sprintf("0:%s:%d", stream.CodecType[:1], n), nil
+}
+
+// TrackMap maps the mkvmerge track ids to the ffprobe stream indexes of the same file.
+// Both tools list the tracks of a type in the same order, but they don't always number them the same,
+// so the tracks get matched by their type and their position among the tracks of that type.
+type TrackMap struct {
+	toStream map[int]int
+	toTrack  map[int]int
+}
+
+// NewTrackMap matches the tracks mkvmerge found to the streams ffprobe found.
+func NewTrackMap(mkvmerge MediaInfo, probe VideoProbeInfo) TrackMap {
+	m := TrackMap{toStream: map[int]int{}, toTrack: map[int]int{}}
+	for codecType, trackType := range trackTypes {
+		streams := probe.StreamsOfType(codecType)
+		for n, track := range mkvmerge.TracksOfType(trackType) {
+			if n >= len(streams) {
+				break
+			}
+			m.toStream[track.ID] = streams[n].Index
+			m.toTrack[streams[n].Index] = track.ID
+		}
+	}
+	return m
+}
+
+// StreamIndex gives the ffprobe stream index of the mkvmerge track id.
+func (m TrackMap) StreamIndex(trackID int) (int, bool) {
+	index, ok := m.toStream[trackID]
+	return index, ok
+}
+
+// TrackID gives the mkvmerge track id of the ffprobe stream index.
+func (m TrackMap) TrackID(streamIndex int) (int, bool) {
+	id, ok := m.toTrack[streamIndex]
+	return id, ok
+}
+
+// languageCodes maps the two letter language codes to their three letter versions,
+// both the bibliographic and the terminology one when they differ.
+var languageCodes = map[string][]string{
+	"ar": {"ara"}, "cs": {"cze", "ces"}, "da": {"dan"}, "de": {"ger", "deu"}, "el": {"gre", "ell"},
+	"en": {"eng"}, "es": {"spa"}, "fi": {"fin"}, "fr": {"fre", "fra"}, "he": {"heb"}, "hi": {"hin"},
+	"hu": {"hun"}, "id": {"ind"}, "it": {"ita"}, "ja": {"jpn"}, "ko": {"kor"}, "nl": {"dut", "nld"},
+	"no": {"nor"}, "pl": {"pol"}, "pt": {"por"}, "ro": {"rum", "ron"}, "ru": {"rus"}, "sv": {"swe"},
+	"th": {"tha"}, "tr": {"tur"}, "uk": {"ukr"}, "vi": {"vie"}, "zh": {"chi", "zho"},
+}
+
+// SameLanguage tells if two language codes are the same language, whether they're IETF tags
+// like en-US or ISO 639-2 codes like eng.
+func SameLanguage(a, b string) bool {
+	a, b = baseLanguage(a), baseLanguage(b)
+	return a != "" && a == b
+}
+
+// baseLanguage reduces a language code to its two letter version when we know it.
+func baseLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	for short, long := range languageCodes {
+		for _, code := range long {
+			if lang == code {
+				return short
+			}
+		}
+	}
+	return lang
+}
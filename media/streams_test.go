@@ -0,0 +1,119 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package media
+
+import (
+	"reflect"
+	"testing"
+)
+
+func indexes(streams []Stream) []int {
+	found := []int{}
+	for _, s := range streams {
+		found = append(found, s.Index)
+	}
+	return found
+}
+
+func TestStreamQueries(t *testing.T) {
+	probe, err := ParseFFprobe(recorded(t, "ffprobe", "-show_streams"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  []Stream
+		want []int
+	}{
+		{"video", probe.VideoStreams(), []int{0}},
+		{"audio", probe.AudioStreams(), []int{1, 2}},
+		{"subtitles", probe.SubtitleStreams(), []int{3, 4}},
+		{"language", probe.AudioStreams(WithLanguage("ja")), []int{1}},
+		{"ietf language", probe.AudioStreams(WithLanguage("de", "en-US")), []int{2}},
+		{"title", probe.SubtitleStreams(WithTitle("full")), []int{4}},
+		{"forced", probe.SubtitleStreams(Forced), []int{3}},
+		{"not forced", probe.SubtitleStreams(Not(Forced)), []int{4}},
+		{"default", probe.AudioStreams(Default), []int{1}},
+		{"hearing impaired", probe.SubtitleStreams(HearingImpaired), []int{}},
+		{"codec", probe.SubtitleStreams(WithCodec("subrip", "ASS")), []int{3, 4}},
+		{"all filters", probe.SubtitleStreams(WithLanguage("en"), WithCodec("ass"), Default), []int{4}},
+	}
+	for _, tt := range tests {
+		if got := indexes(tt.got); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got streams %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	for _, s := range probe.Streams {
+		if s.IsAudio() != (s.CodecType == "audio") {
+			t.Errorf("stream %d is a %s, IsAudio says %v", s.Index, s.CodecType, s.IsAudio())
+		}
+	}
+}
+
+func TestMapSpec(t *testing.T) {
+	probe, err := ParseFFprobe(recorded(t, "ffprobe", "-show_streams"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, want := range map[int]string{0: "0:v:0", 2: "0:a:1", 4: "0:s:1"} {
+		if got, err := probe.MapSpec(index); err != nil || got != want {
+			t.Errorf("MapSpec(%d) = %q, %v, want %q", index, got, err, want)
+		}
+	}
+	if _, err := probe.MapSpec(5); err == nil {
+		t.Error("want an error mapping the attachment")
+	}
+}
+
+func TestTrackMap(t *testing.T) {
+	// an mp4 with a data stream first, which mkvmerge doesn't count as a track.
+	mkvmerge := MediaInfo{Tracks: []Track{
+		{ID: 0, Type: Video}, {ID: 1, Type: Audio}, {ID: 2, Type: Subtitles},
+	}}
+	probe := VideoProbeInfo{Streams: []Stream{
+		{Index: 0, CodecType: "data"}, {Index: 1, CodecType: "video"}, {Index: 2, CodecType: "audio"}, {Index: 3, CodecType: "subtitle"},
+	}}
+	m := NewTrackMap(mkvmerge, probe)
+	for id, want := range map[int]int{0: 1, 1: 2, 2: 3} {
+		if got, ok := m.StreamIndex(id); !ok || got != want {
+			t.Errorf("StreamIndex(%d) = %d, %v, want %d", id, got, ok, want)
+		}
+		if got, ok := m.TrackID(want); !ok || got != id {
+			t.Errorf("TrackID(%d) = %d, %v, want %d", want, got, ok, id)
+		}
+	}
+	if _, ok := m.StreamIndex(3); ok {
+		t.Error("found a stream for a track that isn't there")
+	}
+}
+
+func TestIsHDR(t *testing.T) {
+	tests := []struct {
+		stream Stream
+		want   bool
+	}{
+		{Stream{CodecType: "video", ColorTransfer: "smpte2084"}, true},
+		{Stream{CodecType: "video", ColorTransfer: "arib-std-b67"}, true},
+		{Stream{CodecType: "video", ColorTransfer: "bt709"}, false},
+		{Stream{CodecType: "video"}, false},
+		{Stream{CodecType: "subtitle", ColorTransfer: "smpte2084"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.stream.IsHDR(); got != tt.want {
+			t.Errorf("IsHDR() of a %s with transfer %q = %v, want %v", tt.stream.CodecType, tt.stream.ColorTransfer, got, tt.want)
+		}
+	}
+}
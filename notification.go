@@ -14,7 +14,10 @@ func sendNotification(msg, title string, config *Config) error {
 	// Create a new recipient
 	recipient := pushover.NewRecipient(config.PushoverUserKey)
 
-	// Create the message to send
+	// Create the message to send, pushover refuses messages that are too long.
+	if runes := []rune(msg); len(runes) > pushover.MessageMaxLength {
+		msg = string(runes[:pushover.MessageMaxLength-1]) + "…"
+	}
 	message := pushover.NewMessageWithTitle(msg, title)
 
 	// Send the message to the recipient
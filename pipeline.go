@@ -0,0 +1,301 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// Job is the state shared by all the stages converting a single video file.
+type Job struct {
+	Config     Config
+	Input      string // the video file we're converting
+	Props      VideoProperties
+	Media      *media.MediaInfo      // what mkvmerge or ffprobe knows about the input, see mediaInfo
+	Probe      *media.VideoProbeInfo // what ffprobe knows about the input, see probeInfo
+	Tracks     *SelectedTracks
+	Encoder    *Encoder  // the video encoder, see encoder
+	Geometry   *Geometry // how the video gets cropped, scaled and retimed, see geometry
+	SubsFile   string
+	OutputFile string
+	Progress   ProgressReporter // nil shows a terminal progress bar
+	Workspace  string           // where everything gets written until the output is done
+	Plan       *Plan            // when set, the stages only plan what they would do
+	cleanups   []func()
+
+	extraOutputs []string
+	published    bool
+}
+
+func NewJob(videofile string, config Config) *Job {
+	return &Job{
+		Config:     config,
+		Input:      videofile,
+		OutputFile: outputFileFor(videofile, config),
+	}
+}
+
+// mediaInfo inspects the input the first time a stage needs it.
+func (j *Job) mediaInfo() (*media.MediaInfo, error) {
+	if j.Media == nil {
+		info, err := inspect(j.Input)
+		if err != nil {
+			return nil, err
+		}
+		j.Media = info
+	}
+	return j.Media, nil
+}
+
+// probeInfo asks ffprobe about the input the first time a stage needs it.
+func (j *Job) probeInfo() (*media.VideoProbeInfo, error) {
+	if j.Probe == nil {
+		info, err := GetFFprobeInfo(j.Input)
+		if err != nil {
+			return nil, err
+		}
+		j.Probe = info
+	}
+	return j.Probe, nil
+}
+
+// encoder picks the video encoder the first time a stage needs it.
+// A dry run plans with the configured encoder, without asking ffmpeg which ones it has.
+func (j *Job) encoder() (Encoder, error) {
+	if j.Encoder == nil {
+		choose := chooseEncoder
+		if j.DryRun() {
+			choose = configuredEncoder
+		}
+		encoder, err := choose(j.Config)
+		if err != nil {
+			return Encoder{}, err
+		}
+		j.Encoder = &encoder
+	}
+	return *j.Encoder, nil
+}
+
+// encoding is how the output gets encoded, with the profile and the encoder the job uses.
+func (j *Job) encoding() (outputEncoding, error) {
+	profile, err := outputProfile(j.Config)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := j.encoder()
+	if err != nil {
+		return nil, err
+	}
+	rate, err := j.rateControl()
+	if err != nil {
+		return nil, err
+	}
+	encode := profile.encoding(encoder, rate, j.Config)
+	if j.Tracks == nil || len(j.Tracks.ExtraAudio) == 0 {
+		return encode, nil
+	}
+	// ffmpeg only keeps one audio track unless it's told otherwise.
+	return func(cmd *FFmpegCommand) *FFmpegCommand {
+		return encode(cmd.Map("0:v", "0:a"))
+	}, nil
+}
+
+// mapTrack gives what to -map for the mkvmerge track id. It goes through the ffprobe stream of the track,
+// as mkvmerge doesn't number the tracks of every container the way ffmpeg does.
+func (j *Job) mapTrack(id int) string {
+	mapped := fmt.Sprintf("0:%d", id)
+	mkv, err := j.mediaInfo()
+	if err != nil {
+		return mapped
+	}
+	probe, err := j.probeInfo()
+	if err != nil {
+		Log("Cannot probe", j.Input, "mapping track", id, "as is:", err)
+		return mapped
+	}
+	if index, ok := media.NewTrackMap(*mkv, *probe).StreamIndex(id); ok {
+		return fmt.Sprintf("0:%d", index)
+	}
+	return mapped
+}
+
+// OnFinish registers a function to run when the pipeline is done with the job, whether it failed or not.
+func (j *Job) OnFinish(f func()) {
+	j.cleanups = append(j.cleanups, f)
+}
+
+func (j *Job) finish() {
+	for i := len(j.cleanups) - 1; i >= 0; i-- {
+		j.cleanups[i]()
+	}
+	j.cleanups = nil
+}
+
+func outputFileFor(videofile string, config Config) string {
+	base := path.Base(videofile)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	// PipelineFromConfig already complained about a profile that doesn't work.
+	profile, _ := outputProfile(config)
+	if profile.Container == "mkv" {
+		return path.Join(config.TargetDirectory, "HS_"+base+profile.Extension())
+	}
+	output := path.Join(config.TargetDirectory, base+profile.Extension())
+	if absPath(output) == absPath(videofile) {
+		// never overwrite a video we're converting.
+		output = path.Join(config.TargetDirectory, "HS_"+base+profile.Extension())
+	}
+	return output
+}
+
+// Stage is one step in the conversion of a video file.
+type Stage interface {
+	Name() string
+	Run(job *Job) error
+}
+
+// the stages that can be used in the 'stages' config setting, by name.
+var stageRegistry = map[string]func() Stage{
+	"probe":        func() Stage { return ProbeStage{} },
+	"selecttracks": func() Stage { return SelectTracksStage{} },
+	"extractsubs":  func() Stage { return ExtractSubsStage{} },
+	"encode":       func() Stage { return EncodeStage{} },
+	"speedup":      func() Stage { return SpeedupStage{} },
+	"cutintro":     func() Stage { return CutIntroStage{} },
+	"postprocess":  func() Stage { return PostProcessStage{} },
+	"archive":      func() Stage { return ArchiveStage{} },
+}
+
+var DefaultStages = []string{"probe", "selecttracks", "extractsubs", "encode", "speedup", "cutintro", "postprocess", "archive"}
+
+type Pipeline struct {
+	Stages []Stage
+}
+
+func NewPipeline(names ...string) (*Pipeline, error) {
+	p := &Pipeline{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		newStage, ok := stageRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage: %s", name)
+		}
+		p.Stages = append(p.Stages, newStage())
+	}
+	if len(p.Stages) == 0 {
+		return nil, fmt.Errorf("no stages to run")
+	}
+	return p, nil
+}
+
+// PipelineFromConfig builds the pipeline from the comma separated 'stages' setting,
+// falling back to the default stages when it's empty.
+func PipelineFromConfig(config Config) (*Pipeline, error) {
+	if _, err := configuredEncoder(config); err != nil {
+		return nil, err
+	}
+	if _, err := rateControlFor(config); err != nil {
+		return nil, err
+	}
+	if err := checkFps(config.Fps); err != nil {
+		return nil, err
+	}
+	if err := checkHDR(config); err != nil {
+		return nil, err
+	}
+	if _, err := audioBitratesFor(config); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(config.Stages) == "" {
+		return NewPipeline(DefaultStages...)
+	}
+	return NewPipeline(strings.Split(config.Stages, ",")...)
+}
+
+// Run runs all stages in order, stopping at the first one that fails.
+// The stages write to a workspace, the output gets moved to the target directory
+// when it's done: before the postprocess and archive stages, or after the last stage.
+// Every stage change gets recorded in the job store, except on a dry run.
+func (p *Pipeline) Run(job *Job) error {
+	defer job.finish()
+	job.record(func(r *JobRecord) {
+		r.Attempts++
+		r.setError(nil)
+		r.Files = nil
+		r.Stage = ""
+	})
+	if err := job.createWorkspace(); err != nil {
+		return job.fail(err)
+	}
+	return runStages(job, p.Stages)
+}
+
+// Resume finishes a job that got interrupted after its output was published, running the stages
+// after the one named after like Run does. When that stage isn't in the pipeline, it runs the
+// stages that finish up a job.
+func (p *Pipeline) Resume(job *Job, after string) error {
+	defer job.finish()
+	// the output is in the target directory already.
+	job.published = true
+	return runStages(job, p.stagesAfter(after))
+}
+
+func (p *Pipeline) stagesAfter(name string) []Stage {
+	for i, stage := range p.Stages {
+		if stage.Name() == name {
+			return p.Stages[i+1:]
+		}
+	}
+	var finishing []Stage
+	for _, stage := range p.Stages {
+		if stageStates[stage.Name()] == JobFinishing {
+			finishing = append(finishing, stage)
+		}
+	}
+	return finishing
+}
+
+// runStages runs the stages in order and publishes the output, recording every stage that finished.
+func runStages(job *Job, stages []Stage) error {
+	for _, stage := range stages {
+		Log("Stage", stage.Name(), "for", job.Input)
+		state := stageStates[stage.Name()]
+		if state == JobFinishing {
+			if err := job.publish(); err != nil {
+				return job.fail(err)
+			}
+		}
+		job.setState(state)
+		if err := stage.Run(job); err != nil {
+			return job.fail(fmt.Errorf("%s: %w", stage.Name(), err))
+		}
+		job.record(func(r *JobRecord) { r.Stage = stage.Name() })
+	}
+	if err := job.publish(); err != nil {
+		return job.fail(err)
+	}
+	job.record(func(r *JobRecord) {
+		r.State = JobDone
+		r.Output = absPath(job.OutputFile)
+	})
+	return nil
+}
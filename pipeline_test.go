@@ -0,0 +1,209 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+type fakeStage struct {
+	name   string
+	err    error
+	ran    *[]string
+	output bool // write the output file, like the encode stage does
+}
+
+func (f fakeStage) Name() string { return f.name }
+
+func (f fakeStage) Run(job *Job) error {
+	*f.ran = append(*f.ran, f.name)
+	if f.output {
+		os.WriteFile(job.OutputFile, []byte("converted"), 0o644)
+	}
+	return f.err
+}
+
+func stageNames(p *Pipeline) []string {
+	var names []string
+	for _, s := range p.Stages {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+func TestPipelineFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		stages  string
+		want    []string
+		wantErr bool
+	}{
+		{"default", "", DefaultStages, false},
+		{"reordered", "selecttracks, probe,encode", []string{"selecttracks", "probe", "encode"}, false},
+		{"case insensitive", "Encode,ARCHIVE", []string{"encode", "archive"}, false},
+		{"unknown stage", "probe,transmogrify", nil, true},
+		{"only commas", ",,", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PipelineFromConfig(Config{Stages: tt.stages})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PipelineFromConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if names := stageNames(got); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("PipelineFromConfig() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineRun(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name    string
+		errAt   int
+		wantRan []string
+	}{
+		{"all stages", -1, []string{"one", "two", "three"}},
+		{"stops at failing stage", 1, []string{"one", "two"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ran []string
+			p := &Pipeline{}
+			for i, name := range []string{"one", "two", "three"} {
+				s := fakeStage{name: name, ran: &ran, output: i == 0}
+				if i == tt.errAt {
+					s.err = boom
+				}
+				p.Stages = append(p.Stages, s)
+			}
+			target := t.TempDir()
+			job := NewJob("video.mkv", Config{TargetDirectory: target})
+			finished := false
+			job.OnFinish(func() { finished = true })
+			err := p.Run(job)
+			if tt.errAt >= 0 && !errors.Is(err, boom) {
+				t.Errorf("Run() error = %v, want %v", err, boom)
+			}
+			if tt.errAt < 0 && err != nil {
+				t.Errorf("Run() unexpected error = %v", err)
+			}
+			if !reflect.DeepEqual(ran, tt.wantRan) {
+				t.Errorf("Run() ran %v, want %v", ran, tt.wantRan)
+			}
+			if !finished {
+				t.Error("Run() did not run the cleanup functions")
+			}
+			if FileExists(job.Workspace) {
+				t.Error("Run() did not remove the workspace")
+			}
+			if published := FileExists(path.Join(target, "video.mp4")); published != (tt.errAt < 0) {
+				t.Errorf("output published = %v, want %v", published, tt.errAt < 0)
+			}
+		})
+	}
+}
+
+func Test_outputFileFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		config Config
+		want   string
+	}{
+		{"mp4", "/incoming/show_01.mkv", Config{TargetDirectory: "converted"}, "converted/show_01.mp4"},
+		{"mkv", "/incoming/show_01.mkv", Config{TargetDirectory: "converted", Mkv: true}, "converted/HS_show_01.mkv"},
+		{"avi to mp4", "/incoming/show_01.avi", Config{TargetDirectory: "converted"}, "converted/show_01.mp4"},
+		{"mp4 to mkv", "/incoming/show_01.mp4", Config{TargetDirectory: "converted", Mkv: true}, "converted/HS_show_01.mkv"},
+		{"mp4 in place", "/incoming/show_01.mp4", Config{TargetDirectory: "/incoming"}, "/incoming/HS_show_01.mp4"},
+		{"webm profile", "/incoming/show_01.mkv", Config{TargetDirectory: "converted", Profile: "webm-av1"}, "converted/show_01.webm"},
+		{"mkv profile", "/incoming/show_01.mkv", Config{TargetDirectory: "converted", Profile: "mkv-hevc"}, "converted/HS_show_01.mkv"},
+		{"webm in place", "/incoming/show_01.webm", Config{TargetDirectory: "/incoming", Profile: "webm-vp9"}, "/incoming/HS_show_01.webm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outputFileFor(tt.input, tt.config); got != tt.want {
+				t.Errorf("outputFileFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStagesNeedTracks(t *testing.T) {
+	for _, stage := range []Stage{ExtractSubsStage{}, EncodeStage{}} {
+		t.Run(stage.Name(), func(t *testing.T) {
+			if err := stage.Run(NewJob("video.mkv", Config{})); !errors.Is(err, errNoTracks) {
+				t.Errorf("%s.Run() error = %v, want %v", stage.Name(), err, errNoTracks)
+			}
+		})
+	}
+}
+
+func TestPublishBeforeFinishing(t *testing.T) {
+	target := t.TempDir()
+	var seen string
+	p := &Pipeline{Stages: []Stage{
+		fakeStage{name: "encode", ran: &[]string{}, output: true},
+		stageFunc{"postprocess", func(job *Job) error {
+			seen = job.OutputFile
+			return nil
+		}},
+	}}
+	job := NewJob("video.mkv", Config{TargetDirectory: target})
+	if err := p.Run(job); err != nil {
+		t.Fatal(err)
+	}
+	if want := path.Join(target, "video.mp4"); seen != want {
+		t.Errorf("postprocess saw %s, want the published %s", seen, want)
+	}
+}
+
+type stageFunc struct {
+	name string
+	run  func(job *Job) error
+}
+
+func (s stageFunc) Name() string       { return s.name }
+func (s stageFunc) Run(job *Job) error { return s.run(job) }
+
+func TestArchiveStage(t *testing.T) {
+	dir := t.TempDir()
+	video := path.Join(dir, "video.mkv")
+	if err := os.WriteFile(video, []byte("not really a video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob(video, Config{
+		TargetDirectory:    path.Join(dir, "converted"),
+		OriginalsDirectory: path.Join(dir, "originals"),
+	})
+	if err := (ArchiveStage{}).Run(job); err != nil {
+		t.Fatalf("ArchiveStage.Run() error = %v", err)
+	}
+	if FileExists(video) {
+		t.Error("original is still in the source directory")
+	}
+	if !FileExists(path.Join(dir, "originals", "video.mkv")) {
+		t.Error("original was not moved to the originals directory")
+	}
+}
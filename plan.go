@@ -0,0 +1,170 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// Plan is what a conversion would do, filled in by the stages on a dry run instead of doing it.
+type Plan struct {
+	Input          string           `json:"input"`
+	Tracks         []PlannedTrack   `json:"tracks"`
+	SubtitleType   string           `json:"subtitletype,omitempty"`
+	Commands       []string         `json:"commands"`
+	Outputs        []string         `json:"outputs"`
+	Intro          *IntroBoundaries `json:"intro,omitempty"`
+	Crf            string           `json:"crf,omitempty"` // how the quality ratecontrol picks the crf
+	PostSubExtract string           `json:"postsubextract,omitempty"`
+	PostCmd        string           `json:"postcmd,omitempty"`
+	Original       string           `json:"original,omitempty"` // where the original gets moved to
+}
+
+type PlannedTrack struct {
+	Role     string `json:"role"` // video, audio or subtitles
+	ID       int    `json:"id"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Name     string `json:"name,omitempty"`
+	File     string `json:"file,omitempty"` // a subtitle file next to the video, instead of a track
+}
+
+// DryRun tells if the job only makes a plan.
+func (j *Job) DryRun() bool {
+	return j.Plan != nil
+}
+
+// ffmpeg runs cmd, or adds it to the plan on a dry run.
+func (j *Job) ffmpeg(cmd *FFmpegCommand, props VideoProperties) error {
+	if j.DryRun() {
+		j.Plan.Commands = append(j.Plan.Commands, cmd.String())
+		return nil
+	}
+	return runFfmpeg(cmd.Args(), props, j.Progress)
+}
+
+// ffmpegPasses runs the passes of an encode one after the other, showing the progress of all of them
+// as one run, or adds them to the plan on a dry run.
+func (j *Job) ffmpegPasses(passes []*FFmpegCommand, props VideoProperties) error {
+	if j.DryRun() || len(passes) == 1 {
+		for _, cmd := range passes {
+			if err := j.ffmpeg(cmd, props); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	progress := j.Progress
+	if progress == nil {
+		progress = &terminalProgress{}
+	}
+	all := &passesProgress{ProgressReporter: progress, passes: len(passes)}
+	for i, cmd := range passes {
+		all.pass = i
+		if err := runFfmpeg(cmd.Args(), props, all); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// plannedTracks describes the selected tracks, with the language and name they have in info.
+func plannedTracks(info *media.MediaInfo, tracks *SelectedTracks) []PlannedTrack {
+	type role struct {
+		role string
+		id   int
+	}
+	selection := []role{{"video", tracks.VideoTrack}, {"audio", tracks.AudioTrack}, {"subtitles", tracks.SubsTrack}}
+	for _, id := range tracks.ExtraAudio {
+		selection = append(selection, role{"audio", id})
+	}
+	var planned []PlannedTrack
+	for _, selected := range selection {
+		track := PlannedTrack{Role: selected.role, ID: selected.id}
+		if t, ok := info.Track(selected.id); ok {
+			track.Codec, track.Language, track.Name = t.Codec, t.Language, t.Name
+		}
+		planned = append(planned, track)
+	}
+	if tracks.Sidecar != "" {
+		planned[2] = PlannedTrack{Role: "subtitles", ID: -1, Codec: tracks.SubtitleType.String(), File: tracks.Sidecar}
+	}
+	return planned
+}
+
+func (t PlannedTrack) String() string {
+	if t.File != "" {
+		return fmt.Sprintf("%s file %s", t.Codec, t.File)
+	}
+	if t.ID < 0 {
+		return "none"
+	}
+	s := fmt.Sprintf("#%d %s", t.ID, t.Codec)
+	if t.Language != "" {
+		s += " [" + t.Language + "]"
+	}
+	if t.Name != "" {
+		s += fmt.Sprintf(" %q", t.Name)
+	}
+	return s
+}
+
+// WriteText writes the plan the way a human wants to read it.
+func (p *Plan) WriteText(w io.Writer) {
+	fmt.Fprintln(w, p.Input)
+	for _, t := range p.Tracks {
+		fmt.Fprintf(w, "  %-10s %s\n", t.Role+":", t)
+	}
+	if p.SubtitleType != "" {
+		fmt.Fprintf(w, "  %-10s %s\n", "subs type:", p.SubtitleType)
+	}
+	if p.PostSubExtract != "" {
+		fmt.Fprintf(w, "  %-10s %s\n", "postsub:", strings.TrimSpace(p.PostSubExtract))
+	}
+	if p.Intro != nil {
+		fmt.Fprintf(w, "  %-10s %s -> %s\n", "intro:", p.Intro.Begin, p.Intro.End)
+	}
+	if p.Crf != "" {
+		fmt.Fprintf(w, "  %-10s %s\n", "crf:", p.Crf)
+	}
+	fmt.Fprintln(w, "  commands:")
+	for _, cmd := range p.Commands {
+		fmt.Fprintln(w, "    "+cmd)
+	}
+	for _, output := range p.Outputs {
+		fmt.Fprintf(w, "  %-10s %s\n", "output:", output)
+	}
+	if p.PostCmd != "" {
+		fmt.Fprintf(w, "  %-10s %s\n", "postcmd:", p.PostCmd)
+	}
+	if p.Original != "" {
+		fmt.Fprintf(w, "  %-10s %s\n", "original:", p.Original)
+	}
+}
+
+// printPlan writes the plan as text, or as a single line of JSON for scripts.
+func printPlan(w io.Writer, p *Plan, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(p)
+	}
+	p.WriteText(w)
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	fake := useRecordedRunner(t, "testdata/testvideo2.json")
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = path.Join(dir, "converted")
+	cfg.OriginalsDirectory = path.Join(dir, "originals")
+	cfg.FastVersion = true
+	cfg.PostCmd = "notify-send %%o"
+	cfg.IntroFrames = map[string]IntroBoundaries{"fast_testvideo": {Begin: "op_begin.png", End: "op_end.png"}}
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, DryRun: true}
+	pipeline, err := PipelineFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob("testvideo2.mkv", cfg)
+	job.Plan = &Plan{Input: job.Input}
+	if err := pipeline.Run(job); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for _, call := range fake.Invocations() {
+		if call.Name == "ffmpeg" {
+			t.Errorf("dry run ran %s", call)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("dry run wrote %v", entries)
+	}
+
+	plan := job.Plan
+	wantTracks := []PlannedTrack{
+		{Role: "video", ID: 0, Codec: "AVC/H.264/MPEG-4p10", Language: "und"},
+		{Role: "audio", ID: 1, Codec: "AAC", Language: "ja"},
+		{Role: "subtitles", ID: 4, Codec: "SubStationAlpha", Language: "en", Name: "Full Subtitles"},
+	}
+	if !reflect.DeepEqual(plan.Tracks, wantTracks) {
+		t.Errorf("Tracks = %+v, want %+v", plan.Tracks, wantTracks)
+	}
+	if plan.SubtitleType != "ass" {
+		t.Errorf("SubtitleType = %s, want ass", plan.SubtitleType)
+	}
+	// extract, encode, two for the fast version, two frame searches and three to cut.
+	if len(plan.Commands) != 9 {
+		t.Fatalf("planned %d commands, want 9:\n%s", len(plan.Commands), strings.Join(plan.Commands, "\n"))
+	}
+	if !strings.Contains(plan.Commands[1], "subtitles=") {
+		t.Errorf("second command doesn't burn in the subs: %s", plan.Commands[1])
+	}
+	if plan.Intro == nil || plan.Intro.Begin != "op_begin.png" {
+		t.Errorf("Intro = %v, want the configured boundaries", plan.Intro)
+	}
+	final := path.Join(cfg.TargetDirectory, "FAST_testvideo2_NOINTRO.mp4")
+	wantOutputs := []string{path.Join(cfg.TargetDirectory, "FAST_testvideo2.mp4"), final}
+	if !reflect.DeepEqual(plan.Outputs, wantOutputs) {
+		t.Errorf("Outputs = %v, want %v", plan.Outputs, wantOutputs)
+	}
+	if plan.PostCmd != "notify-send "+final {
+		t.Errorf("PostCmd = %q, want the published output substituted", plan.PostCmd)
+	}
+	if plan.Original != path.Join(cfg.OriginalsDirectory, "testvideo2.mkv") {
+		t.Errorf("Original = %s", plan.Original)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	plan := &Plan{
+		Input:        "show_01.mkv",
+		Tracks:       []PlannedTrack{{Role: "video", ID: 0, Codec: "HEVC"}, {Role: "subtitles", ID: -1}},
+		SubtitleType: "srt",
+		Commands:     []string{"ffmpeg -i show_01.mkv out.mp4"},
+		Outputs:      []string{"converted/show_01.mp4"},
+	}
+	var text bytes.Buffer
+	printPlan(&text, plan, false)
+	for _, want := range []string{"show_01.mkv\n", "video:     #0 HEVC\n", "subtitles: none\n", "    ffmpeg -i show_01.mkv out.mp4\n", "output:    converted/show_01.mp4\n"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text plan doesn't contain %q:\n%s", want, text.String())
+		}
+	}
+	var raw bytes.Buffer
+	printPlan(&raw, plan, true)
+	var decoded Plan
+	if err := json.Unmarshal(raw.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, plan) {
+		t.Errorf("JSON plan = %+v, want %+v", decoded, plan)
+	}
+}
+
+func TestPicturePlan(t *testing.T) {
+	dir := t.TempDir()
+	video := path.Join(dir, "show_01.mp4")
+	// forced signs first, so the full subs we want are the second subtitle stream.
+	useFakeRunner(t, FakeResponse{
+		Name: "ffprobe",
+		Args: append(ffprobe_args, video),
+		Stdout: `{"streams": [
+			{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1280, "height": 720},
+			{"index": 1, "codec_name": "aac", "codec_type": "audio", "channels": 2, "tags": {"language": "jpn"}},
+			{"index": 2, "codec_name": "hdmv_pgs_subtitle", "codec_type": "subtitle", "width": 1920, "height": 1080, "disposition": {"forced": 1}, "tags": {"language": "eng"}},
+			{"index": 3, "codec_name": "hdmv_pgs_subtitle", "codec_type": "subtitle", "width": 1920, "height": 1080, "tags": {"language": "eng"}}],
+			"format": {"filename": "` + video + `", "duration": "60.000000"}}`,
+	})
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = path.Join(dir, "converted")
+	cfg.Stages = "selecttracks,extractsubs,encode"
+	cfg.ForOldDevices = true
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, DryRun: true}
+	pipeline, err := PipelineFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob(video, cfg)
+	job.Plan = &Plan{Input: video}
+	if err := pipeline.Run(job); err != nil {
+		t.Fatal(err)
+	}
+	encode := job.Plan.Commands[len(job.Plan.Commands)-1]
+	for _, want := range []string{
+		"'[0:s:1]scale=1280:720[subs];[0:0][subs]overlay[v]'",
+		"-map '[v]' -map 0:1 -c:a aac",
+		strings.Join(oldDevicesOptions, " "),
+	} {
+		if !strings.Contains(encode, want) {
+			t.Errorf("encode command doesn't contain %q: %s", want, encode)
+		}
+	}
+	if strings.Contains(encode, "-map 0:0") {
+		t.Errorf("encode command maps the video without the subs too: %s", encode)
+	}
+}
+
+func TestPicturePlanWithCover(t *testing.T) {
+	dir := t.TempDir()
+	video := path.Join(dir, "show_01.mkv")
+	// the cover picture comes first, [0:v] would pick it.
+	useFakeRunner(t, FakeResponse{
+		Name: "ffprobe",
+		Args: append(ffprobe_args, video),
+		Stdout: `{"streams": [
+			{"index": 0, "codec_name": "mjpeg", "codec_type": "video", "width": 600, "height": 600, "disposition": {"attached_pic": 1}},
+			{"index": 1, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080},
+			{"index": 2, "codec_name": "aac", "codec_type": "audio", "channels": 2, "tags": {"language": "jpn"}},
+			{"index": 3, "codec_name": "hdmv_pgs_subtitle", "codec_type": "subtitle", "width": 1920, "height": 1080, "tags": {"language": "eng"}}],
+			"format": {"filename": "` + video + `", "duration": "60.000000"}}`,
+	})
+	mkvmergeMissing = true
+	t.Cleanup(func() { mkvmergeMissing = false })
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = path.Join(dir, "converted")
+	cfg.Stages = "selecttracks,extractsubs,encode"
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, DryRun: true}
+	pipeline, err := PipelineFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob(video, cfg)
+	job.Plan = &Plan{Input: video}
+	if err := pipeline.Run(job); err != nil {
+		t.Fatal(err)
+	}
+	encode := job.Plan.Commands[len(job.Plan.Commands)-1]
+	if want := "'[0:1][0:s:0]overlay[v]'"; !strings.Contains(encode, want) {
+		t.Errorf("encode command doesn't contain %q: %s", want, encode)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Profile is a kind of output video: the container, the codecs in it and how to encode them.
+type Profile struct {
+	Name      string `koanf:"-" toml:"-"`
+	Container string `koanf:"container" toml:"container"` // mp4, mkv or webm
+	Video     string `koanf:"video" toml:"video"`         // h264, hevc, av1 or vp9
+	Audio     string `koanf:"audio" toml:"audio"`         // aac, opus or copy, empty for the usual one in the container
+	Crf       int    `koanf:"crf" toml:"crf"`             // used when the crf setting is 0, 0 for the usual one of the codec
+	Compat    bool   `koanf:"compat" toml:"compat"`       // plays on old devices, see oldDevicesOptions
+}
+
+// the profiles everyone has, next to the ones in the profiles setting.
+var builtinProfiles = map[string]Profile{
+	"mp4-h264":        {Container: "mp4", Video: "h264", Audio: "aac", Crf: 18},
+	"mp4-h264-compat": {Container: "mp4", Video: "h264", Audio: "aac", Crf: 18, Compat: true},
+	"mp4-hevc":        {Container: "mp4", Video: "hevc", Audio: "aac", Crf: 18},
+	"mkv-h264":        {Container: "mkv", Video: "h264", Audio: "copy", Crf: 18},
+	"mkv-hevc":        {Container: "mkv", Video: "hevc", Audio: "copy", Crf: 18},
+	"webm-av1":        {Container: "webm", Video: "av1", Audio: "opus", Crf: 30},
+	"webm-vp9":        {Container: "webm", Video: "vp9", Audio: "opus", Crf: 31},
+}
+
+// containerCodecs are the codecs we can put in each container, the first audio codec is the usual one.
+// Copying the audio only works in mkv, the others can't hold every audio codec.
+var containerCodecs = map[string]struct{ video, audio []string }{
+	"mp4":  {video: []string{"h264", "hevc", "av1", "vp9"}, audio: []string{"aac", "opus"}},
+	"mkv":  {video: []string{"h264", "hevc", "av1", "vp9"}, audio: []string{"copy", "aac", "opus"}},
+	"webm": {video: []string{"av1", "vp9"}, audio: []string{"opus"}},
+}
+
+// the crf the built-in profiles use for each video codec, for the profiles in the settings without one.
+var codecCrf = map[string]int{"h264": 18, "hevc": 18, "av1": 30, "vp9": 31}
+
+// the ffmpeg encoders for the audio codecs.
+var audioEncoders = map[string]string{"aac": "aac", "opus": "libopus", "copy": "copy"}
+
+// outputProfile is the profile the config asks for. Without a profile setting,
+// it's made from the mkv, h265 and forolddevices settings we had before the profiles.
+func outputProfile(config Config) (Profile, error) {
+	if config.Profile == "" {
+		profile := legacyProfile(config)
+		return profile, profile.validate()
+	}
+	profile, ok := config.Profiles[config.Profile]
+	if !ok {
+		profile, ok = builtinProfiles[config.Profile]
+	}
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q, use one of %s", config.Profile, strings.Join(profileNames(config), ", "))
+	}
+	profile.Name = config.Profile
+	if profile.Audio == "" && containerCodecs[profile.Container].audio != nil {
+		profile.Audio = containerCodecs[profile.Container].audio[0]
+	}
+	if profile.Crf == 0 {
+		// a crf of 0 is lossless for most encoders, that's not what leaving it out means.
+		profile.Crf = codecCrf[profile.Video]
+	}
+	return profile, profile.validate()
+}
+
+func legacyProfile(config Config) Profile {
+	profile := Profile{Container: "mp4", Video: "h264", Audio: "aac", Crf: 18, Compat: config.ForOldDevices}
+	if config.Mkv {
+		profile.Container, profile.Audio = "mkv", "copy"
+	}
+	if config.H265 {
+		profile.Video = "hevc"
+	}
+	profile.Name = profile.Container + "-" + profile.Video
+	return profile
+}
+
+// profileNames lists the built-in profiles and the ones in the profiles setting.
+func profileNames(config Config) []string {
+	var names []string
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	for name := range config.Profiles {
+		if _, builtin := builtinProfiles[name]; !builtin {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks the container can hold the codecs.
+func (p Profile) validate() error {
+	codecs, ok := containerCodecs[p.Container]
+	if !ok {
+		return fmt.Errorf("profile %s: unknown container %q, use mp4, mkv or webm", p.Name, p.Container)
+	}
+	if !slices.Contains(codecs.video, p.Video) {
+		return fmt.Errorf("profile %s: %s can't hold %q video, only %s", p.Name, p.Container, p.Video, strings.Join(codecs.video, ", "))
+	}
+	if !slices.Contains(codecs.audio, p.Audio) {
+		return fmt.Errorf("profile %s: %s can't hold %q audio, use %s", p.Name, p.Container, p.Audio, strings.Join(codecs.audio, ", "))
+	}
+	if p.Compat && (p.Container != "mp4" || p.Video != "h264" || p.Audio != "aac") {
+		return fmt.Errorf("profile %s: only mp4 with h264 and aac works on old devices", p.Name)
+	}
+	return nil
+}
+
+// Extension is the extension of the videos the profile makes.
+func (p Profile) Extension() string {
+	return "." + p.Container
+}
+
+// encoding makes a command encode the video with the encoder at the rate and the audio the way the profile says.
+func (p Profile) encoding(encoder Encoder, rate RateControl, config Config) outputEncoding {
+	return func(cmd *FFmpegCommand) *FFmpegCommand {
+		cmd.Options("-c:a", audioEncoders[p.Audio])
+		if rate.AudioBitrate > 0 && p.Audio != "copy" {
+			cmd.Options("-b:a", kbit(rate.AudioBitrate))
+		}
+		encoder.apply(cmd, config, rate)
+		if p.Compat {
+			cmd.Options(oldDevicesOptions...)
+		}
+		return cmd
+	}
+}
+
+// crf is the crf setting, or the one of the profile when that's 0.
+func (c Config) crf() int {
+	if c.Crf != 0 {
+		return c.Crf
+	}
+	if profile, err := outputProfile(c); err == nil {
+		return profile.Crf
+	}
+	return 18
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOutputProfile(t *testing.T) {
+	mine := map[string]Profile{
+		"small":    {Container: "webm", Video: "av1", Crf: 40},
+		"mp4-h264": {Container: "mp4", Video: "h264", Audio: "opus"},
+		"mpg":      {Container: "mpg", Video: "mpeg2"},
+		"webmh264": {Container: "webm", Video: "h264"},
+		"mp4copy":  {Container: "mp4", Video: "hevc", Audio: "copy"},
+		"compat":   {Container: "mkv", Video: "h264", Compat: true},
+	}
+	tests := []struct {
+		name    string
+		config  Config
+		want    Profile
+		wantErr string
+	}{
+		{"legacy", Config{}, Profile{Name: "mp4-h264", Container: "mp4", Video: "h264", Audio: "aac", Crf: 18}, ""},
+		{"legacy mkv h265", Config{Mkv: true, H265: true}, Profile{Name: "mkv-hevc", Container: "mkv", Video: "hevc", Audio: "copy", Crf: 18}, ""},
+		{"legacy old devices", Config{ForOldDevices: true}, Profile{Name: "mp4-h264", Container: "mp4", Video: "h264", Audio: "aac", Crf: 18, Compat: true}, ""},
+		{"legacy old devices h265", Config{ForOldDevices: true, H265: true}, Profile{}, "only mp4 with h264 and aac"},
+		{"profile wins", Config{Profile: "webm-vp9", Mkv: true}, Profile{Name: "webm-vp9", Container: "webm", Video: "vp9", Audio: "opus", Crf: 31}, ""},
+		{"mine", Config{Profile: "small", Profiles: mine}, Profile{Name: "small", Container: "webm", Video: "av1", Audio: "opus", Crf: 40}, ""},
+		{"mine wins", Config{Profile: "mp4-h264", Profiles: mine}, Profile{Name: "mp4-h264", Container: "mp4", Video: "h264", Audio: "opus", Crf: 18}, ""},
+		{"unknown", Config{Profile: "flv", Profiles: mine}, Profile{}, `unknown profile "flv", use one of compat, mkv-h264`},
+		{"unknown container", Config{Profile: "mpg", Profiles: mine}, Profile{}, `unknown container "mpg"`},
+		{"video not in container", Config{Profile: "webmh264", Profiles: mine}, Profile{}, `webm can't hold "h264" video`},
+		{"copy in mp4", Config{Profile: "mp4copy", Profiles: mine}, Profile{}, `mp4 can't hold "copy" audio`},
+		{"compat mkv", Config{Profile: "compat", Profiles: mine}, Profile{}, "only mp4 with h264 and aac"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := outputProfile(tt.config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("outputProfile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("outputProfile() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileEncoding(t *testing.T) {
+	tests := []struct {
+		config Config
+		want   string
+	}{
+		{Config{Profile: "mp4-h264-compat", H26xPreset: "fast", H26xTune: "none"}, "ffmpeg -i in.mkv -c:a aac -c:v libx264 -crf 18 -preset fast -profile:v baseline"},
+		{Config{Profile: "webm-av1", H26xPreset: "slow"}, "ffmpeg -i in.mkv -c:a libopus -c:v libsvtav1 -crf 30 -preset 5 out"},
+		{Config{Profile: "webm-vp9", Crf: 28}, "ffmpeg -i in.mkv -c:a libopus -c:v libvpx-vp9 -crf 28 -b:v 0"},
+		{Config{Mkv: true, H26xPreset: "medium", H26xTune: "animation"}, "ffmpeg -i in.mkv -c:a copy -c:v libx264 -crf 18 -preset medium -tune animation out"},
+		// without a crf, the profile uses the one of the codec instead of a lossless 0.
+		{Config{Profile: "small", Profiles: map[string]Profile{"small": {Container: "mkv", Video: "hevc"}}, H26xPreset: "slow", H26xTune: "none"}, "ffmpeg -i in.mkv -c:a copy -c:v libx265 -crf 18 -preset slow"},
+		{Config{Profile: "tiny", Profiles: map[string]Profile{"tiny": {Container: "webm", Video: "av1"}}, H26xPreset: "slow"}, "ffmpeg -i in.mkv -c:a libopus -c:v libsvtav1 -crf 30"},
+	}
+	for _, tt := range tests {
+		profile, err := outputProfile(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder, err := configuredEncoder(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encode := profile.encoding(encoder, RateControl{Mode: rateCrf}, tt.config)
+		if got := encode(NewFFmpegCommand().Input("in.mkv")).Output("out").String(); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: got %s, want it to start with %s", profile.Name, got, tt.want)
+		}
+	}
+}
+
+func TestProfilesSetting(t *testing.T) {
+	keepConfig(t)
+	dir := t.TempDir()
+	userConfig := filepath.Join(dir, "hardsub.toml")
+	os.WriteFile(userConfig, []byte("profile = \"small\"\n[profiles.small]\ncontainer = \"webm\"\nvideo = \"av1\"\ncrf = 40\n"), 0o644)
+	if err := resolveConfig(userConfig, dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := outputProfile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Profile{Name: "small", Container: "webm", Video: "av1", Audio: "opus", Crf: 40}); profile != want {
+		t.Errorf("profile = %+v, want %+v", profile, want)
+	}
+}
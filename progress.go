@@ -0,0 +1,317 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+type ProgressKind int
+
+const (
+	ProgressBegin  ProgressKind = iota // ffmpeg starts
+	ProgressUpdate                     // ffmpeg wrote a block of -progress output
+	ProgressEnd                        // ffmpeg stopped
+)
+
+// ProgressEvent is how far along an ffmpeg run is, from what it writes with -progress.
+type ProgressEvent struct {
+	Kind        ProgressKind
+	Description string        // the file the run works on
+	Done        time.Duration // how much of the output is done, out_time_us
+	Total       time.Duration // the duration of the container, 0 when we don't know
+	Fps         float64       // the frames per second ffmpeg does
+	Speed       float64       // how much faster than realtime ffmpeg goes, 0 when it doesn't know yet
+	Size        int64         // the bytes written so far, total_size
+	Elapsed     time.Duration // since the run started
+	Pass        int           // the pass of a multi-pass encode, from 0
+	Passes      int           // 0 or 1 for a single run
+	Failed      bool          // the run ended with an error, on ProgressEnd
+}
+
+// update reads a line of the -progress output into the event, and tells if it ended a block.
+func (e *ProgressEvent) update(line string) bool {
+	key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+	if !ok {
+		return false
+	}
+	value = strings.TrimSpace(value)
+	switch key {
+	case "out_time_us":
+		// it's N/A or negative before the first frame.
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			e.Done = time.Duration(us) * time.Microsecond
+		}
+	case "fps":
+		if fps, err := strconv.ParseFloat(value, 64); err == nil {
+			e.Fps = fps
+		}
+	case "speed":
+		if speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+			e.Speed = speed
+		}
+	case "total_size":
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+			e.Size = size
+		}
+	case "progress":
+		return true
+	}
+	return false
+}
+
+func (e ProgressEvent) passes() int {
+	return max(e.Passes, 1)
+}
+
+// runFraction is the part of this run that's done.
+func (e ProgressEvent) runFraction() float64 {
+	if e.Total <= 0 {
+		return 0
+	}
+	return math.Min(float64(e.Done)/float64(e.Total), 1)
+}
+
+// Fraction is the part of all passes that's done.
+func (e ProgressEvent) Fraction() float64 {
+	return (float64(e.Pass) + e.runFraction()) / float64(e.passes())
+}
+
+// ETA is how long the passes still take at the speed ffmpeg goes now.
+func (e ProgressEvent) ETA() (time.Duration, bool) {
+	if e.Speed <= 0 || e.Total <= 0 {
+		return 0, false
+	}
+	left := e.Total*time.Duration(e.passes()-e.Pass) - e.Done
+	return time.Duration(float64(max(left, 0)) / e.Speed), true
+}
+
+// ProjectedSize is how big the output gets when the rest goes like what's done.
+func (e ProgressEvent) ProjectedSize() (int64, bool) {
+	if e.Size <= 0 || e.Done <= 0 || e.Total <= 0 {
+		return 0, false
+	}
+	return int64(float64(e.Size) / e.runFraction()), true
+}
+
+// Summary tells people the speed, the time left and the size of the output.
+func (e ProgressEvent) Summary() string {
+	var parts []string
+	if e.Speed > 0 {
+		parts = append(parts, fmt.Sprintf("%.1fx", e.Speed))
+	}
+	eta := "?"
+	if left, ok := e.ETA(); ok {
+		eta = left.Round(time.Second).String()
+	}
+	parts = append(parts, "eta "+eta)
+	if size, ok := e.ProjectedSize(); ok {
+		parts = append(parts, fmt.Sprintf("~%d MB", size>>20))
+	}
+	return strings.Join(append(parts, path.Base(e.Description)), " ")
+}
+
+// ProgressReporter gets the progress events of the ffmpeg runs.
+type ProgressReporter interface {
+	Report(event ProgressEvent)
+}
+
+// ProgressFunc lets a function subscribe to progress events.
+type ProgressFunc func(event ProgressEvent)
+
+func (f ProgressFunc) Report(event ProgressEvent) { f(event) }
+
+// ProgressStream hands the progress events of a job to everything that subscribed to them,
+// like the progress bars and the log.
+type ProgressStream struct {
+	mu          sync.Mutex
+	subscribers []ProgressReporter
+}
+
+func NewProgressStream(subscribers ...ProgressReporter) *ProgressStream {
+	s := &ProgressStream{}
+	for _, subscriber := range subscribers {
+		s.Subscribe(subscriber)
+	}
+	return s
+}
+
+func (s *ProgressStream) Subscribe(subscriber ProgressReporter) {
+	if subscriber == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, subscriber)
+}
+
+func (s *ProgressStream) Report(event ProgressEvent) {
+	s.mu.Lock()
+	subscribers := append([]ProgressReporter{}, s.subscribers...)
+	s.mu.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber.Report(event)
+	}
+}
+
+// the steps of the terminal progress bar.
+const progressSteps = 1000
+
+// terminalProgress is the single progress bar we show when converting one file at a time.
+type terminalProgress struct {
+	bar *progressbar.ProgressBar
+}
+
+func (p *terminalProgress) Report(event ProgressEvent) {
+	switch event.Kind {
+	case ProgressBegin:
+		p.bar = progressbar.NewOptions(
+			progressSteps,
+			progressbar.OptionUseANSICodes(true),
+			progressbar.OptionSetDescription(event.Description),
+			progressbar.OptionShowElapsedTimeOnFinish(),
+			progressbar.OptionShowDescriptionAtLineEnd(),
+			progressbar.OptionSetRenderBlankState(false),
+		)
+	case ProgressUpdate:
+		if p.bar == nil {
+			return
+		}
+		p.bar.Describe(event.Summary())
+		p.bar.Set(int(event.Fraction() * progressSteps))
+	case ProgressEnd:
+		fmt.Printf("\n")
+	}
+}
+
+// progressLog writes how far along the runs are to the log every quarter, and how they went at the end.
+type progressLog struct {
+	next float64
+}
+
+func (l *progressLog) Report(event ProgressEvent) {
+	switch event.Kind {
+	case ProgressBegin:
+		if event.Pass == 0 {
+			l.next = 0.25
+		}
+	case ProgressUpdate:
+		if fraction := event.Fraction(); fraction >= l.next {
+			Log(fmt.Sprintf("%3.0f%%", fraction*100), event.Summary())
+			l.next = math.Floor(fraction*4+1) / 4
+		}
+	case ProgressEnd:
+		if event.Failed {
+			Log("ffmpeg failed on", event.Description, "after", event.Elapsed.Round(time.Second))
+			return
+		}
+		Log(fmt.Sprintf("ffmpeg did %s in %s at %.1fx, wrote %d MB", path.Base(event.Description),
+			event.Elapsed.Round(time.Second), event.Speed, event.Size>>20))
+	}
+}
+
+// MultiProgress draws a line per worker, so you can follow parallel conversions.
+type MultiProgress struct {
+	mu       sync.Mutex
+	out      io.Writer
+	slots    []progressSlot
+	drawn    int
+	lastDraw time.Time
+}
+
+type progressSlot struct {
+	event  ProgressEvent
+	active bool
+}
+
+func NewMultiProgress(out io.Writer, workers int) *MultiProgress {
+	return &MultiProgress{out: out, slots: make([]progressSlot, workers)}
+}
+
+// Slot returns the reporter for the given worker.
+func (m *MultiProgress) Slot(worker int) ProgressReporter {
+	return &multiProgressSlot{m: m, index: worker}
+}
+
+func (m *MultiProgress) update(index int, f func(*progressSlot), force bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&m.slots[index])
+	if !force && time.Since(m.lastDraw) < 200*time.Millisecond {
+		return
+	}
+	m.lastDraw = time.Now()
+	var sb strings.Builder
+	if m.drawn > 0 {
+		fmt.Fprintf(&sb, "\033[%dA", m.drawn)
+	}
+	for i, slot := range m.slots {
+		sb.WriteString("\r\033[K")
+		sb.WriteString(slot.line(i + 1))
+		sb.WriteString("\n")
+	}
+	m.drawn = len(m.slots)
+	io.WriteString(m.out, sb.String())
+}
+
+func (s progressSlot) line(worker int) string {
+	if !s.active {
+		return fmt.Sprintf("[%d] idle", worker)
+	}
+	const width = 30
+	fraction := s.event.Fraction()
+	done := int(fraction * width)
+	return fmt.Sprintf("[%d] %3.0f%% [%s%s] %s", worker, fraction*100,
+		strings.Repeat("=", done), strings.Repeat(" ", width-done), s.event.Summary())
+}
+
+type multiProgressSlot struct {
+	m     *MultiProgress
+	index int
+}
+
+func (s *multiProgressSlot) Report(event ProgressEvent) {
+	s.m.update(s.index, func(slot *progressSlot) {
+		slot.event, slot.active = event, event.Kind != ProgressEnd
+	}, event.Kind != ProgressUpdate)
+}
+
+// passesProgress shows the passes of a multi-pass encode as a single run on its ProgressReporter.
+type passesProgress struct {
+	ProgressReporter
+	passes int
+	pass   int // the one running now, from 0
+}
+
+func (p *passesProgress) Report(event ProgressEvent) {
+	event.Pass, event.Passes = p.pass, p.passes
+	if event.Kind == ProgressBegin && p.pass > 0 {
+		return
+	}
+	if event.Kind == ProgressEnd && p.pass < p.passes-1 && !event.Failed {
+		return
+	}
+	p.ProgressReporter.Report(event)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressEventUpdate(t *testing.T) {
+	lines := "frame=250\nfps=49.80\nout_time_us=N/A\nout_time_us=10000000\ntotal_size=5242880\nspeed=2.5x\nprogress=continue\n"
+	var event ProgressEvent
+	blocks := 0
+	for _, line := range strings.Split(lines, "\n") {
+		if event.update(line) {
+			blocks++
+		}
+	}
+	want := ProgressEvent{Done: 10 * time.Second, Fps: 49.8, Speed: 2.5, Size: 5 << 20}
+	if blocks != 1 || event != want {
+		t.Errorf("update() = %+v after %d blocks, want %+v after 1", event, blocks, want)
+	}
+	event.update("speed=N/A")
+	if event.Speed != 2.5 {
+		t.Errorf("speed N/A changed the speed to %v", event.Speed)
+	}
+}
+
+func TestProgressEventEstimates(t *testing.T) {
+	event := ProgressEvent{Description: "/in/show_01.mkv", Done: 5 * time.Minute, Total: 20 * time.Minute, Speed: 3, Size: 50 << 20}
+	if eta, ok := event.ETA(); !ok || eta != 5*time.Minute {
+		t.Errorf("ETA() = %v, %v, want 5m", eta, ok)
+	}
+	if size, ok := event.ProjectedSize(); !ok || size != 200<<20 {
+		t.Errorf("ProjectedSize() = %d, %v, want %d", size, ok, 200<<20)
+	}
+	if got, want := event.Summary(), "3.0x eta 5m0s ~200 MB show_01.mkv"; got != want {
+		t.Errorf("Summary() = %q, want %q", got, want)
+	}
+	// the first of two passes counts for half.
+	event.Passes = 2
+	if got := event.Fraction(); got != 0.125 {
+		t.Errorf("Fraction() = %v, want 0.125", got)
+	}
+	if eta, _ := event.ETA(); eta != 11*time.Minute+40*time.Second {
+		t.Errorf("ETA() over two passes = %v, want 11m40s", eta)
+	}
+	if _, ok := (ProgressEvent{Total: time.Minute}).ETA(); ok {
+		t.Error("ETA() without a speed")
+	}
+	if got, want := (ProgressEvent{Description: "a.mkv"}).Summary(), "eta ? a.mkv"; got != want {
+		t.Errorf("Summary() = %q, want %q", got, want)
+	}
+}
+
+func TestProgressStream(t *testing.T) {
+	var first, second []ProgressKind
+	stream := NewProgressStream(ProgressFunc(func(event ProgressEvent) { first = append(first, event.Kind) }), nil)
+	stream.Report(ProgressEvent{Kind: ProgressBegin})
+	stream.Subscribe(ProgressFunc(func(event ProgressEvent) { second = append(second, event.Kind) }))
+	stream.Report(ProgressEvent{Kind: ProgressUpdate})
+	stream.Report(ProgressEvent{Kind: ProgressEnd})
+	if want := []ProgressKind{ProgressBegin, ProgressUpdate, ProgressEnd}; !reflect.DeepEqual(first, want) {
+		t.Errorf("first subscriber got %v, want %v", first, want)
+	}
+	if want := []ProgressKind{ProgressUpdate, ProgressEnd}; !reflect.DeepEqual(second, want) {
+		t.Errorf("second subscriber got %v, want %v", second, want)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BatchResult struct {
+	Input    string
+	Output   string
+	Err      error
+	Duration time.Duration
+}
+
+type BatchSummary struct {
+	Results []BatchResult
+}
+
+func (s BatchSummary) Failed() []BatchResult {
+	var failed []BatchResult
+	for _, r := range s.Results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+func (s BatchSummary) String() string {
+	failed := s.Failed()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Converted %d of %d files", len(s.Results)-len(failed), len(s.Results))
+	if len(failed) > 0 {
+		fmt.Fprintf(&sb, ", %d failed:", len(failed))
+		for _, r := range failed {
+			fmt.Fprintf(&sb, "\n  %s: %s", r.Input, r.Err)
+		}
+	}
+	return sb.String()
+}
+
+type convertFunc func(videofile string, config Config, progress ProgressReporter) (string, error)
+
+// JobQueue converts the files added to it with a pool of workers.
+type JobQueue struct {
+	config   Config
+	convert  convertFunc
+	onDone   func(BatchResult)
+	jobs     chan string
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	results  []BatchResult
+	progress *MultiProgress
+}
+
+// NewJobQueue starts config.Workers workers. onDone gets called for every finished file and can be nil.
+func NewJobQueue(config Config, onDone func(BatchResult)) *JobQueue {
+	var progress *MultiProgress
+	if config.Workers > 1 {
+		progress = NewMultiProgress(os.Stdout, config.Workers)
+	}
+	return newJobQueue(config, convert_file, onDone, progress)
+}
+
+// newJobQueue starts the workers, each showing its progress in a slot of progress when it's not nil.
+func newJobQueue(config Config, convert convertFunc, onDone func(BatchResult), progress *MultiProgress) *JobQueue {
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	q := &JobQueue{
+		config:   config,
+		convert:  convert,
+		onDone:   onDone,
+		jobs:     make(chan string, 500), // large buffer in case we copy a whole bunch of files at once.
+		progress: progress,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work(i)
+	}
+	return q
+}
+
+func (q *JobQueue) work(worker int) {
+	defer q.wg.Done()
+	var progress ProgressReporter
+	if q.progress != nil {
+		progress = q.progress.Slot(worker)
+	}
+	for videofile := range q.jobs {
+		start := time.Now()
+		output, err := q.convert(videofile, q.config, progress)
+		result := BatchResult{Input: videofile, Output: output, Err: err, Duration: time.Since(start)}
+		q.mu.Lock()
+		q.results = append(q.results, result)
+		q.mu.Unlock()
+		if q.onDone != nil {
+			q.onDone(result)
+		}
+	}
+}
+
+func (q *JobQueue) Add(videofile string) {
+	if jobStore != nil {
+		jobStore.Update(videofile, func(r *JobRecord) {
+			// a job that only needs finishing up has to remember that until it runs.
+			if r.State != JobFinishing {
+				r.State = JobQueued
+			}
+		})
+	}
+	q.jobs <- videofile
+}
+
+// Wait stops accepting files, waits for the workers to finish and sums up how it went.
+func (q *JobQueue) Wait() BatchSummary {
+	close(q.jobs)
+	q.wg.Wait()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return BatchSummary{Results: append([]BatchResult{}, q.results...)}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	tests := []struct {
+		name          string
+		workers       int
+		wantParallel  bool
+		wantConverted int
+	}{
+		{"one worker", 1, false, 4},
+		{"three workers", 3, true, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, maxRunning int32
+			convert := func(videofile string, config Config, progress ProgressReporter) (string, error) {
+				now := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if now <= max || atomic.CompareAndSwapInt32(&maxRunning, max, now) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				if strings.HasPrefix(videofile, "bad") {
+					return "", errors.New("broken file")
+				}
+				return "converted/" + videofile, nil
+			}
+			var mu sync.Mutex
+			var done []string
+			q := newJobQueue(Config{Workers: tt.workers}, convert, func(r BatchResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				done = append(done, r.Input)
+			}, nil)
+			for _, f := range []string{"a.mkv", "bad1.mkv", "b.mkv", "c.mkv", "bad2.mkv", "d.mkv"} {
+				q.Add(f)
+			}
+			summary := q.Wait()
+			if len(summary.Results) != 6 || len(done) != 6 {
+				t.Errorf("got %d results and %d callbacks, want 6", len(summary.Results), len(done))
+			}
+			if got := len(summary.Results) - len(summary.Failed()); got != tt.wantConverted {
+				t.Errorf("converted %d files, want %d", got, tt.wantConverted)
+			}
+			if max := int(atomic.LoadInt32(&maxRunning)); max > tt.workers || (tt.wantParallel && max < 2) {
+				t.Errorf("ran %d conversions at the same time with %d workers", max, tt.workers)
+			}
+		})
+	}
+}
+
+func TestBatchSummaryString(t *testing.T) {
+	summary := BatchSummary{Results: []BatchResult{
+		{Input: "a.mkv", Output: "converted/a.mp4"},
+		{Input: "b.mkv", Err: errors.New("exitcode 1")},
+	}}
+	want := "Converted 1 of 2 files, 1 failed:\n  b.mkv: exitcode 1"
+	if got := summary.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestMultiProgress(t *testing.T) {
+	var out bytes.Buffer
+	mp := NewMultiProgress(&out, 2)
+	slot := mp.Slot(1)
+	slot.Report(ProgressEvent{Kind: ProgressBegin, Description: "/incoming/show_01.mkv", Total: time.Minute})
+	if !strings.Contains(out.String(), "[1] idle") || !strings.Contains(out.String(), "[2]   0%") {
+		t.Errorf("unexpected rendering: %q", out.String())
+	}
+	slot.Report(ProgressEvent{Kind: ProgressEnd, Description: "/incoming/show_01.mkv", Total: time.Minute})
+	if !strings.HasSuffix(out.String(), "[2] idle\n") {
+		t.Errorf("slot not idle after the end: %q", out.String())
+	}
+}
+
+func Test_threadOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"unlimited", Config{}, nil},
+		{"x264", Config{ThreadsPerWorker: 4}, []string{"-threads", "4"}},
+		{"x265", Config{ThreadsPerWorker: 4, H265: true}, []string{"-threads", "4", "-x265-params", "pools=4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder, _ := configuredEncoder(tt.config)
+			if got := threadOptions(tt.config, encoder); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("threadOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// the values of the 'ratecontrol' setting.
+const (
+	rateCrf       = "crf"       // a constant quality
+	rateCappedCrf = "cappedcrf" // a constant quality, but never more than maxrate
+	rateAbr       = "abr"       // an average bitrate of videobitrate
+	rateSize      = "size"      // the average bitrate that makes the output fit in targetsize
+	rateQuality   = "quality"   // the highest crf that reaches qualitytarget in samples of the video
+)
+
+// RateControl is how the encoder decides how many bits each part of the video gets.
+type RateControl struct {
+	Mode         string
+	Bitrate      int    // the video kbit/s for abr and size, the cap for cappedcrf
+	AudioBitrate int    // the audio kbit/s from the audiobitrates setting or the size, 0 leaves it to the encoder
+	Pass         int    // 1 or 2 when encoding in two passes
+	PassLog      string // where the first pass leaves what it learned for the second
+}
+
+// the audio kbit/s we ask for when the output has to fit in a size and the audiobitrates setting doesn't say.
+var audioBitrates = map[string]int{"aac": 128, "opus": 96}
+
+// part of the size that goes to the container instead of the video and audio.
+const containerOverhead = 0.02
+
+// rateControlFor is the rate control the config asks for. The bitrate for a size is left for rateControl,
+// it depends on the video.
+func rateControlFor(config Config) (RateControl, error) {
+	rate := RateControl{Mode: config.RateControl}
+	bitrates, err := audioBitratesFor(config)
+	if err != nil {
+		return rate, err
+	}
+	if profile, err := outputProfile(config); err == nil {
+		rate.AudioBitrate = bitrates[profile.Audio]
+	}
+	switch config.RateControl {
+	case rateCrf:
+	case "":
+		rate.Mode = rateCrf
+	case rateCappedCrf:
+		if config.MaxRate <= 0 {
+			return rate, fmt.Errorf("ratecontrol %s needs a maxrate", rateCappedCrf)
+		}
+		rate.Bitrate = config.MaxRate
+	case rateAbr:
+		if config.VideoBitrate <= 0 {
+			return rate, fmt.Errorf("ratecontrol %s needs a videobitrate", rateAbr)
+		}
+		rate.Bitrate = config.VideoBitrate
+	case rateSize:
+		if config.TargetSize <= 0 {
+			return rate, fmt.Errorf("ratecontrol %s needs a targetsize", rateSize)
+		}
+	case rateQuality:
+		if err := checkQualityTarget(config); err != nil {
+			return rate, err
+		}
+	default:
+		return rate, fmt.Errorf("unknown ratecontrol %q, use %s, %s, %s, %s or %s", config.RateControl, rateCrf, rateCappedCrf, rateAbr, rateSize, rateQuality)
+	}
+	return rate, nil
+}
+
+// cutRateControl is the rate control for cutting a piece out of a video outside of a job.
+// There's no input to work out the bitrate for a size or the quality from, so those use the crf.
+func cutRateControl(config Config) (RateControl, error) {
+	rate, err := rateControlFor(config)
+	if rate.Mode == rateSize || rate.Mode == rateQuality {
+		rate = RateControl{Mode: rateCrf}
+	}
+	return rate, err
+}
+
+// sizeBitrate is the video kbit/s that makes a video of duration with audio at audioBitrate fit in size MB.
+func sizeBitrate(size int, duration time.Duration, audioBitrate int) (int, error) {
+	if duration <= 0 {
+		return 0, fmt.Errorf("need the duration of the video to fit it in %d MB", size)
+	}
+	kbits := float64(size) * 1024 * 1024 * 8 / 1000 * (1 - containerOverhead)
+	video := int(kbits/duration.Seconds()) - audioBitrate
+	if video <= 0 {
+		return 0, fmt.Errorf("%v of video doesn't fit in %d MB", duration.Round(time.Second), size)
+	}
+	return video, nil
+}
+
+// rateControl works out the rate control for the job, the bitrate that fits the target size needs
+// the duration of the input and the bitrate of the audio. The quality one picks the crf once, the
+// stages after the encode use the same one.
+func (j *Job) rateControl() (RateControl, error) {
+	rate, err := rateControlFor(j.Config)
+	if err == nil && rate.Mode == rateQuality {
+		crf, err := j.qualityCrf()
+		if err != nil {
+			return rate, err
+		}
+		j.Config.Crf, j.Config.RateControl = crf, rateCrf
+		rate.Mode = rateCrf
+		return rate, nil
+	}
+	if err != nil || rate.Mode != rateSize {
+		return rate, err
+	}
+	info, err := j.mediaInfo()
+	if err != nil {
+		return rate, err
+	}
+	profile, err := outputProfile(j.Config)
+	if err != nil {
+		return rate, err
+	}
+	if rate.AudioBitrate == 0 {
+		rate.AudioBitrate = audioBitrates[profile.Audio]
+	}
+	// every audio track in the output takes its part of the size.
+	audio := 0
+	for _, id := range j.Tracks.audioTracks() {
+		if profile.Audio != "copy" {
+			audio += rate.AudioBitrate
+			continue
+		}
+		copied, err := j.copiedAudioBitrate(id)
+		if err != nil {
+			return rate, err
+		}
+		audio += copied
+	}
+	rate.Bitrate, err = sizeBitrate(j.Config.TargetSize, info.Duration, audio)
+	return rate, err
+}
+
+// copiedAudioBitrate is the kbit/s of the audio track that gets copied into the output.
+func (j *Job) copiedAudioBitrate(id int) (int, error) {
+	mkv, err := j.mediaInfo()
+	if err != nil {
+		return 0, err
+	}
+	probe, err := j.probeInfo()
+	if err != nil {
+		return 0, err
+	}
+	var stream media.Stream
+	if index, ok := media.NewTrackMap(*mkv, *probe).StreamIndex(id); ok {
+		stream, _ = probe.Stream(index)
+	}
+	// matroska keeps it in a tag.
+	for _, bitrate := range []string{stream.BitRate, stream.Tags["BPS"]} {
+		if bps, err := strconv.Atoi(bitrate); err == nil && bps > 0 {
+			return (bps + 999) / 1000, nil
+		}
+	}
+	return 0, fmt.Errorf("can't tell the bitrate of audio track %d to fit %s in %d MB, use a profile that encodes the audio", id, j.Input, j.Config.TargetSize)
+}
+
+// passes are the rate controls of the passes encoding with encoder, the two passes
+// of an average bitrate share a pass log in the workspace.
+func (rate RateControl) passes(encoder Encoder, passlog string) []RateControl {
+	if !encoder.TwoPass || (rate.Mode != rateAbr && rate.Mode != rateSize) {
+		return []RateControl{rate}
+	}
+	first, second := rate, rate
+	first.Pass, first.PassLog = 1, passlog
+	second.Pass, second.PassLog = 2, passlog
+	return []RateControl{first, second}
+}
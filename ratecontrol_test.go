@@ -0,0 +1,164 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncoderRateOptions(t *testing.T) {
+	config := Config{Crf: 20, H26xPreset: "slow", H26xTune: "none", ThreadsPerWorker: 2}
+	capped := RateControl{Mode: rateCappedCrf, Bitrate: 3000}
+	abr := RateControl{Mode: rateAbr, Bitrate: 1500}
+	secondPass := RateControl{Mode: rateAbr, Bitrate: 1500, Pass: 2, PassLog: "/ws/passlog"}
+	tests := []struct {
+		encoder string
+		rate    RateControl
+		want    string
+	}{
+		{"x264", capped, "-c:v libx264 -crf 20 -maxrate 3000k -bufsize 6000k -preset slow -threads 2"},
+		{"x264", abr, "-c:v libx264 -b:v 1500k -preset slow -threads 2"},
+		{"x264", secondPass, "-c:v libx264 -b:v 1500k -preset slow -threads 2 -pass 2 -passlogfile /ws/passlog"},
+		{"x265", secondPass, "-c:v libx265 -b:v 1500k -preset slow -threads 2 -x265-params pools=2:pass=2:stats=/ws/passlog.log"},
+		{"vp9", capped, "-c:v libvpx-vp9 -crf 20 -b:v 3000k -row-mt 1 -threads 2"},
+		{"vp9", abr, "-c:v libvpx-vp9 -b:v 1500k -row-mt 1 -threads 2"},
+		{"hevc_nvenc", capped, "-c:v hevc_nvenc -rc vbr -cq 20 -maxrate 3000k -bufsize 6000k -b:v 0"},
+		{"h264_vaapi", abr, "-c:v h264_vaapi -b:v 1500k"},
+	}
+	for _, tt := range tests {
+		encoder, _ := encoderNamed(tt.encoder)
+		if got := strings.Join(encoder.Options(config, tt.rate), " "); got != tt.want {
+			t.Errorf("%s %s pass %d: got %s, want %s", tt.encoder, tt.rate.Mode, tt.rate.Pass, got, tt.want)
+		}
+	}
+}
+
+func TestRateControlFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		want    RateControl
+		wantErr string
+	}{
+		{"default", Config{}, RateControl{Mode: rateCrf}, ""},
+		{"capped", Config{RateControl: rateCappedCrf, MaxRate: 4000}, RateControl{Mode: rateCappedCrf, Bitrate: 4000}, ""},
+		{"capped without maxrate", Config{RateControl: rateCappedCrf}, RateControl{}, "needs a maxrate"},
+		{"abr", Config{RateControl: rateAbr, VideoBitrate: 2000}, RateControl{Mode: rateAbr, Bitrate: 2000}, ""},
+		{"abr without bitrate", Config{RateControl: rateAbr, MaxRate: 2000}, RateControl{}, "needs a videobitrate"},
+		{"size without size", Config{RateControl: rateSize}, RateControl{}, "needs a targetsize"},
+		{"quality", Config{RateControl: rateQuality, QualityMetric: metricVmaf, QualityTarget: 95}, RateControl{Mode: rateQuality}, ""},
+		{"ssim above 1", Config{RateControl: rateQuality, QualityMetric: metricSsim, QualityTarget: 95}, RateControl{}, "between 0 and 1"},
+		{"quality without target", Config{RateControl: rateQuality, QualityMetric: metricVmaf}, RateControl{}, "needs a qualitytarget"},
+		{"unknown metric", Config{RateControl: rateQuality, QualityMetric: "psnr", QualityTarget: 40}, RateControl{}, `unknown qualitymetric "psnr"`},
+		{"unknown", Config{RateControl: "vbr"}, RateControl{}, `unknown ratecontrol "vbr"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rateControlFor(tt.config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("rateControlFor() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("rateControlFor() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSizeBitrate(t *testing.T) {
+	// 100 MB is 838861 kbit, 822084 without the container's part, over 10 minutes.
+	if got, err := sizeBitrate(100, 10*time.Minute, 128); err != nil || got != 1370-128 {
+		t.Errorf("sizeBitrate() = %d, %v, want %d", got, err, 1370-128)
+	}
+	if _, err := sizeBitrate(1, time.Hour, 128); err == nil {
+		t.Error("an hour doesn't fit in a MB")
+	}
+	if _, err := sizeBitrate(100, 0, 128); err == nil {
+		t.Error("want an error without a duration")
+	}
+}
+
+func TestTwoPassPlan(t *testing.T) {
+	useRecordedRunner(t, "testdata/testvideo2.json")
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = t.TempDir()
+	cfg.Stages = "selecttracks,extractsubs,encode"
+	cfg.RateControl = rateSize
+	cfg.TargetSize = 100
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, DryRun: true}
+	pipeline, err := PipelineFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob("testvideo2.mkv", cfg)
+	job.Plan = &Plan{Input: job.Input}
+	if err := pipeline.Run(job); err != nil {
+		t.Fatal(err)
+	}
+	commands := job.Plan.Commands
+	if len(commands) != 3 {
+		t.Fatalf("planned %d commands, want the extraction and two passes:\n%s", len(commands), strings.Join(commands, "\n"))
+	}
+	// the 23:40 of testvideo2 in 100 MB, with 128 kbit/s aac.
+	passlog := path.Join(cfg.TargetDirectory, ".hardsub-dryrun", "passlog")
+	first, second := commands[1], commands[2]
+	for _, want := range []string{"-b:a 128k", "-b:v 450k", "-pass 1 -passlogfile " + passlog, "-an -f null " + os.DevNull} {
+		if !strings.Contains(first, want) {
+			t.Errorf("first pass doesn't contain %q: %s", want, first)
+		}
+	}
+	if !strings.Contains(second, "-pass 2 -passlogfile "+passlog) || !strings.HasSuffix(second, "testvideo2.mp4") {
+		t.Errorf("second pass doesn't write the output with the pass log: %s", second)
+	}
+}
+
+type recordedProgress struct {
+	calls []string
+}
+
+func (p *recordedProgress) Report(event ProgressEvent) {
+	switch event.Kind {
+	case ProgressBegin:
+		p.calls = append(p.calls, "begin "+event.Description)
+	case ProgressUpdate:
+		p.calls = append(p.calls, fmt.Sprintf("%.0f%%", event.Fraction()*100))
+	case ProgressEnd:
+		p.calls = append(p.calls, "end")
+	}
+}
+
+func TestPassesProgress(t *testing.T) {
+	useFakeRunner(t, FakeResponse{Name: "ffmpeg", Stderr: "out_time_us=100000000\nprogress=continue\nout_time_us=200000000\nprogress=end\n"})
+	progress := &recordedProgress{}
+	job := &Job{Progress: progress}
+	passes := []*FFmpegCommand{NewFFmpegCommand().Output("pass1"), NewFFmpegCommand().Output("pass2")}
+	if err := job.ffmpegPasses(passes, VideoProperties{Filename: "in.mkv", Duration: 200 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"begin in.mkv", "25%", "50%", "75%", "100%", "end"}
+	if !reflect.DeepEqual(progress.calls, want) {
+		t.Errorf("progress = %q, want %q", progress.calls, want)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ToolRunner runs the external tools we depend on. (ffmpeg, ffprobe, mkvmerge, ...)
+type ToolRunner interface {
+	// Run runs the tool to completion, copying its output to stdout and stderr, which can be nil.
+	// A non-zero exit code is returned as an *ExitError.
+	Run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error
+}
+
+// tools is the ToolRunner used for everything, tests replace it with a FakeRunner.
+var tools ToolRunner = ExecRunner{}
+
+type ExitError struct {
+	Name string
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s: exitcode %d", e.Name, e.Code)
+}
+
+// ExecRunner runs the real executables found on $PATH.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Name: name, Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// toolOutput runs the tool and returns what it wrote to stdout. When the tool fails, the error is a *ToolError.
+func toolOutput(name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	stderr := newStderrTail(stderrTailLines)
+	if err := tools.Run(context.Background(), name, args, &stdout, stderr); err != nil {
+		return nil, toolError(name, args, err, stderr)
+	}
+	return stdout.Bytes(), nil
+}
+
+// streamTool runs the tool and hands its stderr to handle while it's running.
+// Cancel the context to stop the tool early. When the tool fails, the error is a *ToolError.
+func streamTool(ctx context.Context, name string, args []string, handle func(stderr io.Reader)) error {
+	pr, pw := io.Pipe()
+	stderr := newStderrTail(stderrTailLines)
+	done := make(chan error, 1)
+	go func() {
+		err := tools.Run(ctx, name, args, nil, io.MultiWriter(pw, stderr))
+		pw.Close()
+		done <- err
+	}()
+	handle(pr)
+	io.Copy(io.Discard, pr) // the tool blocks on a full pipe if handle stopped reading early.
+	return toolError(name, args, <-done, stderr)
+}
+
+// FakeResponse is the canned output for one invocation of a tool.
+type FakeResponse struct {
+	Name     string   `json:"name"`
+	Args     []string `json:"args,omitempty"` // nil matches any arguments
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	ExitCode int      `json:"exitcode,omitempty"`
+}
+
+func (r FakeResponse) matches(name string, args []string) bool {
+	if r.Name != name {
+		return false
+	}
+	return r.Args == nil || reflect.DeepEqual(r.Args, args)
+}
+
+type ToolInvocation struct {
+	Name string
+	Args []string
+}
+
+func (ti ToolInvocation) String() string {
+	return ti.Name + " " + strings.Join(ti.Args, " ")
+}
+
+// FakeRunner replays canned responses instead of running anything, and records what was asked of it.
+// The first response matching the tool and its arguments is used.
+type FakeRunner struct {
+	mu        sync.Mutex
+	Responses []FakeResponse
+	Calls     []ToolInvocation
+}
+
+// LoadFakeRunner reads the responses saved by a RecordingRunner.
+func LoadFakeRunner(filename string) (*FakeRunner, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var responses []FakeResponse
+	if err := json.Unmarshal(raw, &responses); err != nil {
+		return nil, fmt.Errorf("could not unmarshal fake responses from %s: %w", filename, err)
+	}
+	return &FakeRunner{Responses: responses}, nil
+}
+
+func (f *FakeRunner) Run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+	f.mu.Lock()
+	f.Calls = append(f.Calls, ToolInvocation{Name: name, Args: append([]string{}, args...)})
+	var response *FakeResponse
+	for i := range f.Responses {
+		if f.Responses[i].matches(name, args) {
+			response = &f.Responses[i]
+			break
+		}
+	}
+	f.mu.Unlock()
+	if response == nil {
+		return fmt.Errorf("fake runner: no response for %s %s", name, strings.Join(args, " "))
+	}
+	if stdout != nil {
+		io.WriteString(stdout, response.Stdout)
+	}
+	if stderr != nil {
+		io.WriteString(stderr, response.Stderr)
+	}
+	if response.ExitCode != 0 {
+		return &ExitError{Name: name, Code: response.ExitCode}
+	}
+	return ctx.Err()
+}
+
+// Invocations returns the calls made so far, safe to use while tools are running.
+func (f *FakeRunner) Invocations() []ToolInvocation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ToolInvocation{}, f.Calls...)
+}
+
+// RecordingRunner runs the tools with Runner and saves every response to Filename,
+// so a real run can be replayed later with LoadFakeRunner.
+type RecordingRunner struct {
+	Runner   ToolRunner
+	Filename string
+	mu       sync.Mutex
+	recorded []FakeResponse
+}
+
+func (r *RecordingRunner) Run(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+	var outBuf, errBuf bytes.Buffer
+	err := r.Runner.Run(ctx, name, args, teeWriter(stdout, &outBuf), teeWriter(stderr, &errBuf))
+	response := FakeResponse{
+		Name:   name,
+		Args:   append([]string{}, args...),
+		Stdout: outBuf.String(),
+		Stderr: errBuf.String(),
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		response.ExitCode = exitErr.Code
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded = append(r.recorded, response)
+	if saveErr := r.save(); saveErr != nil {
+		LogErrorln("could not save recorded tool output:", saveErr)
+	}
+	return err
+}
+
+func (r *RecordingRunner) save() error {
+	raw, err := json.MarshalIndent(r.recorded, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.Filename, raw, 0o644)
+}
+
+func teeWriter(w io.Writer, buf *bytes.Buffer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(w, buf)
+}
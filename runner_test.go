@@ -0,0 +1,233 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFakeRunner makes all tools run by the test use the given responses.
+func useFakeRunner(t *testing.T, responses ...FakeResponse) *FakeRunner {
+	t.Helper()
+	fake := &FakeRunner{Responses: responses}
+	previous := tools
+	tools = fake
+	t.Cleanup(func() { tools = previous })
+	return fake
+}
+
+// useRecordedRunner makes all tools run by the test replay the responses in filename.
+func useRecordedRunner(t *testing.T, filename string) *FakeRunner {
+	t.Helper()
+	fake, err := LoadFakeRunner(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := tools
+	tools = fake
+	t.Cleanup(func() { tools = previous })
+	return fake
+}
+
+func TestFakeRunner(t *testing.T) {
+	fake := &FakeRunner{Responses: []FakeResponse{
+		{Name: "ffmpeg", Args: []string{"-version"}, Stdout: "ffmpeg version 6.0"},
+		{Name: "ffmpeg", Stderr: "something broke", ExitCode: 1},
+	}}
+	tests := []struct {
+		name       string
+		tool       string
+		args       []string
+		wantStdout string
+		wantStderr string
+		wantCode   int
+		wantErr    bool
+	}{
+		{"exact arguments", "ffmpeg", []string{"-version"}, "ffmpeg version 6.0", "", 0, false},
+		{"any arguments", "ffmpeg", []string{"-i", "x.mkv"}, "", "something broke", 1, true},
+		{"unknown tool", "mkvmerge", []string{"-J", "x.mkv"}, "", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := fake.Run(context.Background(), tt.tool, tt.args, &stdout, &stderr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var exitErr *ExitError
+			if tt.wantCode != 0 && (!errors.As(err, &exitErr) || exitErr.Code != tt.wantCode) {
+				t.Errorf("Run() error = %v, want exit code %d", err, tt.wantCode)
+			}
+			if stdout.String() != tt.wantStdout || stderr.String() != tt.wantStderr {
+				t.Errorf("Run() wrote %q/%q, want %q/%q", stdout.String(), stderr.String(), tt.wantStdout, tt.wantStderr)
+			}
+		})
+	}
+	if len(fake.Invocations()) != len(tests) {
+		t.Errorf("FakeRunner recorded %d calls, want %d", len(fake.Invocations()), len(tests))
+	}
+}
+
+func TestRecordingRunner(t *testing.T) {
+	filename := path.Join(t.TempDir(), "recorded.json")
+	inner := &FakeRunner{Responses: []FakeResponse{
+		{Name: "mkvmerge", Args: []string{"-J", "a.mkv"}, Stdout: `{"tracks":[]}`},
+		{Name: "ffmpeg", Stderr: "Unknown encoder 'libx265'", ExitCode: 8},
+	}}
+	recorder := &RecordingRunner{Runner: inner, Filename: filename}
+	var stdout bytes.Buffer
+	if err := recorder.Run(context.Background(), "mkvmerge", []string{"-J", "a.mkv"}, &stdout, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != `{"tracks":[]}` {
+		t.Errorf("RecordingRunner did not pass stdout through, got %q", stdout.String())
+	}
+	recorder.Run(context.Background(), "ffmpeg", []string{"-i", "a.mkv"}, nil, nil)
+
+	replay, err := LoadFakeRunner(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FakeResponse{
+		{Name: "mkvmerge", Args: []string{"-J", "a.mkv"}, Stdout: `{"tracks":[]}`},
+		{Name: "ffmpeg", Args: []string{"-i", "a.mkv"}, Stderr: "Unknown encoder 'libx265'", ExitCode: 8},
+	}
+	if !reflect.DeepEqual(replay.Responses, want) {
+		t.Errorf("recorded %v, want %v", replay.Responses, want)
+	}
+}
+
+func TestRunAndParseFfmpeg(t *testing.T) {
+	tests := []struct {
+		name     string
+		response FakeResponse
+		wantErr  string
+	}{
+		{"success", FakeResponse{Name: "ffmpeg", Stderr: "out_time_us=4170000\nspeed=2x\nprogress=continue\nout_time_us=8000000\nprogress=end\n"}, ""},
+		{"failure", FakeResponse{Name: "ffmpeg", Stderr: "Error opening input files", ExitCode: 1}, "ffmpeg: exitcode 1: Error opening input files"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeRunner(t, tt.response)
+			err := RunAndParseFfmpeg([]string{"-i", "input.mkv", "output.mp4"}, VideoProperties{Filename: "input.mkv", Duration: 8 * time.Second})
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("RunAndParseFfmpeg() unexpected error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("RunAndParseFfmpeg() error = %v, want %v", err, tt.wantErr)
+			}
+			want := []ToolInvocation{{Name: "ffmpeg", Args: []string{"-progress", "pipe:2", "-i", "input.mkv", "output.mp4"}}}
+			if !reflect.DeepEqual(fake.Invocations(), want) {
+				t.Errorf("RunAndParseFfmpeg() ran %v, want %v", fake.Invocations(), want)
+			}
+		})
+	}
+}
+
+func TestSearchForFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		stderr  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			"found",
+			"[Parsed_blackframe_1 @ 0x9f27880] frame:2470 pblack:100 pts:103020 t:103.020000 type:I last_keyframe:2448\n",
+			103020 * time.Millisecond,
+			false,
+		},
+		{"not found", "frame=34047 fps=400\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeRunner(t, FakeResponse{Name: "ffmpeg", Stderr: tt.stderr})
+			got, err := SearchForFrame("video.mkv", "intro_begin.png")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SearchForFrame() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SearchForFrame() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertWithFakeTools(t *testing.T) {
+	fake := useRecordedRunner(t, "testdata/testvideo2.json")
+	fake.Responses = append(fake.Responses, cannedEncoders(t), FakeResponse{Name: "ffmpeg", Stderr: "frame=34047 fps=400\n"})
+	cfg := DefaultConfig()
+	cfg.ExtractFonts = false
+	cfg.TargetDirectory = t.TempDir()
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1}
+	pipeline, err := NewPipeline("probe", "selecttracks", "extractsubs", "encode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake ffmpeg doesn't write anything, so do it for the encoder.
+	pipeline.Stages = append(pipeline.Stages, fakeStage{name: "fake-encoder", ran: &[]string{}, output: true})
+	job := NewJob("testvideo2.mkv", cfg)
+	if err := pipeline.Run(job); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if want := path.Join(cfg.TargetDirectory, "testvideo2.mp4"); job.OutputFile != want {
+		t.Errorf("OutputFile = %s, want %s", job.OutputFile, want)
+	}
+	var ffmpegCalls []string
+	for _, call := range fake.Invocations() {
+		if call.Name == "ffmpeg" && !reflect.DeepEqual(call.Args, encodersArgs) {
+			ffmpegCalls = append(ffmpegCalls, call.String())
+		}
+	}
+	if len(ffmpegCalls) != 2 {
+		t.Fatalf("expected a subs extraction and an encode, got %v", ffmpegCalls)
+	}
+	if !strings.Contains(ffmpegCalls[0], "-map 0:4 "+path.Join(job.Workspace, "testvideo2.ass")) {
+		t.Errorf("subs extraction didn't use the full subtitles track: %s", ffmpegCalls[0])
+	}
+	if !strings.Contains(ffmpegCalls[1], "-map 0:0 -map 0:1 -vf subtitles="+path.Join(job.Workspace, "testvideo2.ass")) {
+		t.Errorf("encode didn't burn the extracted subs: %s", ffmpegCalls[1])
+	}
+}
+
+func TestFailedEncode(t *testing.T) {
+	fake := useRecordedRunner(t, "testdata/testvideo2.json")
+	fake.Responses = append(fake.Responses, cannedEncoders(t), FakeResponse{Name: "ffmpeg", Stderr: "boom\n", ExitCode: 1})
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = t.TempDir()
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1}
+	pipeline, err := NewPipeline("probe", "selecttracks", "encode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob("testvideo2.mkv", cfg)
+	job.SubsFile = "testvideo2.ass" // instead of extracting them with the failing ffmpeg.
+	err = pipeline.Run(job)
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) || toolErr.ExitCode != 1 {
+		t.Fatalf("Run() error = %v, want the failed ffmpeg run", err)
+	}
+	if FileExists(path.Join(cfg.TargetDirectory, "testvideo2.mp4")) {
+		t.Error("a failed encode got published")
+	}
+}
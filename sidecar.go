@@ -0,0 +1,212 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// the extensions of the subtitle files we can burn in when they're next to the video.
+var sidecarExtensions = []string{"srt", "ass", "ssa", "sup"}
+
+// the values of the 'sidecars' setting.
+const (
+	sidecarsNever    = "never"    // only use the subtitle tracks in the video
+	sidecarsFallback = "fallback" // use a sidecar when the video has no subtitle track we want
+	sidecarsPrefer   = "prefer"   // use a sidecar when there is one we want
+)
+
+// Sidecar is a subtitle file next to a video, named like the video: show_01.srt, show_01.en.srt or show_01.eng.forced.ass.
+type Sidecar struct {
+	Path     string
+	Language string // from the name, empty when the name doesn't have one
+	Codec    string // srt, ass or pgs
+}
+
+// sidecarCodecs maps the extensions of subtitle files to their codec.
+var sidecarCodecs = map[string]string{"srt": "srt", "ass": "ass", "ssa": "ass", "sup": "pgs"}
+
+// SubtitleType tells how we need to handle the sidecar.
+func (s Sidecar) SubtitleType() SubsType {
+	switch s.Codec {
+	case "ass":
+		return SSA_ASS
+	case "pgs":
+		return PICTURE
+	}
+	return SRT
+}
+
+// subtitleFile is the sidecar for a subtitle file given on the command line.
+func subtitleFile(file string) (Sidecar, error) {
+	codec, ok := sidecarCodecs[strings.ToLower(strings.TrimPrefix(path.Ext(file), "."))]
+	if !ok {
+		return Sidecar{}, fmt.Errorf("can't burn in %s, only srt, ass, ssa and sup files", file)
+	}
+	if !FileExists(file) {
+		return Sidecar{}, fmt.Errorf("subtitle file %s doesn't exist", file)
+	}
+	return Sidecar{Path: file, Codec: codec}, nil
+}
+
+// findSidecars lists the subtitle files named like videofile, sorted by name.
+func findSidecars(videofile string) []Sidecar {
+	dir := path.Dir(videofile)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	base := path.Base(videofile)
+	prefix := strings.TrimSuffix(base, path.Ext(base)) + "."
+	var sidecars []Sidecar
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !hasExtension(name, sidecarExtensions) {
+			continue
+		}
+		ext := path.Ext(name)
+		sidecar := Sidecar{Path: path.Join(dir, name), Codec: sidecarCodecs[strings.ToLower(ext[1:])]}
+		// what's between the video name and the extension, like "en" or "eng.forced".
+		middle := strings.TrimPrefix(strings.TrimSuffix(name, ext), strings.TrimSuffix(prefix, "."))
+		for _, part := range strings.Split(strings.TrimPrefix(middle, "."), ".") {
+			if looksLikeLanguage(part) {
+				sidecar.Language = part
+				break
+			}
+		}
+		sidecars = append(sidecars, sidecar)
+	}
+	sort.Slice(sidecars, func(i, j int) bool { return sidecars[i].Path < sidecars[j].Path })
+	return sidecars
+}
+
+// looksLikeLanguage tells if part of a filename is a language code, like en, eng or pt-BR.
+func looksLikeLanguage(part string) bool {
+	lang, region, _ := strings.Cut(part, "-")
+	if len(lang) != 2 && len(lang) != 3 {
+		return false
+	}
+	if region != "" && len(region) != 2 {
+		return false
+	}
+	for _, ch := range lang {
+		if ch < 'a' || ch > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// bestSidecar picks the sidecar in the most wanted language. The ones without a language
+// come after the wanted languages, the ones in other languages are never picked.
+func bestSidecar(sidecars []Sidecar, langs []string) (Sidecar, bool) {
+	if len(langs) == 0 && len(sidecars) > 0 {
+		return sidecars[0], true
+	}
+	for _, lang := range langs {
+		for _, sidecar := range sidecars {
+			if sidecar.Language != "" && languageMatches(sidecar.Language, lang) {
+				return sidecar, true
+			}
+		}
+	}
+	for _, sidecar := range sidecars {
+		if sidecar.Language == "" {
+			return sidecar, true
+		}
+	}
+	return Sidecar{}, false
+}
+
+// useSidecar makes the tracks use the subtitle file given with --subs, or the best one next to videofile
+// when the 'sidecars' setting says so.
+func useSidecar(videofile string, tracks *SelectedTracks, config Config) error {
+	if config.arguments.SubsFile != "" {
+		sidecar, err := subtitleFile(config.arguments.SubsFile)
+		if err != nil {
+			return err
+		}
+		tracks.use(sidecar)
+		return nil
+	}
+	switch config.Sidecars {
+	case sidecarsNever:
+		return nil
+	case sidecarsFallback:
+		if tracks.SubsTrack != -1 {
+			return nil
+		}
+	case sidecarsPrefer:
+	default:
+		return fmt.Errorf("unknown sidecars setting %q, use %s, %s or %s", config.Sidecars, sidecarsNever, sidecarsFallback, sidecarsPrefer)
+	}
+	if sidecar, ok := bestSidecar(findSidecars(videofile), splitList(config.SubsLang)); ok {
+		tracks.use(sidecar)
+	}
+	return nil
+}
+
+// use makes the tracks use the subs in the sidecar instead of a subtitle track.
+func (tracks *SelectedTracks) use(sidecar Sidecar) {
+	Log("Using the subtitles in", sidecar.Path)
+	tracks.SubsTrack = -1
+	tracks.Sidecar = sidecar.Path
+	tracks.SubtitleType = sidecar.SubtitleType()
+}
+
+// the directories next to a subtitle file the fonts it uses are usually in.
+var sidecarFontDirs = []string{"fonts", "Fonts", "attachments"}
+
+// installSidecarFonts installs the fonts in the font directories next to an ass file for libass,
+// like extractFonts does for the fonts attached to the video.
+func installSidecarFonts(subsfile string) {
+	for _, name := range sidecarFontDirs {
+		dir := path.Join(path.Dir(subsfile), name)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		var fonts []media.Attachment
+		for _, entry := range entries {
+			if font := (media.Attachment{FileName: entry.Name()}); !entry.IsDir() && font.IsFont() {
+				fonts = append(fonts, font)
+			}
+		}
+		if len(fonts) == 0 {
+			continue
+		}
+		if err := copyFontsToLocalFontsDir(dir, fonts); err != nil {
+			LogErrorln("Cannot install the fonts in", dir, err)
+			continue
+		}
+		refreshFonts()
+	}
+}
+
+// languageMatches tells if a track in lang is one in the wanted language. A wanted "en" matches
+// "en-US" and "eng", a wanted "en-US" only matches "en-US" and its longer versions.
+func languageMatches(lang, wanted string) bool {
+	if strings.HasPrefix(strings.ToLower(lang), strings.ToLower(wanted)) {
+		return true
+	}
+	return !strings.Contains(wanted, "-") && media.SameLanguage(lang, wanted)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindSidecars(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"show_01.avi", "show_01.srt", "show_01.en.srt", "show_01.eng.forced.ass", "show_01.nl.txt", "show_02.en.srt"} {
+		if err := os.WriteFile(path.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sidecars := findSidecars(path.Join(dir, "show_01.avi"))
+	want := []Sidecar{
+		{Path: path.Join(dir, "show_01.en.srt"), Language: "en", Codec: "srt"},
+		{Path: path.Join(dir, "show_01.eng.forced.ass"), Language: "eng", Codec: "ass"},
+		{Path: path.Join(dir, "show_01.srt"), Codec: "srt"},
+	}
+	if !reflect.DeepEqual(sidecars, want) {
+		t.Fatalf("found %+v, want %+v", sidecars, want)
+	}
+	tests := []struct {
+		langs []string
+		want  string
+		found bool
+	}{
+		{[]string{"en"}, "show_01.en.srt", true},
+		{[]string{"nl", "en"}, "show_01.en.srt", true},
+		{[]string{"nl"}, "show_01.srt", true},
+		{nil, "show_01.en.srt", true},
+	}
+	for _, tt := range tests {
+		got, found := bestSidecar(sidecars, tt.langs)
+		if found != tt.found || path.Base(got.Path) != tt.want {
+			t.Errorf("bestSidecar(%v) = %s, %v, want %s", tt.langs, got.Path, found, tt.want)
+		}
+	}
+	if _, found := bestSidecar(sidecars[:2], []string{"nl"}); found {
+		t.Error("picked subs in a language we don't want")
+	}
+}
+
+// planAvi plans the conversion of an avi without subtitle streams, with the given files next to it.
+func planAvi(t *testing.T, configure func(c *Config), files ...string) (string, *Plan, error) {
+	return planVideo(t, "show_01.avi", configure, files...)
+}
+
+// planVideo plans the conversion of name, a video without subtitle streams, with the given files next to it.
+func planVideo(t *testing.T, name string, configure func(c *Config), files ...string) (string, *Plan, error) {
+	dir := t.TempDir()
+	video := path.Join(dir, name)
+	for _, name := range append(files, name) {
+		if err := os.WriteFile(path.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	useFakeRunner(t, FakeResponse{
+		Name:   "ffprobe",
+		Args:   append(ffprobe_args, video),
+		Stdout: `{"streams": [{"index": 0, "codec_name": "mpeg4", "codec_type": "video"}, {"index": 1, "codec_name": "mp3", "codec_type": "audio", "channels": 2}], "format": {"filename": "` + video + `", "duration": "60.000000"}}`,
+	})
+	cfg := DefaultConfig()
+	cfg.TargetDirectory = path.Join(dir, "converted")
+	cfg.Stages = "selecttracks,extractsubs,encode"
+	cfg.AudioLang = ""
+	cfg.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1, DryRun: true}
+	configure(&cfg)
+	pipeline, err := PipelineFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob(video, cfg)
+	job.Plan = &Plan{Input: video}
+	return dir, job.Plan, pipeline.Run(job)
+}
+
+func TestSidecarPlan(t *testing.T) {
+	dir, plan, err := planAvi(t, func(c *Config) {}, "show_01.en.srt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTracks := []PlannedTrack{
+		{Role: "video", ID: 0, Codec: "mpeg4"},
+		{Role: "audio", ID: 1, Codec: "mp3"},
+		{Role: "subtitles", ID: -1, Codec: "srt", File: path.Join(dir, "show_01.en.srt")},
+	}
+	if !reflect.DeepEqual(plan.Tracks, wantTracks) {
+		t.Errorf("tracks %+v, want %+v", plan.Tracks, wantTracks)
+	}
+	if want := []string{path.Join(dir, "converted", "show_01.mp4")}; !reflect.DeepEqual(plan.Outputs, want) {
+		t.Errorf("outputs %v, want %v", plan.Outputs, want)
+	}
+}
+
+func TestSubsFile(t *testing.T) {
+	t.Run("sup", func(t *testing.T) {
+		var subs string
+		dir, plan, err := planAvi(t, func(c *Config) {
+			subs = path.Join(path.Dir(c.TargetDirectory), "other.sup")
+			c.arguments.SubsFile = subs
+		}, "other.sup", "show_01.en.srt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.SubtitleType != "picture" || plan.Tracks[2].File != subs {
+			t.Errorf("using %s subs %+v, want the sup file", plan.SubtitleType, plan.Tracks[2])
+		}
+		want := "-i " + path.Join(dir, "show_01.avi") + " -i " + subs + " -filter_complex '[0:0][1:s:0]overlay[v]'"
+		if len(plan.Commands) != 1 || !strings.Contains(plan.Commands[0], want) {
+			t.Errorf("commands %q, want one with %q", plan.Commands, want)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		_, _, err := planAvi(t, func(c *Config) { c.arguments.SubsFile = "nothere.ass" })
+		if err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+			t.Errorf("want an error about the missing file, got %v", err)
+		}
+	})
+	t.Run("not subs", func(t *testing.T) {
+		_, _, err := planAvi(t, func(c *Config) { c.arguments.SubsFile = "notes.txt" })
+		if err == nil || !strings.Contains(err.Error(), "only srt, ass, ssa and sup") {
+			t.Errorf("want an error about the kind of file, got %v", err)
+		}
+	})
+	t.Run("never use sidecars", func(t *testing.T) {
+		_, _, err := planAvi(t, func(c *Config) { c.Sidecars = sidecarsNever }, "show_01.en.srt")
+		if err == nil || !strings.Contains(err.Error(), "no subtitle track or sidecar") {
+			t.Errorf("want an error about the missing subs, got %v", err)
+		}
+	})
+}
+
+func TestNoSubtitles(t *testing.T) {
+	dir, _, err := planVideo(t, "show_01.mp4", func(c *Config) {})
+	want := "no subtitle track or sidecar for " + path.Join(dir, "show_01.mp4")
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Run() error = %v, want %q", err, want)
+	}
+}
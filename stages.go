@@ -0,0 +1,420 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gertm/hardsub/media"
+	"github.com/gertm/hardsub/subfix"
+)
+
+var errNoTracks = errors.New("no tracks selected, run the selecttracks stage first")
+
+// ProbeStage gets the video properties we need for the progress bars.
+type ProbeStage struct{}
+
+func (ProbeStage) Name() string { return "probe" }
+
+func (ProbeStage) Run(job *Job) error {
+	job.Props = GetVideoPropertiesWithFFProbe(job.Input)
+	return nil
+}
+
+// SelectTracksStage picks the video, audio and subtitle tracks to use.
+type SelectTracksStage struct{}
+
+func (SelectTracksStage) Name() string { return "selecttracks" }
+
+func (SelectTracksStage) Run(job *Job) error {
+	info, err := job.mediaInfo()
+	if err != nil {
+		return fmt.Errorf("could not get the tracks: %w", err)
+	}
+	tracks, err := selectedTracks(info, job.Config)
+	if err != nil {
+		return fmt.Errorf("could not select tracks: %w", err)
+	}
+	if err := useSidecar(job.Input, tracks, job.Config); err != nil {
+		return err
+	}
+	if tracks.SubsTrack == -1 && tracks.Sidecar == "" {
+		return fmt.Errorf("no subtitle track or sidecar for %s", job.Input)
+	}
+	job.Tracks = tracks
+	if job.DryRun() {
+		job.Plan.Tracks = plannedTracks(info, tracks)
+		job.Plan.SubtitleType = tracks.SubtitleType.String()
+	}
+	return nil
+}
+
+// ExtractSubsStage extracts text based subtitles so we can forcibly select the correct one,
+// runs the post extraction hook, fixes SRT subs and extracts the fonts.
+type ExtractSubsStage struct{}
+
+func (ExtractSubsStage) Name() string { return "extractsubs" }
+
+func (ExtractSubsStage) Run(job *Job) error {
+	if job.Tracks == nil {
+		return errNoTracks
+	}
+	if job.Tracks.SubtitleType == PICTURE {
+		// picture based subs get overlayed straight from the video or sup file.
+		return nil
+	}
+	if job.Tracks.SubtitleType == SSA_ASS {
+		job.SubsFile = job.workspaceFile(subsFileFor(job.Input, ".ass"))
+	}
+	if job.Tracks.SubtitleType == SRT {
+		job.SubsFile = job.workspaceFile(subsFileFor(job.Input, ".srt"))
+	}
+	if job.Tracks.Sidecar != "" {
+		job.SubsFile = job.workspaceFile(subsFileFor(job.Input, path.Ext(job.Tracks.Sidecar)))
+		if !job.DryRun() {
+			// copied, as fixing the subs changes the file.
+			if err := copyFileTo(job.Tracks.Sidecar, job.SubsFile); err != nil {
+				return fmt.Errorf("error copying the subs: %w", err)
+			}
+		}
+	} else {
+		extractCmd := quietFFmpeg().
+			Input(job.Input, "-txt_format", "text").
+			Map(job.mapTrack(job.Tracks.SubsTrack)).
+			Output(job.SubsFile)
+		Log(extractCmd)
+		if err := job.ffmpeg(extractCmd, job.Props); err != nil {
+			return fmt.Errorf("error while extracting subs: %w", err)
+		}
+	}
+
+	if job.Config.PostSubExtract != "" {
+		postsubcmd := strings.ReplaceAll(job.Config.PostSubExtract, "%%s", job.SubsFile) + "\n"
+		if job.DryRun() {
+			job.Plan.PostSubExtract = postsubcmd
+			return nil
+		}
+		if err := RunBashCommand(postsubcmd); err != nil {
+			LogErrorln("Post Sub Extraction Command failed, check your script?\n", err)
+		}
+	}
+	if job.DryRun() {
+		return nil
+	}
+	if job.Tracks.SubtitleType == SRT {
+		subfix.FixSubs(job.SubsFile, 22, true, job.Config.Verbose)
+	}
+	if job.Config.ExtractFonts {
+		fontsDir := job.Workspace
+		if fontsDir == "" {
+			fontsDir = job.Config.TargetDirectory
+		}
+		info, err := job.mediaInfo()
+		if err != nil {
+			return fmt.Errorf("cannot list the attachments: %w", err)
+		}
+		if err := extractFonts(fontsDir, absPath(job.Input), info.Fonts()); err != nil {
+			return fmt.Errorf("error extracting fonts: %w", err)
+		}
+		if job.Tracks.Sidecar != "" && job.Tracks.SubtitleType == SSA_ASS {
+			installSidecarFonts(job.Tracks.Sidecar)
+		}
+	}
+	return nil
+}
+
+// EncodeStage burns the subtitles into the video.
+type EncodeStage struct{}
+
+func (EncodeStage) Name() string { return "encode" }
+
+func (EncodeStage) Run(job *Job) error {
+	if job.Tracks == nil {
+		return errNoTracks
+	}
+	if job.Tracks.SubtitleType != PICTURE && job.SubsFile == "" {
+		return fmt.Errorf("no subtitle file to burn in, run the extractsubs stage first")
+	}
+	profile, err := outputProfile(job.Config)
+	if err != nil {
+		return err
+	}
+	encoder, err := job.encoder()
+	if err != nil {
+		return err
+	}
+	rate, err := job.rateControl()
+	if err != nil {
+		return err
+	}
+	geometry, err := job.geometry()
+	if err != nil {
+		return err
+	}
+	audio, err := job.audioOutputs(profile)
+	if err != nil {
+		return err
+	}
+	var overlay string
+	if job.Tracks.SubtitleType == PICTURE {
+		if overlay, err = pictureOverlay(job, geometry); err != nil {
+			return err
+		}
+	}
+	log.Println("Starting re-encoding...")
+	run := func(cmds []*FFmpegCommand) error {
+		for _, cmd := range cmds {
+			Log("Convert Command:", cmd)
+		}
+		return job.ffmpegPasses(cmds, job.Props)
+	}
+	used, err := encodeWithFallback(encoder, run, func(encoder Encoder) []*FFmpegCommand {
+		var cmds []*FFmpegCommand
+		for _, pass := range rate.passes(encoder, job.workspaceFile("passlog")) {
+			cmds = append(cmds, encodeCommand(job, profile, encoder, pass, geometry, audio, overlay))
+		}
+		return cmds
+	})
+	if err != nil {
+		return fmt.Errorf("error running the conversion for %s: %w", job.Input, err)
+	}
+	// cutting the intro re-encodes with the encoder that worked.
+	job.Encoder = &used
+	return nil
+}
+
+// encodeCommand makes the command burning the subs into the video with the encoder at the rate.
+// The picture subs get overlaid with the overlay filter graph, which does the geometry itself.
+// The text subs get rendered after the geometry. A first pass only writes the pass log.
+func encodeCommand(job *Job, profile Profile, encoder Encoder, rate RateControl, geometry Geometry, audio []AudioOutput, overlay string) *FFmpegCommand {
+	cmd := quietFFmpeg().Input(job.Input)
+	if overlay != "" {
+		if job.Tracks.Sidecar != "" {
+			cmd.Input(job.Tracks.Sidecar)
+		}
+		// the frames only go to a hardware encoder at the end of the graph.
+		graph := strings.Join(append([]string{overlay}, encoder.Filters()...), ",")
+		cmd.
+			FilterComplex(graph + "[v]").
+			Map("[v]")
+	} else {
+		cmd.
+			Map(job.mapTrack(job.Tracks.VideoTrack)).
+			VideoFilter(geometry.Filters()...).
+			VideoFilter("subtitles=" + escapeFilterValue(job.SubsFile))
+	}
+	for _, output := range audio {
+		cmd.Map(output.Map)
+	}
+	encode := profile.encoding(encoder, rate, job.Config)
+	encode(cmd).Options(geometry.hdrOptions(encoder)...).X265Params(geometry.hdr10Params(encoder)).Options(audioOptions(audio)...)
+	if rate.Pass == 1 {
+		return cmd.Options("-an", "-f", "null").Output(os.DevNull)
+	}
+	return cmd.Output(job.OutputFile)
+}
+
+// pictureOverlay gives the filter graph overlaying the selected picture subs on the video after the geometry,
+// without the output label. The subs cover the whole picture, so they get scaled like the video, or to it
+// when they were made for another resolution, and moved with the crop.
+func pictureOverlay(job *Job, geometry Geometry) (string, error) {
+	subs, size, err := pictureSubs(job)
+	if err != nil {
+		return "", err
+	}
+	// the selected video track, [0:v] can be a cover picture or another video.
+	graph, video := "", "["+job.mapTrack(job.Tracks.VideoTrack)+"]"
+	if filters := geometry.Filters(); len(filters) > 0 {
+		graph, video = video+strings.Join(filters, ",")+"[video];", "[video]"
+	}
+	scale := geometry.scale()
+	scaled := func(size int) int { return int(float64(size)*scale + 0.5) }
+	width, height := scaled(geometry.Width), scaled(geometry.Height)
+	var options []string
+	if crop := geometry.Crop; crop != nil {
+		options = append(options, fmt.Sprintf("x=%d:y=%d", -scaled(crop.X), -scaled(crop.Y)))
+	}
+	if geometry.HDR != nil {
+		// overlay makes 8-bit video unless it's told otherwise.
+		options = append(options, "format=yuv420p10")
+	}
+	overlay := "overlay"
+	if len(options) > 0 {
+		overlay += "=" + strings.Join(options, ":")
+	}
+	if size.Width == 0 {
+		size.Width, size.Height = geometry.Width, geometry.Height
+	}
+	if size.Width == 0 || width == 0 || (size.Width == width && size.Height == height) {
+		return fmt.Sprintf("%s%s[%s]%s", graph, video, subs, overlay), nil
+	}
+	return fmt.Sprintf("%s[%s]scale=%d:%d[subs];%s[subs]%s", graph, subs, width, height, video, overlay), nil
+}
+
+// pictureSubs gives the stream specifier of the selected picture subs, relative to the subtitle streams
+// so it doesn't matter how the container numbers its streams, and their size when ffprobe knows it.
+func pictureSubs(job *Job) (string, media.Track, error) {
+	if job.Tracks.Sidecar != "" {
+		// a sup file only has the one subtitle stream.
+		var size media.Track
+		if probe, err := GetFFprobeInfo(job.Tracks.Sidecar); err == nil && len(probe.SubtitleStreams()) > 0 {
+			size = probe.MediaInfo().TracksOfType(media.Subtitles)[0]
+		}
+		return "1:s:0", size, nil
+	}
+	info, err := job.mediaInfo()
+	if err != nil {
+		return "", media.Track{}, err
+	}
+	for n, track := range info.TracksOfType(media.Subtitles) {
+		if track.ID != job.Tracks.SubsTrack {
+			continue
+		}
+		// mkvmerge doesn't know the size of picture subs, ffprobe does.
+		if probe, err := job.probeInfo(); err == nil && n < len(probe.SubtitleStreams()) {
+			subs := probe.SubtitleStreams()[n]
+			track.Width, track.Height = subs.Width, subs.Height
+		}
+		return fmt.Sprintf("0:s:%d", n), track, nil
+	}
+	return "", media.Track{}, fmt.Errorf("track %d is not a subtitle track of %s", job.Tracks.SubsTrack, job.Input)
+}
+
+// SpeedupStage makes a 1.5x speed version of the output when 'fastversion' is set.
+type SpeedupStage struct{}
+
+func (SpeedupStage) Name() string { return "speedup" }
+
+func (SpeedupStage) Run(job *Job) error {
+	if !job.Config.FastVersion {
+		return nil
+	}
+	if profile, _ := outputProfile(job.Config); profile.Video != "h264" {
+		log.Println("Skipping the fast version, it only works for h264 video.")
+		return nil
+	}
+	fastOutputFile := job.workspaceFile("FAST_" + path.Base(job.OutputFile))
+	if job.DryRun() {
+		firstPass, secondPass, _ := fastFileCommands(job.OutputFile, fastOutputFile)
+		job.ffmpeg(firstPass, job.Props)
+		job.ffmpeg(secondPass, job.Props)
+	} else {
+		log.Println(">>>>>>>>> Creating", fastOutputFile, ">>>>>>>>>>>")
+		if err := FastFile(job.OutputFile, fastOutputFile, job.Progress); err != nil {
+			// the normal speed version is still fine, so this doesn't fail the job.
+			log.Println(err)
+			log.Println("Keeping normal speed version because creating the fast version failed.")
+			return nil
+		}
+	}
+	if job.Config.KeepSlowVersion {
+		job.KeepOutput(fastOutputFile)
+		return nil
+	}
+	if !job.DryRun() {
+		os.RemoveAll(job.OutputFile)
+	}
+	job.OutputFile = fastOutputFile
+	return nil
+}
+
+// CutIntroStage cuts the intro out of the output when we know its boundaries.
+type CutIntroStage struct{}
+
+func (CutIntroStage) Name() string { return "cutintro" }
+
+func (CutIntroStage) Run(job *Job) error {
+	intro, err := job.Config.IntroFramesForFilename(job.OutputFile)
+	if err != nil {
+		log.Println("no intro boundaries definition found for", job.OutputFile, "  skipping...")
+		return nil
+	}
+	encode, err := job.encoding()
+	if err != nil {
+		return err
+	}
+	if job.DryRun() {
+		// where to cut depends on where ffmpeg finds the frames in the output.
+		job.Plan.Intro = &intro
+		job.ffmpeg(searchFrameCommand(job.OutputFile, intro.Begin), job.Props)
+		job.ffmpeg(searchFrameCommand(job.OutputFile, intro.End), job.Props)
+		cut := planCut("<begin>", "<end>", sexagesimal(job.Props.Duration), job.OutputFile, encode)
+		for _, cmd := range cut.commands {
+			job.ffmpeg(cmd, job.Props)
+		}
+		job.KeepOutput(job.OutputFile)
+		job.OutputFile = cut.noIntroFile
+		return nil
+	}
+	nointroFile, err := cutFragmentFromVideo(job.OutputFile, intro.Begin, intro.End, encode, job.Progress)
+	if err != nil {
+		Log("Error while intro cutting:", err)
+		return nil
+	}
+	// keep the version with the intro as well.
+	job.KeepOutput(job.OutputFile)
+	job.OutputFile = nointroFile
+	return nil
+}
+
+// PostProcessStage runs the configured postcmd on the output.
+type PostProcessStage struct{}
+
+func (PostProcessStage) Name() string { return "postprocess" }
+
+func (PostProcessStage) Run(job *Job) error {
+	if job.Config.PostCmd == "" {
+		return nil
+	}
+	Log("Running postcmd...")
+	postcommand := strings.ReplaceAll(job.Config.PostCmd, "%%o", job.OutputFile)
+	if job.DryRun() {
+		job.Plan.PostCmd = postcommand
+		return nil
+	}
+	if err := RunBashCommand(postcommand); err != nil {
+		log.Println("Post command failed, check your script?\n", err)
+	}
+	return nil
+}
+
+// ArchiveStage moves the original file out of the way.
+type ArchiveStage struct{}
+
+func (ArchiveStage) Name() string { return "archive" }
+
+func (ArchiveStage) Run(job *Job) error {
+	if job.Config.OriginalsDirectory == job.Config.TargetDirectory {
+		return nil
+	}
+	movedFile := path.Join(job.Config.OriginalsDirectory, path.Base(job.Input))
+	if job.DryRun() {
+		job.Plan.Original = movedFile
+		return nil
+	}
+	if err := createDirectoryIfNeeded(job.Config.OriginalsDirectory); err != nil {
+		return fmt.Errorf("cannot create originals directory: %w", err)
+	}
+	if err := os.Rename(job.Input, movedFile); err != nil {
+		return fmt.Errorf("error moving original: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// stderrTailLines is how many of the last lines of stderr a ToolError keeps.
+const stderrTailLines = 20
+
+// the -progress key=value lines and the -stats lines, which don't tell why ffmpeg failed.
+var progressLine = regexp.MustCompile(`^(frame|size)=|^\w+=\S*$`)
+
+// stderrTail is a ring buffer with the last lines a tool wrote to stderr, leaving out its progress.
+type stderrTail struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int // where the next line goes once the buffer is full
+	partial []byte
+}
+
+func newStderrTail(size int) *stderrTail {
+	return &stderrTail{lines: make([]string, 0, size)}
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexAny(t.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		t.add(string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	t.partial = append([]byte{}, t.partial...)
+	return len(p), nil
+}
+
+func (t *stderrTail) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || progressLine.MatchString(line) {
+		return
+	}
+	if len(t.lines) < cap(t.lines) {
+		t.lines = append(t.lines, line)
+		return
+	}
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+}
+
+// Lines returns the lines in the order the tool wrote them, with the last one even when it didn't end.
+func (t *stderrTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append(append([]string{}, t.lines[t.next:]...), t.lines[:t.next]...)
+	if last := strings.TrimSpace(string(t.partial)); last != "" && !progressLine.MatchString(last) {
+		lines = append(lines, last)
+	}
+	return lines[max(len(lines)-cap(t.lines), 0):]
+}
+
+// Failure is the reason a tool failed, when we recognise it in what it wrote to stderr.
+type Failure string
+
+const (
+	failureDiskFull         Failure = "disk full"
+	failurePermission       Failure = "permission denied"
+	failureUnknownEncoder   Failure = "unknown encoder"
+	failureMissingFont      Failure = "missing font"
+	failureInvalidSubtitles Failure = "invalid subtitles"
+)
+
+// what ffmpeg and libass write for each failure, in lowercase. The first failure that matches wins.
+var failurePatterns = []struct {
+	failure  Failure
+	patterns []string
+}{
+	{failureDiskFull, []string{"no space left on device", "disk quota exceeded"}},
+	{failurePermission, []string{"permission denied", "operation not permitted"}},
+	{failureUnknownEncoder, []string{"unknown encoder", "encoder not found", "no such encoder"}},
+	{failureMissingFont, []string{"fontselect: failed to find", "error opening font", "no usable fontconfig", "failed to find any fallback"}},
+	{failureInvalidSubtitles, []string{"error initializing filter 'subtitles'", "invalid ass", "invalid subtitle", "error decoding subtitle", "error while decoding subtitle"}},
+}
+
+// classifyFailure tells why a tool failed from the lines it wrote to stderr, or "" when it can't tell.
+func classifyFailure(lines []string) Failure {
+	for _, fp := range failurePatterns {
+		for _, line := range lines {
+			line = strings.ToLower(line)
+			for _, pattern := range fp.patterns {
+				if strings.Contains(line, pattern) {
+					return fp.failure
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// ToolError is a tool that exited with an error, with what it ran and the end of what it said about it.
+type ToolError struct {
+	Name     string
+	Command  string // the command line, quoted for a shell
+	ExitCode int
+	Failure  Failure  // why it failed, "" when we don't recognise it
+	Stderr   []string // the last lines of stderr
+	Err      error    // the *ExitError
+}
+
+func (e *ToolError) Error() string {
+	msg := fmt.Sprintf("%s: exitcode %d", e.Name, e.ExitCode)
+	// the last line is usually something like "Conversion failed!" when we know better.
+	if e.Failure != "" {
+		return msg + ": " + string(e.Failure)
+	}
+	if n := len(e.Stderr); n > 0 {
+		return msg + ": " + e.Stderr[n-1]
+	}
+	return msg
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// Details is the exit code, the end of stderr and the command, for the log and notifications.
+// The command comes last, it's long and the least likely to tell what went wrong.
+func (e *ToolError) Details() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "exit code: %d", e.ExitCode)
+	if e.Failure != "" {
+		fmt.Fprintf(&sb, " (%s)", e.Failure)
+	}
+	for _, line := range e.Stderr {
+		sb.WriteString("\n  " + line)
+	}
+	sb.WriteString("\ncommand: " + e.Command)
+	return sb.String()
+}
+
+// toolError turns the exit error of a tool into a ToolError with the end of its stderr.
+// Other errors, like a cancelled context, are returned as they are.
+func toolError(name string, args []string, err error, stderr *stderrTail) error {
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	lines := stderr.Lines()
+	return &ToolError{
+		Name:     name,
+		Command:  shellJoin(append([]string{name}, args...)),
+		ExitCode: exitErr.Code,
+		Failure:  classifyFailure(lines),
+		Stderr:   lines,
+		Err:      err,
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStderrTail(t *testing.T) {
+	tail := newStderrTail(3)
+	io.WriteString(tail, "one\ntwo\nframe=  100 fps=50 q=28.0\rout_time_us=100\nprogress=continue\nthr")
+	io.WriteString(tail, "ee\n\nfour\nfive")
+	if got, want := tail.Lines(), []string{"three", "four", "five"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines() = %q, want %q", got, want)
+	}
+	io.WriteString(tail, "\n")
+	if got, want := tail.Lines(), []string{"three", "four", "five"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines() after the newline = %q, want %q", got, want)
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   Failure
+	}{
+		{"[Parsed_subtitles_0 @ 0x55] fontselect: failed to find any fallback with glyph 0x3042 for font: (Arial, 400, 0)", failureMissingFont},
+		{"[AVFilterGraph @ 0x55] Error initializing filter 'subtitles' with args 'subs.ass'", failureInvalidSubtitles},
+		{"Unknown encoder 'libsvtav1'", failureUnknownEncoder},
+		{"[mp4 @ 0x55] Error writing trailer: No space left on device", failureDiskFull},
+		{"/target/show.mp4: Permission denied", failurePermission},
+		{"Error opening input files: Invalid data found when processing input", ""},
+	}
+	for _, tt := range tests {
+		if got := classifyFailure([]string{"Conversion failed!", tt.stderr}); got != tt.want {
+			t.Errorf("classifyFailure(%q) = %q, want %q", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestStreamToolError(t *testing.T) {
+	useFakeRunner(t, FakeResponse{
+		Name:     "ffmpeg",
+		Stderr:   "out_time_us=1000000\nprogress=continue\nUnknown encoder 'libsvtav1'\n",
+		ExitCode: 1,
+	})
+	err := streamTool(context.Background(), "ffmpeg", []string{"-i", "in put.mkv", "-c:v", "libsvtav1", "out.webm"}, func(stderr io.Reader) {})
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		t.Fatalf("streamTool() error = %v, want a *ToolError", err)
+	}
+	want := ToolError{
+		Name:     "ffmpeg",
+		Command:  "ffmpeg -i 'in put.mkv' -c:v libsvtav1 out.webm",
+		ExitCode: 1,
+		Failure:  failureUnknownEncoder,
+		Stderr:   []string{"Unknown encoder 'libsvtav1'"},
+	}
+	got := *toolErr
+	got.Err = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("streamTool() error = %+v, want %+v", got, want)
+	}
+	if got, want := err.Error(), "ffmpeg: exitcode 1: unknown encoder"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 1 {
+		t.Errorf("the ToolError doesn't wrap the exit error: %v", err)
+	}
+	if details := toolErr.Details(); !strings.HasPrefix(details, "exit code: 1 (unknown encoder)\n  Unknown encoder") ||
+		!strings.HasSuffix(details, "command: "+want.Command) {
+		t.Errorf("Details() = %q", details)
+	}
+}
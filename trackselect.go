@@ -0,0 +1,273 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// subtitleTypeFor tells how we need to handle subs of this track, if we know how.
+func subtitleTypeFor(track media.Track) (SubsType, bool) {
+	switch track.SubsCodec() {
+	case "ass":
+		return SSA_ASS, true
+	case "srt":
+		return SRT, true
+	case "pgs", "vobsub", "dvbsub", "bmp":
+		return PICTURE, true
+	}
+	return SRT, false
+}
+
+// TrackRules are the rules from the config that score the audio and subtitle tracks.
+type TrackRules struct {
+	AudioLangs      []string
+	SubsLangs       []string
+	SubsName        string
+	AudioInclude    *regexp.Regexp
+	AudioExclude    *regexp.Regexp
+	SubsInclude     *regexp.Regexp
+	SubsExclude     *regexp.Regexp
+	ForcedScore     int
+	DefaultScore    int
+	HearingImpaired int
+	SubsCodecs      []string
+	AudioChannels   int
+}
+
+// splitList splits a comma separated setting, dropping the empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// compileRule compiles the regex of a setting, leaving it nil when it's empty.
+func compileRule(setting, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", setting, err)
+	}
+	return re, nil
+}
+
+func trackRulesFromConfig(config Config) (TrackRules, error) {
+	rules := TrackRules{
+		AudioLangs:      splitList(config.AudioLang),
+		SubsLangs:       splitList(config.SubsLang),
+		SubsName:        strings.ToLower(config.SubsName),
+		ForcedScore:     config.ForcedScore,
+		DefaultScore:    config.DefaultScore,
+		HearingImpaired: config.HearingImpairedScore,
+		SubsCodecs:      splitList(strings.ToLower(config.SubsCodecs)),
+		AudioChannels:   config.AudioChannels,
+	}
+	var err error
+	for _, rule := range []struct {
+		setting, expr string
+		re            **regexp.Regexp
+	}{
+		{"audioinclude", config.AudioInclude, &rules.AudioInclude},
+		{"audioexclude", config.AudioExclude, &rules.AudioExclude},
+		{"subsinclude", config.SubsInclude, &rules.SubsInclude},
+		{"subsexclude", config.SubsExclude, &rules.SubsExclude},
+	} {
+		if *rule.re, err = compileRule(rule.setting, rule.expr); err != nil {
+			return rules, err
+		}
+	}
+	return rules, nil
+}
+
+// ScoredTrack is a track with the score the rules gave it and why.
+type ScoredTrack struct {
+	media.Track
+	Score    int
+	Reasons  []string
+	Excluded string // why the track can't be used, empty when it can
+}
+
+func (t *ScoredTrack) add(points int, reason string) {
+	t.Score += points
+	t.Reasons = append(t.Reasons, fmt.Sprintf("%s %+d", reason, points))
+}
+
+// languageScore prefers the languages in the order they're listed, matching "en" to "en-US" and "eng" as well.
+func languageScore(t *ScoredTrack, langs []string) {
+	if len(langs) == 0 {
+		return
+	}
+	for i, lang := range langs {
+		if languageMatches(t.Language, lang) {
+			t.add(100-20*i, "language "+t.Language)
+			return
+		}
+	}
+	t.Excluded = fmt.Sprintf("language %q is not in %s", t.Language, strings.Join(langs, ","))
+}
+
+func nameRules(t *ScoredTrack, include, exclude *regexp.Regexp) {
+	if include != nil && !include.MatchString(t.Name) {
+		t.Excluded = fmt.Sprintf("name %q doesn't match %s", t.Name, include)
+	}
+	if exclude != nil && exclude.MatchString(t.Name) {
+		t.Excluded = fmt.Sprintf("name %q matches %s", t.Name, exclude)
+	}
+}
+
+func (r TrackRules) flagScores(t *ScoredTrack) {
+	if t.Forced && r.ForcedScore != 0 {
+		t.add(r.ForcedScore, "forced")
+	}
+	if t.Default && r.DefaultScore != 0 {
+		t.add(r.DefaultScore, "default")
+	}
+	if t.HearingImpaired && r.HearingImpaired != 0 {
+		t.add(r.HearingImpaired, "hearing impaired")
+	}
+}
+
+// Score scores a track according to the rules.
+func (r TrackRules) Score(track media.Track) ScoredTrack {
+	t := ScoredTrack{Track: track}
+	switch track.Type {
+	case media.Audio:
+		languageScore(&t, r.AudioLangs)
+		nameRules(&t, r.AudioInclude, r.AudioExclude)
+		r.flagScores(&t)
+		if r.AudioChannels > 0 && track.Channels == r.AudioChannels {
+			t.add(15, fmt.Sprintf("%d channels", track.Channels))
+		}
+	case media.Subtitles:
+		languageScore(&t, r.SubsLangs)
+		nameRules(&t, r.SubsInclude, r.SubsExclude)
+		r.flagScores(&t)
+		codec := track.SubsCodec()
+		for i, preferred := range r.SubsCodecs {
+			if codec == preferred {
+				t.add(30-10*i, "codec "+codec)
+				break
+			}
+		}
+		if r.SubsName != "" && strings.Contains(strings.ToLower(track.Name), r.SubsName) {
+			t.add(20, fmt.Sprintf("name contains %q", r.SubsName))
+		}
+	}
+	return t
+}
+
+// TrackSelection holds every scored track and the ones that got picked.
+type TrackSelection struct {
+	Media    *media.MediaInfo
+	Tracks   []ScoredTrack
+	Selected SelectedTracks
+}
+
+// best returns the id of the highest scoring usable track of a type, the first one on a tie.
+// When none can be used but there's only one track of the type, that one is used anyway.
+func best(tracks []ScoredTrack, trackType string) int {
+	id, score, count, only := -1, 0, 0, -1
+	for _, t := range tracks {
+		if t.Type != trackType {
+			continue
+		}
+		count++
+		only = t.ID
+		if t.Excluded != "" {
+			continue
+		}
+		if id == -1 || t.Score > score {
+			id, score = t.ID, t.Score
+		}
+	}
+	if id == -1 && count == 1 {
+		return only
+	}
+	return id
+}
+
+// selectTracks scores the tracks of the video and picks the best video, audio and subtitle track,
+// unless the arguments force a track.
+func selectTracks(info *media.MediaInfo, config Config) (*TrackSelection, error) {
+	rules, err := trackRulesFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	selection := TrackSelection{Media: info, Selected: SelectedTracks{VideoTrack: -1, AudioTrack: -1, SubsTrack: -1}}
+	for _, track := range info.Tracks {
+		selection.Tracks = append(selection.Tracks, rules.Score(track))
+		if track.Type == media.Video && selection.Selected.VideoTrack == -1 {
+			selection.Selected.VideoTrack = track.ID
+		}
+	}
+	selection.Selected.AudioTrack = best(selection.Tracks, media.Audio)
+	selection.Selected.SubsTrack = best(selection.Tracks, media.Subtitles)
+	if config.arguments.ForceAudioTrack != -1 {
+		selection.Selected.AudioTrack = config.arguments.ForceAudioTrack
+	}
+	if config.arguments.ForceSubsTrack != -1 {
+		selection.Selected.SubsTrack = config.arguments.ForceSubsTrack
+	}
+	if config.AudioTracks > 1 && selection.Selected.AudioTrack != -1 {
+		// only mkv players let you pick between the audio tracks.
+		if profile, err := outputProfile(config); err == nil && profile.Container == "mkv" {
+			selection.Selected.ExtraAudio = extraAudio(selection.Tracks, selection.Selected.AudioTrack, config.AudioTracks-1)
+		}
+	}
+	if subs, ok := info.Track(selection.Selected.SubsTrack); ok {
+		if subsType, ok := subtitleTypeFor(subs); ok {
+			selection.Selected.SubtitleType = subsType
+		}
+	}
+	return &selection, nil
+}
+
+// WriteExplanation writes how every audio and subtitle track scored and which ones got picked.
+func (s *TrackSelection) WriteExplanation(w io.Writer) {
+	for _, t := range s.Tracks {
+		if t.Type != media.Audio && t.Type != media.Subtitles {
+			continue
+		}
+		mark := " "
+		if t.ID == s.Selected.AudioTrack || t.ID == s.Selected.SubsTrack || slices.Contains(s.Selected.ExtraAudio, t.ID) {
+			mark = "*"
+		}
+		track := PlannedTrack{Role: t.Type, ID: t.ID, Codec: t.Codec, Language: t.Language, Name: t.Name}
+		fmt.Fprintf(w, "  %s %-10s %s\n", mark, t.Type+":", track)
+		if t.Excluded != "" {
+			fmt.Fprintf(w, "      excluded: %s\n", t.Excluded)
+			continue
+		}
+		fmt.Fprintf(w, "      score %d", t.Score)
+		if len(t.Reasons) > 0 {
+			fmt.Fprintf(w, ": %s", strings.Join(t.Reasons, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gertm/hardsub/media"
+)
+
+// testvideo2Info is what the recorded mkvmerge says about testvideo2.mkv.
+func testvideo2Info(t *testing.T) *media.MediaInfo {
+	useRecordedRunner(t, "testdata/testvideo2.json")
+	info, err := GetMkvMergeInfo("testvideo2.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestSelectTracks(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(c *Config)
+		audio     int
+		subs      int
+	}{
+		{"defaults", func(c *Config) {}, 1, 4},
+		{"language order", func(c *Config) { c.AudioLang = "en,ja" }, 2, 4},
+		{"unwanted language falls back to the first listed", func(c *Config) { c.AudioLang = "de,ja" }, 1, 4},
+		{"no usable track", func(c *Config) { c.SubsLang = "de" }, 1, -1},
+		{"exclude by name", func(c *Config) { c.AudioLang = "en,ja"; c.AudioExclude = "(?i)dub" }, 1, 4},
+		{"include by name", func(c *Config) { c.SubsExclude = ""; c.SubsInclude = "Songs" }, 1, 3},
+		{"prefer forced", func(c *Config) { c.SubsExclude = ""; c.ForcedScore = 50 }, 1, 3},
+		{"channels", func(c *Config) { c.AudioLang = ""; c.AudioChannels = 6 }, 2, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := testvideo2Info(t)
+			c := DefaultConfig()
+			c.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1}
+			tt.configure(&c)
+			selection, err := selectTracks(info, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selection.Selected; got.VideoTrack != 0 || got.AudioTrack != tt.audio || got.SubsTrack != tt.subs {
+				t.Errorf("selected %+v, want audio %d and subs %d", got, tt.audio, tt.subs)
+			}
+		})
+	}
+}
+
+func TestSelectTracksInvalidRule(t *testing.T) {
+	info := testvideo2Info(t)
+	c := DefaultConfig()
+	c.SubsExclude = "(songs"
+	if _, err := selectTracks(info, c); err == nil || !strings.Contains(err.Error(), "subsexclude") {
+		t.Errorf("want an error about subsexclude, got %v", err)
+	}
+}
+
+func TestWriteExplanation(t *testing.T) {
+	info := testvideo2Info(t)
+	c := DefaultConfig()
+	c.arguments = Arguments{ForceAudioTrack: -1, ForceSubsTrack: -1}
+	selection, err := selectTracks(info, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	selection.WriteExplanation(&out)
+	want := `  * audio:     #1 AAC [ja]
+      score 110: language ja +100, default +10
+    audio:     #2 AAC [en] "English Dub"
+      excluded: language "en" is not in ja
+    subtitles: #3 SubStationAlpha [en] "Signs & Songs"
+      excluded: name "Signs & Songs" matches (?i)signs|songs
+  * subtitles: #4 SubStationAlpha [en] "Full Subtitles"
+      score 160: language en +100, default +10, codec ass +30, name contains "subtitles" +20
+`
+	if out.String() != want {
+		t.Errorf("explanation:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
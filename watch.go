@@ -0,0 +1,100 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// how often to check if a new file is still being written.
+var writePollInterval = 3 * time.Second
+
+// watchForVideos sends the videos with one of the extensions that show up in dir to incoming,
+// once they're done being written. It only returns when ctx is done or watching fails.
+func watchForVideos(ctx context.Context, dir string, extensions []string, incoming chan<- string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cannot create watcher: %w", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("cannot watch %s: %w", dir, err)
+	}
+	if config.Verbose {
+		log.Printf("Watching directory %v for incoming videos.\n", dir)
+	}
+	var writing sync.Map // the files we're waiting for
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) || !hasExtension(event.Name, extensions) {
+				continue
+			}
+			if _, already := writing.LoadOrStore(event.Name, true); already {
+				continue
+			}
+			go func(file string) {
+				defer writing.Delete(file)
+				if err := waitForWriteToFinish(ctx, file); err != nil {
+					log.Println(err)
+					return
+				}
+				incoming <- file
+			}(event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Println("error watching for videos:", err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitForWriteToFinish waits until the size of file stopped changing for a few checks.
+func waitForWriteToFinish(ctx context.Context, file string) error {
+	var size int64
+	sameSize := 0
+	for sameSize < 3 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(writePollInterval):
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.Size() != size {
+			size = info.Size()
+			sameSize = 0
+			continue
+		}
+		sameSize++
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWatchForVideos(t *testing.T) {
+	defer func(interval time.Duration) { writePollInterval = interval }(writePollInterval)
+	writePollInterval = 10 * time.Millisecond
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	incoming := make(chan string, 10)
+	watching := make(chan error, 1)
+	go func() { watching <- watchForVideos(ctx, dir, []string{"mkv", "mp4"}, incoming) }()
+	time.Sleep(50 * time.Millisecond) // give the watcher time to start.
+	for _, name := range []string{"notes.txt", "show_01.MP4"} {
+		if err := os.WriteFile(path.Join(dir, name), []byte("video"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case got := <-incoming:
+		if got != path.Join(dir, "show_01.MP4") {
+			t.Errorf("got %s, want the mp4", got)
+		}
+	case err := <-watching:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mp4 never came in")
+	}
+	select {
+	case got := <-incoming:
+		t.Errorf("got %s as well", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Gert Meulyzer
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// createWorkspace makes the directory the job writes everything to until the output is done.
+// It lives in the target directory by default, so moving the output into place is a rename.
+// Anything watching the target directory should ignore it, it's a hidden directory.
+func (j *Job) createWorkspace() error {
+	parent := j.Config.WorkDirectory
+	if parent == "" {
+		parent = j.Config.TargetDirectory
+	}
+	if parent == "" {
+		parent = "."
+	}
+	if j.DryRun() {
+		// only the name matters for the plan.
+		j.Workspace = path.Join(parent, ".hardsub-dryrun")
+		j.OutputFile = j.workspaceFile(path.Base(j.OutputFile))
+		return nil
+	}
+	if err := createDirectoryIfNeeded(parent); err != nil {
+		return fmt.Errorf("cannot create directory for the workspace: %w", err)
+	}
+	workspace, err := os.MkdirTemp(parent, ".hardsub-")
+	if err != nil {
+		return fmt.Errorf("cannot create workspace: %w", err)
+	}
+	j.Workspace = workspace
+	j.OutputFile = j.workspaceFile(path.Base(j.OutputFile))
+	j.OnFinish(func() { os.RemoveAll(workspace) })
+	return nil
+}
+
+// workspaceFile is the path for name inside the workspace, or next to the output when there's no workspace.
+func (j *Job) workspaceFile(name string) string {
+	if j.Workspace == "" {
+		return path.Join(path.Dir(j.OutputFile), name)
+	}
+	return path.Join(j.Workspace, name)
+}
+
+// KeepOutput marks a file in the workspace that needs to end up in the target directory next to the output.
+func (j *Job) KeepOutput(file string) {
+	j.extraOutputs = append(j.extraOutputs, file)
+}
+
+// publish moves the output out of the workspace into the target directory.
+func (j *Job) publish() error {
+	if j.Workspace == "" || j.published {
+		return nil
+	}
+	target := j.Config.TargetDirectory
+	if target == "" {
+		target = "."
+	}
+	if j.DryRun() {
+		for _, extra := range j.extraOutputs {
+			j.Plan.Outputs = append(j.Plan.Outputs, path.Join(target, path.Base(extra)))
+		}
+		j.OutputFile = path.Join(target, path.Base(j.OutputFile))
+		j.Plan.Outputs = append(j.Plan.Outputs, j.OutputFile)
+		j.published = true
+		return nil
+	}
+	if err := createDirectoryIfNeeded(target); err != nil {
+		return fmt.Errorf("cannot create target directory: %w", err)
+	}
+	if !FileExists(j.OutputFile) {
+		return fmt.Errorf("no output to publish: %s doesn't exist", j.OutputFile)
+	}
+	for _, extra := range j.extraOutputs {
+		if !FileExists(extra) {
+			continue
+		}
+		if err := moveFile(extra, path.Join(target, path.Base(extra))); err != nil {
+			return err
+		}
+	}
+	final := path.Join(target, path.Base(j.OutputFile))
+	if err := moveFile(j.OutputFile, final); err != nil {
+		return err
+	}
+	j.OutputFile = final
+	if j.Config.KeepSubs && j.SubsFile != "" && FileExists(j.SubsFile) {
+		// the subs used to be extracted next to the original, keep them there.
+		if err := moveFile(j.SubsFile, path.Join(path.Dir(j.Input), path.Base(j.SubsFile))); err != nil {
+			LogErrorln("could not keep the subs:", err)
+		}
+	}
+	j.published = true
+	return nil
+}
+
+// moveFile renames src to dst. When they're on different filesystems, it copies to
+// a hidden file next to dst first, so dst never shows up half written.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	tmp := path.Join(path.Dir(dst), "."+path.Base(dst)+".part")
+	if err := copyFileTo(src, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot move %s to %s: %w", src, dst, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot move %s to %s: %w", src, dst, err)
+	}
+	return os.Remove(src)
+}
+
+func copyFileTo(src, dst string) error {
+	fin, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	fout, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fout, fin); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
+
+// subsFileFor is the name of the extracted subtitle file for videofile.
+func subsFileFor(videofile, extension string) string {
+	base := path.Base(videofile)
+	return strings.TrimSuffix(base, path.Ext(base)) + extension
+}